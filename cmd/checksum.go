@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// newHash returns a hash.Hash for the named algorithm, or nil if the algorithm is not supported.
+func newHash(algorithm string) hash.Hash {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// parseChecksum splits a checksum of the form algorithm:hex into its algorithm and digest.
+func parseChecksum(checksum string) (string, []byte, error) {
+	algorithm, digest, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return "", nil, ErrInvalidChecksum
+	}
+	h := newHash(algorithm)
+	if h == nil {
+		return "", nil, ErrInvalidChecksum
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != h.Size() {
+		return "", nil, ErrInvalidChecksum
+	}
+	return strings.ToLower(algorithm), sum, nil
+}
+
+// verifyChecksum computes the hash of the file at path and compares it against checksum.
+func verifyChecksum(path, checksum string) error {
+	algorithm, expected, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := newHash(algorithm)
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+
+	actual := h.Sum(nil)
+	if hex.EncodeToString(actual) != hex.EncodeToString(expected) {
+		return ChecksumError{
+			Path:      path,
+			Algorithm: algorithm,
+			Expected:  hex.EncodeToString(expected),
+			Actual:    hex.EncodeToString(actual),
+		}
+	}
+	return nil
+}
+
+// fileHash hashes the data of a file as it is written, so that the file doesn't have to be
+// read again once it is downloaded. size counts the bytes hashed so far.
+type fileHash struct {
+	hash.Hash
+	size int64
+}
+
+// newFileHash returns a fileHash for the named algorithm, or nil if algorithm is empty.
+func newFileHash(algorithm string) *fileHash {
+	if len(algorithm) == 0 {
+		return nil
+	}
+	return &fileHash{Hash: newHash(algorithm)}
+}
+
+func (h *fileHash) Write(b []byte) (int, error) {
+	n, err := h.Hash.Write(b)
+	h.size += int64(n)
+	return n, err
+}
+
+func (h *fileHash) Reset() {
+	h.Hash.Reset()
+	h.size = 0
+}
+
+// sum returns the hex encoded hash of the file at path. The file is only read if not all
+// of its data was hashed as it was written, e.g. because it was downloaded in segments or
+// by an earlier run.
+func (h *fileHash) sum(path string) (string, error) {
+	size, err := getExistingFileSize(path)
+	if err != nil {
+		return "", err
+	}
+	if size != h.size {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		h.Reset()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumAlgorithms maps the length of a hex encoded digest to the algorithm producing it.
+var checksumAlgorithms = map[int]string{32: "md5", 40: "sha1", 64: "sha256", 128: "sha512"}
+
+// checksumManifest maps the name of each file listed in a checksums file, such as
+// SHA256SUMS, to its checksum as algorithm:hex.
+type checksumManifest map[string]string
+
+// lookup returns the checksum of the file saved to name, a slash separated path relative to
+// the download location. A file listed under its base name only matches that name.
+func (m checksumManifest) lookup(name string) (string, bool) {
+	if checksum, ok := m[name]; ok {
+		return checksum, true
+	}
+	checksum, ok := m[path.Base(name)]
+	return checksum, ok
+}
+
+// readChecksumFile reads the checksums file at path.
+func readChecksumFile(path string) (checksumManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, InvalidInputError{fmt.Errorf("%w: %v", ErrInvalidChecksumFile, err)}
+	}
+	defer f.Close()
+	manifest, err := parseChecksumFile(f)
+	if err != nil {
+		return nil, InvalidInputError{fmt.Errorf("%w: %v in %s", ErrInvalidChecksumFile, err, path)}
+	}
+	return manifest, nil
+}
+
+// parseChecksumFile parses the "<hex>  <name>" lines written by tools such as sha256sum,
+// where a * before the name marks a file hashed in binary mode. The algorithm of each line
+// is told by the length of its digest. Blank lines and lines starting with # are skipped.
+func parseChecksumFile(r io.Reader) (checksumManifest, error) {
+	manifest := make(checksumManifest)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, name, ok := strings.Cut(line, " ")
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		algorithm := checksumAlgorithms[len(digest)]
+		if _, err := hex.DecodeString(digest); !ok || err != nil || len(algorithm) == 0 || len(name) == 0 {
+			return nil, fmt.Errorf("invalid checksum on line %d", lineNum)
+		}
+		manifest[path.Clean(name)] = algorithm + ":" + strings.ToLower(digest)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
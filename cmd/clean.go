@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// staleFile is a .part file, segment file or sidecar file left behind by an interrupted
+// download.
+type staleFile struct {
+	path string
+	size int64
+}
+
+// findStaleFiles returns the .part files, segment files and sidecar files in location and
+// its sub-directories, sorted by path. A .part file or segment file is only returned if
+// its download has a sidecar file, so files of the user that happen to have the same
+// suffix are left alone.
+func findStaleFiles(location string) ([]staleFile, error) {
+	var files []staleFile
+	err := filepath.WalkDir(location, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if downloadPath, ok := trimPartPath(path); ok {
+			if !fileExists(getMetaPath(downloadPath)) {
+				return nil
+			}
+		} else if !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, staleFile{path: path, size: info.Size()})
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, InvalidInputError{fmt.Errorf("%w: %s", ErrLocationNotExist, location)}
+	}
+	return files, err
+}
+
+// confirm asks question on w and reports whether the answer read from stdin is yes.
+func confirm(w io.Writer, question string) (bool, error) {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	scanner := bufio.NewScanner(stdin)
+	if !scanner.Scan() {
+		fmt.Fprintln(w)
+		return false, scanner.Err()
+	}
+	answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+	return answer == "y" || answer == "yes", nil
+}
+
+// HandleClean handles the clean sub-command, which lists the .part files and sidecar
+// files left behind by interrupted downloads and deletes them once confirmed.
+func HandleClean(w io.Writer, args []string) error {
+	var location string
+	var yes bool
+
+	flags := flag.NewFlagSet("clean", flag.ContinueOnError)
+	flags.SetOutput(w)
+	flags.StringVar(&location, "location", DefaultLocation, "Download location to clean")
+	flags.BoolVar(&yes, "yes", false, "Delete the files without asking for confirmation")
+	flags.Usage = func() {
+		var usageString = `
+clean: A sub-command for deleting partial downloads
+
+clean: <options>`
+		fmt.Fprint(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "options: ")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return FlagParsingError{err}
+	}
+	if flags.NArg() != 0 {
+		return InvalidInputError{ErrCleanArgs}
+	}
+
+	files, err := findStaleFiles(location)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(w, "No partial downloads found in %s\n", location)
+		return nil
+	}
+
+	var total int64
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSIZE")
+	for _, file := range files {
+		fmt.Fprintf(tw, "%s\t%s\n", file.path, formatByteSize(float64(file.size)))
+		total += file.size
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d file(s), %s\n", len(files), formatByteSize(float64(total)))
+
+	if !yes {
+		ok, err := confirm(w, "Delete them?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintln(w, "No files were deleted")
+			return nil
+		}
+	}
+	for _, file := range files {
+		err := os.Remove(file.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "Deleted %d file(s), freeing %s\n", len(files), formatByteSize(float64(total)))
+	return nil
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandleClean(t *testing.T) {
+	defer func() { stdin = os.Stdin }()
+
+	testCases := []struct {
+		args    []string
+		input   string
+		deleted bool
+	}{
+		{input: "n\n", deleted: false},
+		{input: "", deleted: false},
+		{input: "y\n", deleted: true},
+		{args: []string{"-yes"}, deleted: true},
+	}
+	for _, tc := range testCases {
+		location := t.TempDir()
+		stale := []string{
+			filepath.Join(location, "file.txt.part"),
+			filepath.Join(location, "file.txt.dlmeta"),
+			filepath.Join(location, "assets", "go.pdf.part"),
+			filepath.Join(location, "assets", "go.pdf.dlmeta"),
+			filepath.Join(location, "video.mp4.part0"),
+			filepath.Join(location, "video.mp4.part12"),
+			filepath.Join(location, "video.mp4.dlmeta"),
+		}
+		// Files with the suffix of a .part file but no sidecar file may not be from a download
+		kept := []string{
+			filepath.Join(location, "done.txt"),
+			filepath.Join(location, "notes.txt.part"),
+			filepath.Join(location, "backup.tar.part1"),
+		}
+		err := os.MkdirAll(filepath.Join(location, "assets"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range append(stale, kept...) {
+			err := os.WriteFile(path, []byte("hello"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stdin = strings.NewReader(tc.input)
+		byteBuf := new(bytes.Buffer)
+		err = HandleClean(byteBuf, append(tc.args, "-location", location))
+		if err != nil {
+			t.Fatalf("%v: Expected nil error. Got: %v", tc.args, err)
+		}
+		output := byteBuf.String()
+		for _, path := range stale {
+			if !strings.Contains(output, path) {
+				t.Fatalf("%v: Expected %s to be listed, Got: %q", tc.args, path, output)
+			}
+			_, err := os.Stat(path)
+			if tc.deleted != errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("%v: Expected %s to be deleted: %v, Got: %v", tc.args, path, tc.deleted, err)
+			}
+		}
+		for _, path := range kept {
+			if strings.Contains(output, path) {
+				t.Fatalf("%v: Expected %s not to be listed, Got: %q", tc.args, path, output)
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("%v: Expected %s to be kept, Got: %v", tc.args, path, err)
+			}
+		}
+		if tc.deleted && !strings.Contains(output, "Deleted 7 file(s), freeing 35 B") {
+			t.Fatalf("%v: Expected the deleted files to be reported, Got: %q", tc.args, output)
+		}
+	}
+}
+
+func TestHandleCleanErrors(t *testing.T) {
+	byteBuf := new(bytes.Buffer)
+	location := t.TempDir()
+	err := HandleClean(byteBuf, []string{"-location", location})
+	if err != nil || byteBuf.String() != "No partial downloads found in "+location+"\n" {
+		t.Fatalf("Expected nothing to clean, Got: %v, %q", err, byteBuf.String())
+	}
+
+	err = HandleClean(byteBuf, []string{"-location", filepath.Join(t.TempDir(), "missing")})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrLocationNotExist) {
+		t.Fatalf("Expected ErrLocationNotExist, Got: %v", err)
+	}
+
+	err = HandleClean(byteBuf, []string{"downloads"})
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrCleanArgs) {
+		t.Fatalf("Expected ErrCleanArgs, Got: %v", err)
+	}
+
+	err = HandleClean(byteBuf, []string{"-force"})
+	if !errors.As(err, &FlagParsingError{}) {
+		t.Fatalf("Expected a flag parsing error, Got: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// subCommands lists the sub-commands of dlmanager that are completed.
+var subCommands = []struct {
+	name        string
+	description string
+}{
+	{"download", "Download files"},
+	{"version", "Print the version"},
+	{"completion", "Print a shell completion script"},
+	{"clean", "Delete partial downloads"},
+	{"list", "List partial downloads that can be resumed"},
+	{"head", "Print the metadata of a url without downloading it"},
+}
+
+// completionShells lists the shells completion scripts are generated for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// Values completed for download flags. Other flags that take a value complete nothing.
+var (
+	dirFlags   = map[string]bool{"location": true}
+	fileFlags  = map[string]bool{"url-file": true, "config": true, "cacert": true, "token-file": true}
+	flagValues = map[string][]string{"on-conflict": {ConflictRename, ConflictSkip, ConflictError}, "on-oversize": {OversizeRestart, OversizeError}, "merge-strategy": {MergeWriteAt, MergeConcat}, "http-version": {HTTPVersion1, HTTPVersion2}, "log-level": {LogError, LogInfo, LogDebug}}
+)
+
+// completionFlag is a download flag as it is completed.
+type completionFlag struct {
+	name        string
+	description string
+	// takesValue is set unless the flag is a bool flag
+	takesValue bool
+	// repeatable is set if the flag may be given more than once
+	repeatable bool
+}
+
+// HandleCompletion handles the completion sub-command, which prints a script completing
+// the sub-commands and download flags of dlmanager for the shell named by args[0].
+func HandleCompletion(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return InvalidInputError{ErrInvalidShell}
+	}
+	flags := downloadCompletionFlags()
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(w, flags)
+	case "zsh":
+		writeZshCompletion(w, flags)
+	case "fish":
+		writeFishCompletion(w, flags)
+	default:
+		return InvalidInputError{ErrInvalidShell}
+	}
+	return nil
+}
+
+// downloadCompletionFlags returns the flags of the download sub-command, sorted by name.
+func downloadCompletionFlags() []completionFlag {
+	var flags []completionFlag
+	fs := newDownloadFlagSet(io.Discard, &downloadConfig{}, new(string), new(string))
+	fs.VisitAll(func(f *flag.Flag) {
+		_, usage := flag.UnquoteUsage(f)
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		_, repeatable := f.Value.(*stringsFlag)
+		flags = append(flags, completionFlag{
+			name:        f.Name,
+			description: usage,
+			takesValue:  !ok || !boolFlag.IsBoolFlag(),
+			repeatable:  repeatable,
+		})
+	})
+	return flags
+}
+
+// writeBashCompletion writes a bash completion script for flags to w.
+func writeBashCompletion(w io.Writer, flags []completionFlag) {
+	var names, commands, files, dirs, values []string
+	for _, f := range flags {
+		names = append(names, "-"+f.name)
+		switch {
+		case dirFlags[f.name]:
+			dirs = append(dirs, "-"+f.name)
+		case fileFlags[f.name]:
+			files = append(files, "-"+f.name)
+		case len(flagValues[f.name]) != 0:
+			// Completed with its choices below
+		case f.takesValue:
+			values = append(values, "-"+f.name)
+		}
+	}
+	for _, c := range subCommands {
+		commands = append(commands, c.name)
+	}
+
+	fmt.Fprintln(w, "# bash completion for dlmanager")
+	fmt.Fprintln(w, "_dlmanager() {")
+	fmt.Fprintln(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"")
+	fmt.Fprintln(w, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(commands, " "))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase \"${COMP_WORDS[1]}\" in")
+	fmt.Fprintln(w, "\tdownload)")
+	fmt.Fprintln(w, "\t\tcase \"$prev\" in")
+	fmt.Fprintf(w, "\t\t%s)\n\t\t\tCOMPREPLY=($(compgen -d -- \"$cur\"))\n\t\t\treturn\n\t\t\t;;\n", strings.Join(dirs, "|"))
+	fmt.Fprintf(w, "\t\t%s)\n\t\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\t\treturn\n\t\t\t;;\n", strings.Join(files, "|"))
+	for _, f := range flags {
+		if choices := flagValues[f.name]; len(choices) != 0 {
+			fmt.Fprintf(w, "\t\t-%s)\n\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\t\treturn\n\t\t\t;;\n", f.name, strings.Join(choices, " "))
+		}
+	}
+	fmt.Fprintf(w, "\t\t%s)\n\t\t\treturn\n\t\t\t;;\n", strings.Join(values, "|"))
+	fmt.Fprintln(w, "\t\tesac")
+	fmt.Fprintln(w, "\t\tif [[ \"$cur\" == -* ]]; then")
+	fmt.Fprintf(w, "\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintln(w, "\t\tfi")
+	fmt.Fprintln(w, "\t\t;;")
+	fmt.Fprintln(w, "\tcompletion)")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(completionShells, " "))
+	fmt.Fprintln(w, "\t\t;;")
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _dlmanager dlmanager")
+}
+
+// writeZshCompletion writes a zsh completion script for flags to w.
+func writeZshCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprintln(w, "#compdef dlmanager")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_dlmanager() {")
+	fmt.Fprintln(w, "\tlocal line state")
+	fmt.Fprintln(w, "\t_arguments -C '1: :->command' '*:: :->args'")
+	fmt.Fprintln(w, "\tcase $state in")
+	fmt.Fprintln(w, "\tcommand)")
+	fmt.Fprint(w, "\t\t_values 'command'")
+	for _, c := range subCommands {
+		fmt.Fprintf(w, " %s", zshQuote(c.name+"["+zshEscape(c.description)+"]"))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "\t\t;;")
+	fmt.Fprintln(w, "\targs)")
+	fmt.Fprintln(w, "\t\tcase $line[1] in")
+	fmt.Fprintln(w, "\t\tdownload)")
+	fmt.Fprintln(w, "\t\t\t_arguments \\")
+	for _, f := range flags {
+		spec := "-" + f.name + "[" + zshEscape(f.description) + "]"
+		if f.repeatable {
+			spec = "*" + spec
+		}
+		switch {
+		case dirFlags[f.name]:
+			spec += ":directory:_files -/"
+		case fileFlags[f.name]:
+			spec += ":file:_files"
+		case len(flagValues[f.name]) != 0:
+			spec += ":value:(" + strings.Join(flagValues[f.name], " ") + ")"
+		case f.takesValue:
+			spec += ":value: "
+		}
+		fmt.Fprintf(w, "\t\t\t\t%s \\\n", zshQuote(spec))
+	}
+	fmt.Fprintln(w, "\t\t\t\t'*:url: '")
+	fmt.Fprintln(w, "\t\t\t;;")
+	fmt.Fprintln(w, "\t\tcompletion)")
+	fmt.Fprintf(w, "\t\t\t_arguments '1:shell:(%s)'\n", strings.Join(completionShells, " "))
+	fmt.Fprintln(w, "\t\t\t;;")
+	fmt.Fprintln(w, "\t\tesac")
+	fmt.Fprintln(w, "\t\t;;")
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_dlmanager \"$@\"")
+}
+
+// writeFishCompletion writes a fish completion script for flags to w.
+func writeFishCompletion(w io.Writer, flags []completionFlag) {
+	for _, c := range subCommands {
+		fmt.Fprintf(w, "complete -c dlmanager -f -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.description))
+	}
+	fmt.Fprintf(w, "complete -c dlmanager -f -n '__fish_seen_subcommand_from completion' -a %s\n", fishQuote(strings.Join(completionShells, " ")))
+	for _, f := range flags {
+		args := "-o " + f.name
+		switch {
+		case dirFlags[f.name]:
+			args += " -r -f -a '(__fish_complete_directories)'"
+		case fileFlags[f.name]:
+			args += " -r -F"
+		case len(flagValues[f.name]) != 0:
+			args += " -x -a " + fishQuote(strings.Join(flagValues[f.name], " "))
+		case f.takesValue:
+			args += " -x"
+		}
+		fmt.Fprintf(w, "complete -c dlmanager -n '__fish_seen_subcommand_from download' %s -d %s\n", args, fishQuote(f.description))
+	}
+}
+
+// zshEscape escapes the characters that end a description in a zsh _arguments spec.
+func zshEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// zshQuote quotes s as a single shell word.
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote quotes s as a single fish word.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHandleCompletion(t *testing.T) {
+	testCases := []struct {
+		shell string
+		// flagFormat is how each flag is written in the script
+		flagFormat string
+		expected   []string
+	}{
+		{"bash", "-%s", []string{"complete -F _dlmanager dlmanager", "-on-conflict)", "compgen -W \"rename skip error\"", "-location)\n\t\t\tCOMPREPLY=($(compgen -d"}},
+		{"zsh", "-%s[", []string{"#compdef dlmanager", "'*-header[", "'-location[Download location]:directory:_files -/'", "'-on-conflict[", ":value:(rename skip error)'"}},
+		{"fish", "-o %s ", []string{"-o location -r -f -a '(__fish_complete_directories)'", "-o url-file -r -F", "-o on-conflict -x -a 'rename skip error'", "-o insecure -d 'Don\\'t verify"}},
+	}
+	for _, tc := range testCases {
+		byteBuf := new(bytes.Buffer)
+		err := HandleCompletion(byteBuf, []string{tc.shell})
+		if err != nil {
+			t.Fatalf("%s: Expected nil error. Got: %v", tc.shell, err)
+		}
+		script := byteBuf.String()
+
+		// Every download flag is completed, including ones added later
+		for _, f := range downloadCompletionFlags() {
+			if !strings.Contains(script, strings.Replace(tc.flagFormat, "%s", f.name, 1)) {
+				t.Fatalf("%s: Expected -%s to be completed, Got: %s", tc.shell, f.name, script)
+			}
+		}
+		for _, expected := range tc.expected {
+			if !strings.Contains(script, expected) {
+				t.Fatalf("%s: Expected script to contain %q, Got: %s", tc.shell, expected, script)
+			}
+		}
+	}
+
+	for _, args := range [][]string{{}, {"powershell"}, {"bash", "zsh"}} {
+		err := HandleCompletion(new(bytes.Buffer), args)
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidShell) {
+			t.Fatalf("%q: Expected ErrInvalidShell, Got: %v", args, err)
+		}
+	}
+}
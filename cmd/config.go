@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFileName is the name of the config file looked for in the home directory
+// when -config isn't given.
+const configFileName = ".dlmanagerrc"
+
+// loadConfigFile sets the flags of flags that weren't given on the command line from the
+// config file at path, or from ~/.dlmanagerrc if path is empty. A missing default config
+// file is ignored.
+//
+// Each line of the file holds a flag name and its value, separated by a colon, e.g.
+// "limit-rate: 500k". Blank lines and lines starting with # are skipped, and a value may be
+// quoted as a whole. A flag that may be repeated, such as header, may be given on several
+// lines. The format isn't YAML: there is no nesting, and a # after a value is part of it.
+func loadConfigFile(flags *flag.FlagSet, path string) error {
+	if len(path) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, configFileName)
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return InvalidInputError{fmt.Errorf("%w: %v", ErrInvalidConfig, err)}
+	}
+	defer f.Close()
+
+	// Flags on the command line take precedence
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || len(name) == 0 {
+			return InvalidInputError{fmt.Errorf("%w: expected name: value on line %d of %s", ErrInvalidConfig, lineNum, path)}
+		}
+		if flags.Lookup(name) == nil || name == "config" {
+			return InvalidInputError{fmt.Errorf("%w: unknown option %q on line %d of %s", ErrInvalidConfig, name, lineNum, path)}
+		}
+		if given[name] {
+			continue
+		}
+		value = unquote(strings.TrimSpace(value))
+		if err := flags.Set(name, value); err != nil {
+			return InvalidInputError{fmt.Errorf("%w: invalid value %q for %s on line %d of %s: %v", ErrInvalidConfig, value, name, lineNum, path, err)}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return InvalidInputError{fmt.Errorf("%w: %v", ErrInvalidConfig, err)}
+	}
+	return nil
+}
+
+// unquote removes a pair of matching single or double quotes around value, if any.
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the tests with an empty home directory, so a config file in the home
+// directory of the user running them can't change their results.
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "dlmanager-home")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("HOME", home)
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+func TestHandleDownloadConfigFile(t *testing.T) {
+	var userAgent, accept string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		accept = r.Header.Get("Accept")
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	configLocation := t.TempDir()
+	config := strings.Join([]string{
+		"# defaults",
+		"location: " + configLocation,
+		`user-agent: "my agent"`,
+		"header: Accept: text/plain",
+		"retries: 0",
+		"",
+	}, "\n")
+	err := os.WriteFile(filepath.Join(home, configFileName), []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config file in the home directory is read by default
+	err = HandleDownload(new(bytes.Buffer), []string{ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(configLocation, "file.txt")); err != nil {
+		t.Fatalf("Expected the file in the configured location. Got: %v", err)
+	}
+	if userAgent != "my agent" || accept != "text/plain" {
+		t.Fatalf("Expected the configured User-Agent and Accept headers, Got: %q and %q", userAgent, accept)
+	}
+
+	// Flags on the command line override the config file
+	location := t.TempDir()
+	err = HandleDownload(new(bytes.Buffer), []string{"-location", location, "-user-agent", "other", ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(location, "file.txt")); err != nil {
+		t.Fatalf("Expected the file in the -location directory. Got: %v", err)
+	}
+	if userAgent != "other" {
+		t.Fatalf("Expected User-Agent: other, Got: %q", userAgent)
+	}
+
+	// -config replaces the default config file
+	otherLocation := t.TempDir()
+	configFile := filepath.Join(t.TempDir(), "dlmanagerrc")
+	err = os.WriteFile(configFile, []byte("location: '"+otherLocation+"'\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = HandleDownload(new(bytes.Buffer), []string{"-config", configFile, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(otherLocation, "file.txt")); err != nil {
+		t.Fatalf("Expected the file in the -config location. Got: %v", err)
+	}
+}
+
+func TestHandleDownloadConfigFileErrors(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	testCases := []struct {
+		config   string
+		expected string
+	}{
+		{"location /tmp", "expected name: value on line 1"},
+		{"# comment\nspeed: 500k", `unknown option "speed" on line 2`},
+		{"config: other", `unknown option "config" on line 1`},
+		{"retries: many", `invalid value "many" for retries on line 1`},
+	}
+	for _, tc := range testCases {
+		configFile := filepath.Join(t.TempDir(), "dlmanagerrc")
+		err := os.WriteFile(configFile, []byte(tc.config), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = HandleDownload(new(bytes.Buffer), []string{"-config", configFile, "http://localhost/file.txt"})
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidConfig) || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%q: Expected an invalid config error containing %q, Got: %v", tc.config, tc.expected, err)
+		}
+	}
+
+	// A missing -config file is an error, unlike a missing default config file
+	err := HandleDownload(new(bytes.Buffer), []string{"-config", filepath.Join(t.TempDir(), "missing"), "http://localhost/file.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidConfig) {
+		t.Fatalf("Expected ErrInvalidConfig, Got: %v", err)
+	}
+}
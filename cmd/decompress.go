@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isCompressed reports whether a Content-Encoding is one that is decompressed before saving.
+func isCompressed(contentEncoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip", "deflate":
+		return true
+	}
+	return false
+}
+
+// decodedBody is the decompressed body of a response. Closing it closes the original body.
+type decodedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
+
+// decodeBody replaces the body of a gzip or deflate encoded response with its decompressed
+// content and reports whether it did. The Content-Length of a decoded response is unknown.
+func decodeBody(r *http.Response) (bool, error) {
+	var reader io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(r.Body)
+	case "deflate":
+		reader, err = zlib.NewReader(r.Body)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.Body = &decodedBody{Reader: reader, body: r.Body}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	r.Uncompressed = true
+	return true, nil
+}
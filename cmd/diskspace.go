@@ -0,0 +1,51 @@
+package cmd
+
+import "fmt"
+
+// availableSpace returns the number of bytes free for use in the directory dir.
+// It is a variable so tests can replace it.
+var availableSpace = getAvailableSpace
+
+// checkDiskSpace returns an error wrapping ErrInsufficientSpace if the download location
+// doesn't have room for every file in remotes. Data already on disk from an earlier run
+// is subtracted, and files of unknown length or that are skipped as duplicates are ignored.
+func (d *downloader) checkDiskSpace(remotes []remoteFile) error {
+	var required int64
+	for _, remote := range remotes {
+		if remote.contentLength <= 0 || remote.duplicate {
+			continue
+		}
+		// Files without a name fail once their download starts
+		path, err := d.getDestinationPath(remote)
+		if err != nil {
+			continue
+		}
+		fileSize, err := getExistingFileSize(path)
+		if err != nil {
+			return err
+		}
+		if fileSize == remote.contentLength {
+			continue
+		}
+		partSize, err := getExistingFileSize(getPartPath(path))
+		if err != nil {
+			return err
+		}
+		if partSize < remote.contentLength {
+			required += remote.contentLength - partSize
+		}
+	}
+	if required == 0 {
+		return nil
+	}
+
+	available, err := availableSpace(d.opts.Location)
+	if err != nil {
+		// Free space can't be determined on every platform, so it isn't checked
+		return nil
+	}
+	if uint64(required) > available {
+		return fmt.Errorf("%w: need %d bytes but only %d are available in %s", ErrInsufficientSpace, required, available, d.opts.Location)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !darwin && !freebsd && !linux
+
+package cmd
+
+import "errors"
+
+// getAvailableSpace isn't supported on this platform.
+func getAvailableSpace(dir string) (uint64, error) {
+	return 0, errors.New("free disk space can't be determined on this platform")
+}
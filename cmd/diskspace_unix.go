@@ -0,0 +1,15 @@
+//go:build darwin || freebsd || linux
+
+package cmd
+
+import "syscall"
+
+// getAvailableSpace returns the number of bytes free for unprivileged users
+// on the filesystem containing dir.
+func getAvailableSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
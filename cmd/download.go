@@ -0,0 +1,1544 @@
+package cmd
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultUserAgent is the User-Agent sent with every request if none is given.
+var DefaultUserAgent = "dlmanager/" + Version
+
+const (
+	// DefaultLocation is the directory files are downloaded to if none is given.
+	DefaultLocation = "./downloads"
+	// DefaultMaxConcurrent is the number of files downloaded at the same time if not specified.
+	DefaultMaxConcurrent = 4
+	// DefaultMaxRedirects is the number of redirects followed if not specified.
+	DefaultMaxRedirects = 10
+	// DefaultBufferSize is the size of the chunks files are read and written in if not specified.
+	DefaultBufferSize = 32 << 10
+	// MaxBufferSize is the largest BufferSize allowed.
+	MaxBufferSize = 64 << 20
+	// DefaultProgressInterval is how often progress is shown if not specified.
+	DefaultProgressInterval = 200 * time.Millisecond
+	// DefaultMaxIdleConns is the number of idle connections kept open if not specified.
+	DefaultMaxIdleConns = 25
+	// DefaultIdleConnTimeout is how long idle connections are kept open if not specified.
+	DefaultIdleConnTimeout = 90 * time.Second
+	// DefaultMaxRetryAfter is the longest Retry-After delay waited for if not specified.
+	DefaultMaxRetryAfter = 5 * time.Minute
+)
+
+// Policies for urls that are saved to the same file, see DownloadOptions.OnConflict.
+const (
+	// ConflictRename saves each later url under a numbered name, e.g. file(1).zip.
+	ConflictRename = "rename"
+	// ConflictSkip only downloads the first url saved to each file.
+	ConflictSkip = "skip"
+	// ConflictError fails before anything is downloaded.
+	ConflictError = "error"
+)
+
+// HTTP versions, see DownloadOptions.HTTPVersion.
+const (
+	// HTTPVersion1 only connects over HTTP/1.1.
+	HTTPVersion1 = "1.1"
+	// HTTPVersion2 negotiates HTTP/2 over TLS, falling back to HTTP/1.1 if the server
+	// doesn't support it.
+	HTTPVersion2 = "2"
+)
+
+// Policies for a partial download larger than the remote file, see DownloadOptions.OnOversize.
+const (
+	// OversizeRestart discards the partial download and downloads the file from scratch.
+	OversizeRestart = "restart"
+	// OversizeError fails the download, leaving the partial download in place.
+	OversizeError = "error"
+)
+
+// Strategies for writing the segments of a file, see DownloadOptions.MergeStrategy.
+const (
+	// MergeWriteAt writes each segment at its offset in the file.
+	MergeWriteAt = "writeat"
+	// MergeConcat writes each segment to a file of its own, e.g. file.zip.part0, and
+	// joins the files once every segment is complete.
+	MergeConcat = "concat"
+)
+
+// DownloadOptions configures a call to Download.
+type DownloadOptions struct {
+	// URLs lists the files to download.
+	URLs []string
+	// Location is the directory files are downloaded to. Missing directories are created.
+	// It defaults to DefaultLocation.
+	Location string
+	// LocationMustExist fails the download with an error wrapping ErrLocationNotExist if
+	// Location doesn't exist, instead of creating it.
+	LocationMustExist bool
+	// Paths optionally overrides where each url is saved, relative to Location. Paths[i]
+	// applies to URLs[i], and an empty or missing entry saves the url under its own name.
+	// A path ending in / names the directory the url is saved in under its own name.
+	Paths []string
+	// Method is the HTTP method files are requested with. It defaults to GET. Files requested
+	// with another method are named after their url, since they aren't looked up before they
+	// are downloaded, and aren't resumed.
+	Method string
+	// Body is sent as the request body with Method, which can't be GET if it is set.
+	Body []byte
+	// Mirrors optionally lists alternative urls for each url. Mirrors[i] applies to URLs[i],
+	// and its urls are tried in order once URLs[i] fails or fails Checksum. A mirror that
+	// supports ranges resumes from the data already downloaded if it reports the same size.
+	Mirrors [][]string
+	// Filename overrides the name the file is saved as inside Location, instead of
+	// deriving it from the url. It can only be set when downloading a single url.
+	Filename string
+	// PreservePath saves each url under the directories of its path inside Location, so
+	// http://host/a/b/c.zip is saved to a/b/c.zip instead of c.zip. It doesn't apply to
+	// Filename or Paths.
+	PreservePath bool
+	// PerHost saves each url in a directory named after its host inside Location, so
+	// http://host:8080/c.zip is saved to host/c.zip. Directories kept by PreservePath are
+	// created inside it. It doesn't apply to Paths.
+	PerHost bool
+	// RenameTemplate renames each file saved under its own name. Its placeholders are
+	// replaced by the name of the file ({basename}), the host of its url ({host}), the
+	// date of the download as 2006-01-02 ({date}) and the position of its url counting
+	// from 1 ({index}), e.g. "{date}-{basename}". It doesn't apply to Filename or Paths.
+	RenameTemplate string
+	// GuessExtension adds an extension based on the Content-Type of the file to a
+	// filename that has none. It doesn't apply to Filename or Paths.
+	GuessExtension bool
+	// KeepQuery appends the query of a url to the name of the file it is saved as, e.g.
+	// file.zip?v=2, instead of stripping it along with the fragment. It doesn't apply to
+	// files named by the server, Filename or Paths.
+	KeepQuery bool
+	// Destination, if set, receives the downloaded file instead of it being saved to disk.
+	// It can only be set when downloading a single url, and doesn't support Checksum.
+	Destination io.Writer
+	// StopOnError cancels the remaining downloads as soon as one fails, instead of
+	// downloading as many urls as possible. The cancelled downloads fail with ErrStopped.
+	StopOnError bool
+	// MaxConcurrent caps the number of downloads in flight at any one time.
+	// It defaults to DefaultMaxConcurrent.
+	MaxConcurrent int
+	// Wait is the pause before starting each download after the first, once a slot is free,
+	// to spare rate-limited servers. With a MaxConcurrent of 1, it is the pause between one
+	// download finishing and the next starting. Zero means no pause.
+	Wait time.Duration
+	// Segments is the number of parallel range requests used to download each file.
+	// Files are downloaded in a single request if the server doesn't support ranges.
+	// It defaults to 1.
+	Segments int
+	// MergeStrategy decides how the segments of a file are written, and is one of
+	// MergeWriteAt or MergeConcat. MergeConcat avoids writing to a sparse file, which is
+	// slow on some filesystems, but needs twice the size of the file on disk while the
+	// segments are joined. It defaults to MergeWriteAt.
+	MergeStrategy string
+	// Retries is the number of times a failed download is retried.
+	Retries int
+	// RetryBackoff is the delay before the first retry. It doubles on each subsequent retry,
+	// up to MaxRetryAfter.
+	RetryBackoff time.Duration
+	// MaxRetryAfter caps how long a retry waits, both for the backoff and when a 429 or 503
+	// response asks for a delay in its Retry-After header, which is used instead of
+	// RetryBackoff. It defaults to DefaultMaxRetryAfter.
+	MaxRetryAfter time.Duration
+	// Timeout caps the total time spent downloading each file, including retries.
+	// A file that times out is left on disk to be resumed later. Zero means no limit.
+	Timeout time.Duration
+	// IdleTimeout aborts a download attempt if no data arrives for this long, so that
+	// it can be retried. Zero means no limit.
+	IdleTimeout time.Duration
+	// Checksum is the expected checksum of the downloaded file, as algorithm:hex.
+	// It can only be set when downloading a single url.
+	Checksum string
+	// ChecksumFile is the path of a checksums file, such as SHA256SUMS, listing the md5,
+	// sha1, sha256 or sha512 checksum of files in the "<hex>  <name>" format of sha256sum.
+	// Every downloaded file listed in it under its path inside Location, or its name, is
+	// verified against it, and a warning is written for files that aren't listed. It can't
+	// be combined with Checksum.
+	ChecksumFile string
+	// DeleteOnChecksumMismatch removes the downloaded file if it doesn't match Checksum
+	// or its entry in ChecksumFile.
+	DeleteOnChecksumMismatch bool
+	// Hash names the algorithm, one of md5, sha1, sha256 or sha512, of the hash reported in
+	// FileResult.Hash for every file. It is computed as the file is written, so that large
+	// files aren't read a second time.
+	Hash string
+	// BufferSize is the size of the chunks files are read and written in. Larger chunks
+	// suit fast links. It defaults to DefaultBufferSize and can't exceed MaxBufferSize.
+	BufferSize int
+	// LimitRate caps the combined transfer rate of all downloads, in bytes per second.
+	// Zero means no limit.
+	LimitRate int64
+	// LimitRatePerHost caps the combined transfer rate of the downloads from each host, in
+	// bytes per second, so that no server is hammered. LimitRate still caps all of them.
+	// Zero means no limit.
+	LimitRatePerHost int64
+	// MinFileSize fails the download of files smaller than this many bytes with an error
+	// wrapping ErrFileTooSmall, since they are likely error pages sent instead of the file.
+	// A file whose Content-Length is smaller isn't downloaded, any other one is deleted once
+	// downloaded. Zero means no minimum.
+	MinFileSize int64
+	// MaxRedirects is the number of redirects followed before a request fails.
+	// It defaults to DefaultMaxRedirects. A negative value follows no redirects.
+	MaxRedirects int
+	// Username and Password are sent with every request using basic authentication,
+	// if Username is set.
+	Username string
+	Password string
+	// BearerToken is sent with every request as an Authorization: Bearer header, if set.
+	// It can't be combined with Username.
+	BearerToken string
+	// NetrcFile is a netrc file whose login and password for the host of a request are sent
+	// using basic authentication, unless Username or BearerToken is set. Empty reads none.
+	NetrcFile string
+	// UserAgent is sent as the User-Agent of every request. It defaults to DefaultUserAgent.
+	// A User-Agent field in Header takes precedence, and sends no User-Agent if it is empty.
+	UserAgent string
+	// Referer is sent as the Referer header of every request, if set. It must be an
+	// http or https url.
+	Referer string
+	// Cookie is sent as the Cookie header of every request, as name=value pairs separated
+	// by semicolons. Cookies set by the server are kept for later requests, including
+	// redirects, whether or not Cookie is set.
+	Cookie string
+	// Header holds additional header fields sent with every request. A Range field
+	// replaces the range used to resume a download, but not the ranges of Segments.
+	Header http.Header
+	// Output receives a message when each download starts, is skipped, completes or fails,
+	// as well as the output of DryRun, Spider and Verbose. It also receives the progress of each
+	// download unless Progress is set. Everything written to it is discarded if it is nil.
+	Output io.Writer
+	// Progress receives the progress of each download, so it can be routed separately
+	// from the messages written to Output. It defaults to Output.
+	Progress io.Writer
+	// OnProgress, if set, is called with every ProgressEvent, the same events the progress
+	// written to Progress is made of. It is called from a single goroutine, one event at a
+	// time and in order, so it needs no locking, but downloads wait for it to return.
+	OnProgress func(ProgressEvent)
+	// ProgressInterval is how often the progress of each file is written to Progress, instead
+	// of for every chunk. It defaults to DefaultProgressInterval.
+	ProgressInterval time.Duration
+	// Proxy is the http, https or socks5 proxy requests are sent through. If it is nil,
+	// the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy *url.URL
+	// IPv4 and IPv6 restrict connections to IPv4 or IPv6 addresses respectively. By default
+	// either is used. Only one of them can be set.
+	IPv4, IPv6 bool
+	// MaxIdleConns is the number of idle connections kept open for reuse, across all servers.
+	// It defaults to DefaultMaxIdleConns.
+	MaxIdleConns int
+	// IdleConnTimeout is how long an idle connection is kept open for reuse. It defaults
+	// to DefaultIdleConnTimeout.
+	IdleConnTimeout time.Duration
+	// DisableHTTP2 connects to servers over HTTP/1.1 even if they support HTTP/2.
+	DisableHTTP2 bool
+	// HTTPVersion is HTTPVersion2, the default, or HTTPVersion1, which is the same as
+	// DisableHTTP2.
+	HTTPVersion string
+	// Insecure disables verification of the server's TLS certificate. Prefer CACertFile
+	// for servers with a self-signed certificate.
+	Insecure bool
+	// CACertFile is a file of PEM encoded certificates used instead of the system's to
+	// verify the server's TLS certificate.
+	CACertFile string
+	// Verbose logs the details of every request and its response to Output.
+	Verbose bool
+	// Trace times the DNS lookup, connection, TLS handshake, first byte and transfer of
+	// the request that downloads each file, and reports them in FileResult.Timings.
+	Trace bool
+	// LogLevel is the level of the messages written to Output, one of LogError, LogInfo or
+	// LogDebug. It defaults to LogInfo.
+	LogLevel string
+	// JSONProgress writes progress to Output as newline-delimited JSON objects,
+	// one per progress update, completed download and failed download.
+	JSONProgress bool
+	// Force deletes any existing or partially downloaded file and downloads it again
+	// from scratch.
+	Force bool
+	// OnConflict decides what happens when several urls are saved to the same file, and is
+	// one of ConflictRename, ConflictSkip or ConflictError. It defaults to ConflictRename.
+	OnConflict string
+	// OnOversize decides what happens when the partial download of a file is larger than the
+	// remote file, so it can't be resumed, and is one of OversizeRestart or OversizeError.
+	// It defaults to OversizeRestart. A warning is written to Output either way.
+	OnOversize string
+	// NoClobber skips urls whose file already exists, whatever its size. A file named
+	// after the url is skipped without sending any request. Force takes precedence.
+	NoClobber bool
+	// TimeCond looks up urls whose file already exists with an If-Modified-Since header
+	// holding the modification time of the file. The url is skipped if the server answers
+	// 304 Not Modified, or reports a Last-Modified time that isn't later, and the file is
+	// downloaded again otherwise. Downloaded files get the Last-Modified time the server
+	// reports as their modification time. Force takes precedence.
+	TimeCond bool
+	// DryRun only looks up each url, and prints where it would be downloaded to Output
+	// instead of downloading it. Urls that can't be reached are reported as errors.
+	DryRun bool
+	// Spider only checks that each url responds with a success status, and prints whether
+	// each link is OK or broken to Output instead of downloading it. Broken links are
+	// reported as errors. It takes precedence over DryRun.
+	Spider bool
+	// NoHead looks up each url with a GET request for its first byte instead of a HEAD
+	// request. Servers that reject HEAD requests are handled this way without it.
+	NoHead bool
+	// NoSpaceCheck skips checking that the download location has enough free space
+	// for all files before starting, for filesystems that misreport it.
+	NoSpaceCheck bool
+	// NoDecompress saves gzip and deflate encoded responses as the server sent them.
+	// By default they are decompressed, and can't be resumed after a failure.
+	NoDecompress bool
+
+	// startTime is when Download was called, the {date} of RenameTemplate
+	startTime time.Time
+}
+
+// FileResult reports the outcome of downloading a single url.
+type FileResult struct {
+	URL string
+	// Path is where the file was saved.
+	Path string
+	// Mirror is the mirror the file was downloaded from, or empty if it was downloaded from URL.
+	Mirror string
+	// BytesWritten is the number of bytes downloaded by this run.
+	// It excludes any data already on disk from an earlier run.
+	BytesWritten int64
+	// Resumed reports that the download continued from data left on disk by an earlier run.
+	Resumed bool
+	// Duration is how long the download took, including retries.
+	Duration time.Duration
+	// Skipped reports that the url wasn't downloaded, because NoClobber was set and the
+	// file already existed at Path, because OnConflict is ConflictSkip and an earlier
+	// url is saved to Path, or because the file is UpToDate.
+	Skipped bool
+	// UpToDate reports that TimeCond was set and the file at Path wasn't modified since.
+	UpToDate bool
+	// Hash is the hex encoded hash of the file if DownloadOptions.Hash is set, and the
+	// file was downloaded or already complete.
+	Hash string
+	// Timings breaks down the request that downloaded the file if DownloadOptions.Trace
+	// is set, or is nil if no request was made.
+	Timings *Timings
+	// Err is the reason the download failed, or nil if it succeeded.
+	Err error
+}
+
+// Status returns the outcome of the download as completed, resumed, up-to-date, skipped
+// or failed.
+func (f FileResult) Status() string {
+	switch {
+	case f.Err != nil:
+		return "failed"
+	case f.UpToDate:
+		return "up-to-date"
+	case f.Skipped:
+		return "skipped"
+	case f.Resumed:
+		return "resumed"
+	default:
+		return "completed"
+	}
+}
+
+// Statuses of a ProgressEvent.
+const (
+	// ProgressStarted is sent when the download of a url starts.
+	ProgressStarted = "started"
+	// ProgressDownloading is sent every time a chunk of a file is written.
+	ProgressDownloading = "downloading"
+	// ProgressCompleted is sent when a file has been downloaded.
+	ProgressCompleted = "completed"
+	// ProgressSkipped is sent when a url isn't downloaded, see FileResult.Skipped.
+	ProgressSkipped = "skipped"
+	// ProgressFailed is sent when the download of a url fails.
+	ProgressFailed = "failed"
+)
+
+// ProgressEvent reports a change in the progress of a single download to OnProgress.
+type ProgressEvent struct {
+	// Status is one of ProgressStarted, ProgressDownloading, ProgressCompleted,
+	// ProgressSkipped or ProgressFailed.
+	Status string
+	URL    string
+	// Bytes is the number of bytes of the file written by this run so far.
+	Bytes int64
+	// Total is the size of the file, or -1 if it is unknown.
+	Total int64
+	// Result is the outcome of the download once it is completed, skipped or failed.
+	Result *FileResult
+}
+
+// DownloadResult reports the outcome of a call to Download.
+type DownloadResult struct {
+	// Files holds one result per url, in the order the urls were given.
+	Files []FileResult
+}
+
+// syncWriter serializes writes to w, which is shared by the progress display
+// and the concurrent downloads.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	// bar is set if w is a terminal, where progress is shown as a single line updated
+	// in place. Other writes clear the line first, and the next update redraws it
+	bar      bool
+	barShown bool
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.barShown {
+		s.barShown = false
+		if _, err := io.WriteString(s.w, "\r\033[K"); err != nil {
+			return 0, err
+		}
+	}
+	return s.w.Write(p)
+}
+
+// updateBar replaces the progress bar line with line.
+func (s *syncWriter) updateBar(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	io.WriteString(s.w, "\r\033[K"+line)
+	s.barShown = true
+}
+
+// finishBar leaves the progress bar line as it is, and moves to the next line.
+func (s *syncWriter) finishBar() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.barShown {
+		io.WriteString(s.w, "\n")
+		s.barShown = false
+	}
+}
+
+// downloader holds the state shared by all downloads of one call to Download.
+type downloader struct {
+	client    *http.Client
+	opts      *DownloadOptions
+	bytesChan chan progressEvent
+	// limiter throttles the combined transfer rate of all downloads
+	limiter *rateLimiter
+	log     *logger
+	// checksums holds the entries of ChecksumFile, if it is set
+	checksums checksumManifest
+	// hostLimiters throttles the downloads from each host, if LimitRatePerHost is set
+	hostLimiters *hostLimiters
+}
+
+// Download downloads every url in opts concurrently. It returns once all
+// downloads have finished. If any download fails, the returned error is a
+// DownloadErrors describing each failure, and the result still reports the
+// downloads that succeeded. If ctx is cancelled, Download returns ctx.Err()
+// and leaves partially downloaded files on disk to be resumed later.
+func Download(ctx context.Context, opts DownloadOptions) (*DownloadResult, error) {
+	opts.startTime = time.Now()
+	if len(opts.Location) == 0 {
+		opts.Location = DefaultLocation
+	}
+	if opts.MaxConcurrent == 0 {
+		opts.MaxConcurrent = DefaultMaxConcurrent
+	}
+	if opts.MaxConcurrent < 0 {
+		return nil, InvalidInputError{ErrMaxConcurrent}
+	}
+	if opts.Segments == 0 {
+		opts.Segments = 1
+	}
+	if opts.Segments < 0 {
+		return nil, InvalidInputError{ErrNumSegments}
+	}
+	switch opts.MergeStrategy {
+	case "":
+		opts.MergeStrategy = MergeWriteAt
+	case MergeWriteAt, MergeConcat:
+	default:
+		return nil, InvalidInputError{ErrMergeStrategy}
+	}
+	if opts.LimitRate < 0 {
+		return nil, InvalidInputError{ErrInvalidLimitRate}
+	}
+	if opts.LimitRatePerHost < 0 {
+		return nil, InvalidInputError{ErrInvalidHostRate}
+	}
+	if opts.MinFileSize < 0 {
+		return nil, InvalidInputError{ErrInvalidMinFileSize}
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	if opts.BufferSize < 0 || opts.BufferSize > MaxBufferSize {
+		return nil, InvalidInputError{ErrInvalidBufferSize}
+	}
+	if opts.Timeout < 0 {
+		return nil, InvalidInputError{ErrTimeout}
+	}
+	for _, path := range opts.Paths {
+		if err := validatePath(path); err != nil {
+			return nil, InvalidInputError{err}
+		}
+	}
+	if err := validateURLs(opts.URLs, opts.Mirrors); err != nil {
+		return nil, InvalidInputError{err}
+	}
+	if opts.IdleTimeout < 0 {
+		return nil, InvalidInputError{ErrIdleTimeout}
+	}
+	if opts.Wait < 0 {
+		return nil, InvalidInputError{ErrWait}
+	}
+	switch opts.OnConflict {
+	case "":
+		opts.OnConflict = ConflictRename
+	case ConflictRename, ConflictSkip, ConflictError:
+	default:
+		return nil, InvalidInputError{ErrInvalidOnConflict}
+	}
+	switch opts.HTTPVersion {
+	case "", HTTPVersion2:
+	case HTTPVersion1:
+		opts.DisableHTTP2 = true
+	default:
+		return nil, InvalidInputError{fmt.Errorf("%w, not %q", ErrHTTPVersion, opts.HTTPVersion)}
+	}
+	switch opts.LogLevel {
+	case "":
+		opts.LogLevel = LogInfo
+	case LogError, LogInfo, LogDebug:
+	default:
+		return nil, InvalidInputError{ErrInvalidLogLevel}
+	}
+	switch opts.OnOversize {
+	case "":
+		opts.OnOversize = OversizeRestart
+	case OversizeRestart, OversizeError:
+	default:
+		return nil, InvalidInputError{ErrInvalidOnOversize}
+	}
+	if len(opts.Method) == 0 {
+		opts.Method = http.MethodGet
+	}
+	if opts.Method == http.MethodHead {
+		return nil, InvalidInputError{ErrInvalidMethod}
+	}
+	if opts.Method == http.MethodGet && opts.Body != nil {
+		return nil, InvalidInputError{ErrBodyWithGet}
+	}
+	if opts.ProgressInterval == 0 {
+		opts.ProgressInterval = DefaultProgressInterval
+	}
+	if opts.ProgressInterval < 0 {
+		return nil, InvalidInputError{ErrProgressInterval}
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if opts.MaxIdleConns < 0 {
+		return nil, InvalidInputError{ErrMaxIdleConns}
+	}
+	if opts.IdleConnTimeout == 0 {
+		opts.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if opts.IdleConnTimeout < 0 {
+		return nil, InvalidInputError{ErrIdleConnTimeout}
+	}
+	if opts.MaxRetryAfter == 0 {
+		opts.MaxRetryAfter = DefaultMaxRetryAfter
+	}
+	if opts.MaxRetryAfter < 0 {
+		return nil, InvalidInputError{ErrMaxRetryAfter}
+	}
+	if err := validateRenameTemplate(opts.RenameTemplate); err != nil {
+		return nil, InvalidInputError{err}
+	}
+	if opts.IPv4 && opts.IPv6 {
+		return nil, InvalidInputError{ErrIPVersion}
+	}
+	if len(opts.Referer) != 0 && !isHTTPURL(opts.Referer) {
+		return nil, InvalidInputError{ErrInvalidReferer}
+	}
+	if len(opts.Checksum) != 0 {
+		_, _, err := parseChecksum(opts.Checksum)
+		if err != nil {
+			return nil, InvalidInputError{err}
+		}
+		if len(opts.URLs) > 1 {
+			return nil, InvalidInputError{ErrChecksumSingleFile}
+		}
+	}
+	if len(opts.Hash) != 0 && newHash(opts.Hash) == nil {
+		return nil, InvalidInputError{ErrInvalidHash}
+	}
+	if (len(opts.Filename) != 0 || opts.Destination != nil) && len(opts.URLs) > 1 {
+		return nil, InvalidInputError{ErrOutputSingleFile}
+	}
+	if len(opts.Checksum) != 0 && opts.Destination != nil {
+		return nil, InvalidInputError{ErrChecksumStdout}
+	}
+	var checksums checksumManifest
+	if len(opts.ChecksumFile) != 0 {
+		if len(opts.Checksum) != 0 {
+			return nil, InvalidInputError{ErrChecksumConflict}
+		}
+		if opts.Destination != nil {
+			return nil, InvalidInputError{ErrChecksumFileStdout}
+		}
+		var err error
+		checksums, err = readChecksumFile(opts.ChecksumFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Output == nil {
+		opts.Output = io.Discard
+	}
+	if len(opts.UserAgent) == 0 {
+		opts.UserAgent = DefaultUserAgent
+	}
+	if len(opts.Username) != 0 && len(opts.BearerToken) != 0 {
+		return nil, InvalidInputError{ErrAuthTwice}
+	}
+	opts.Header = opts.requestHeader()
+	w := &syncWriter{w: opts.Output, bar: !opts.JSONProgress && isTerminal(opts.Output)}
+	progress := w
+	if opts.Progress != nil {
+		w.bar = false
+		progress = &syncWriter{w: opts.Progress, bar: !opts.JSONProgress && isTerminal(opts.Progress)}
+	}
+
+	httpClient, err := opts.newClient(w)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Insecure {
+		fmt.Fprintln(w, "Warning: TLS certificate verification is disabled, connections can be intercepted")
+	}
+
+	if opts.Spider {
+		return spider(ctx, httpClient, &opts, w)
+	}
+	if opts.DryRun {
+		return dryRun(ctx, httpClient, &opts, w)
+	}
+
+	// Set download destination once, before any download starts, so that
+	// concurrent downloads don't race to create the same directories
+	if opts.Destination == nil {
+		location, err := setDownloadLocation(opts.Location, opts.LocationMustExist)
+		if err != nil {
+			return nil, err
+		}
+		opts.Location = location
+	}
+
+	limiter := newRateLimiter(opts.LimitRate)
+	d := &downloader{
+		client:       httpClient,
+		opts:         &opts,
+		bytesChan:    make(chan progressEvent),
+		limiter:      limiter,
+		hostLimiters: newHostLimiters(opts.LimitRatePerHost, limiter),
+		log:          newLogger(w, opts.LogLevel),
+		checksums:    checksums,
+	}
+
+	// Look up every file before starting, so the total size is known up front
+	remotes := make([]remoteFile, len(opts.URLs))
+	lookupErrs := make([]error, len(opts.URLs))
+	for i, u := range opts.URLs {
+		// An existing file named after the url isn't looked up at all
+		remote := opts.place(i, remoteFile{filename: getURLFileName(u, opts.KeepQuery)})
+		if _, ok := d.skipExisting(remote); ok {
+			remotes[i] = remote
+			continue
+		}
+
+		// Only ask for the file if it changed since the existing file was downloaded
+		modTime := d.existingModTime(remote)
+		placed := remote
+
+		// Fall back to the mirrors if the url can't be reached or is dead
+		remote, err := d.lookup(ctx, u, modTime)
+		for _, mirror := range opts.mirrors(i) {
+			if err == nil && lookupStatusError(remote) == nil {
+				break
+			}
+			remote, err = d.lookup(ctx, mirror, modTime)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			// A url that can't be reached fails on its own, like a dead url
+			lookupErrs[i] = err
+			remotes[i] = placed
+			continue
+		}
+		if !modTime.IsZero() && notModified(remote, modTime) {
+			placed.notModified = true
+			remotes[i] = placed
+			continue
+		}
+		// A dead url fails without being requested again, so its size doesn't count
+		lookupErrs[i] = lookupStatusError(remote)
+		if lookupErrs[i] != nil {
+			remote.contentLength = 0
+		}
+		remotes[i] = opts.place(i, remote)
+	}
+	// Resolve every filename before any download starts writing
+	if err := resolveConflicts(opts.URLs, remotes, opts.OnConflict); err != nil {
+		return nil, err
+	}
+
+	if opts.Destination == nil && !opts.NoSpaceCheck {
+		if err := d.checkDiskSpace(remotes); err != nil {
+			return nil, err
+		}
+	}
+
+	// Display download progress info
+	displayDone := make(chan struct{})
+	events := d.bytesChan
+	if opts.OnProgress != nil {
+		events = notifyProgress(d.bytesChan, opts.URLs, remotes, opts.OnProgress)
+	}
+	go func() {
+		defer close(displayDone)
+		if opts.JSONProgress {
+			displayJSONProgress(w, progress, opts.URLs, remotes, events, opts.ProgressInterval)
+			return
+		}
+		displayDownloadInfo(w, progress, opts.URLs, remotes, events, opts.ProgressInterval)
+	}()
+
+	// sem limits the number of in-flight downloads. Remaining urls queue
+	// until a slot frees up.
+	sem := make(chan struct{}, opts.MaxConcurrent)
+
+	// batchCtx is cancelled by the first failed download if StopOnError is set
+	batchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	result := &DownloadResult{Files: make([]FileResult, len(opts.URLs))}
+	var wg sync.WaitGroup
+	// dispatched counts the downloads started so far
+	var dispatched int
+	for i, u := range opts.URLs {
+		if lookupErrs[i] != nil {
+			result.Files[i] = FileResult{URL: u, Err: lookupErrs[i]}
+			if opts.Destination == nil {
+				result.Files[i].Path, _ = d.getDestinationPath(remotes[i])
+			}
+			d.bytesChan <- progressEvent{url: u, result: &result.Files[i]}
+			if opts.StopOnError {
+				stop()
+			}
+			continue
+		}
+
+		var notice string
+		path, exists := d.skipExisting(remotes[i])
+		switch {
+		case exists:
+			notice = fmt.Sprintf("Skipping existing file %s", path)
+		case remotes[i].duplicate:
+			path, _ = d.getDestinationPath(remotes[i])
+			notice = fmt.Sprintf("Skipping %v, which is saved to %s by an earlier url", u, path)
+		case remotes[i].notModified:
+			path, _ = d.getDestinationPath(remotes[i])
+			notice = fmt.Sprintf("Skipping %s, which is up to date", path)
+		}
+		if len(notice) != 0 {
+			if !opts.JSONProgress {
+				d.log.infof("%s", notice)
+			}
+			result.Files[i] = FileResult{URL: u, Path: path, Skipped: true, UpToDate: remotes[i].notModified}
+			d.bytesChan <- progressEvent{url: u, result: &result.Files[i]}
+			continue
+		}
+
+		// Stop starting new downloads once ctx is cancelled
+		var started bool
+		select {
+		case sem <- struct{}{}:
+			// A slot may free up at the same time as the batch is cancelled
+			started = batchCtx.Err() == nil
+			if !started {
+				<-sem
+			}
+		case <-batchCtx.Done():
+		}
+		// Pause before every download but the first
+		if started && dispatched > 0 && opts.Wait > 0 {
+			select {
+			case <-time.After(opts.Wait):
+			case <-batchCtx.Done():
+				started = false
+				<-sem
+			}
+		}
+		if !started {
+			err := ctx.Err()
+			if err == nil {
+				err = ErrStopped
+			}
+			result.Files[i] = FileResult{URL: u, Err: err}
+			continue
+		}
+		if !opts.JSONProgress {
+			d.log.infof("Downloading %v...", u)
+		}
+		d.bytesChan <- progressEvent{url: u, started: true}
+		dispatched++
+		wg.Add(1)
+		go func(url string, remote remoteFile, mirrors []string, file *FileResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			*file = d.downloadFile(batchCtx, url, remote, mirrors)
+			file.Duration = time.Since(start)
+			if file.Err != nil && opts.StopOnError {
+				if batchCtx.Err() != nil && ctx.Err() == nil {
+					// Cancelled because another download failed
+					file.Err = ErrStopped
+				} else {
+					stop()
+				}
+			}
+			d.bytesChan <- progressEvent{url: url, result: file}
+		}(u, remotes[i], opts.mirrors(i), &result.Files[i])
+	}
+	wg.Wait()
+
+	// Let the final progress update print before returning
+	close(d.bytesChan)
+	<-displayDone
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	// Collect the error of every download that didn't complete
+	var failed []DownloadError
+	for _, file := range result.Files {
+		if file.Err != nil {
+			failed = append(failed, DownloadError{URL: file.URL, Err: file.Err})
+		}
+	}
+	if len(failed) > 0 {
+		return result, DownloadErrors{Errs: failed, Total: len(opts.URLs)}
+	}
+	return result, nil
+}
+
+// requestHeader returns a copy of Header with the User-Agent, Referer, Cookie and
+// credentials of opts added, as sent with every request. A User-Agent or Referer
+// already in Header is kept.
+func (opts *DownloadOptions) requestHeader() http.Header {
+	header := opts.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if _, ok := header["User-Agent"]; !ok {
+		userAgent := opts.UserAgent
+		if len(userAgent) == 0 {
+			userAgent = DefaultUserAgent
+		}
+		header.Set("User-Agent", userAgent)
+	}
+	if _, ok := header["Referer"]; !ok && len(opts.Referer) != 0 {
+		header.Set("Referer", opts.Referer)
+	}
+	if len(opts.Cookie) != 0 {
+		header.Add("Cookie", opts.Cookie)
+	}
+	if len(opts.Username) != 0 {
+		header.Set("Authorization", basicAuth(opts.Username, opts.Password))
+	}
+	if len(opts.BearerToken) != 0 {
+		header.Set("Authorization", bearerAuth(opts.BearerToken))
+	}
+	return header
+}
+
+// newClient creates the HTTP client requests are sent with, configured by the TLS, proxy,
+// netrc, connection and IP version options of opts. With Verbose, every request is logged
+// to w. Unset options take their defaults, so the CLI can send requests other than
+// downloads, such as for a url file, the same way Download does.
+func (opts *DownloadOptions) newClient(w io.Writer) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(opts.Insecure, opts.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+	config := clientConfig{
+		maxRedirects:       opts.MaxRedirects,
+		proxy:              opts.Proxy,
+		tlsConfig:          tlsConfig,
+		disableCompression: opts.NoDecompress,
+		maxIdleConns:       opts.MaxIdleConns,
+		idleConnTimeout:    opts.IdleConnTimeout,
+		disableHTTP2:       opts.DisableHTTP2 || opts.HTTPVersion == HTTPVersion1,
+	}
+	switch {
+	case config.maxRedirects == 0:
+		config.maxRedirects = DefaultMaxRedirects
+	case config.maxRedirects < 0:
+		config.maxRedirects = 0
+	}
+	if config.maxIdleConns == 0 {
+		config.maxIdleConns = DefaultMaxIdleConns
+	}
+	if config.idleConnTimeout == 0 {
+		config.idleConnTimeout = DefaultIdleConnTimeout
+	}
+	if len(opts.NetrcFile) != 0 {
+		config.netrc, err = readNetrc(opts.NetrcFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Verbose {
+		config.verbose = w
+	}
+	switch {
+	case opts.IPv4:
+		config.network = "tcp4"
+	case opts.IPv6:
+		config.network = "tcp6"
+	}
+	return httpClient(config), nil
+}
+
+// path returns the entry of Paths for the url at index i, if any.
+func (opts *DownloadOptions) path(i int) string {
+	if i < len(opts.Paths) {
+		return opts.Paths[i]
+	}
+	return ""
+}
+
+// place returns remote saved where the url at index i is saved inside Location: under
+// its entry of Paths if it has one, or otherwise under the directories of its url path
+// if PreservePath is set, inside a directory named after its host if PerHost is set,
+// and renamed by RenameTemplate.
+func (opts *DownloadOptions) place(i int, remote remoteFile) remoteFile {
+	remote.filename = opts.rename(remote.filename, opts.URLs[i], i+1)
+	if opts.PreservePath {
+		remote.dir = getURLDir(opts.URLs[i])
+	}
+	if opts.PerHost {
+		remote.dir = filepath.Join(getURLHostDir(opts.URLs[i]), remote.dir)
+	}
+	return remote.withPath(opts.path(i))
+}
+
+// mirrors returns the entry of Mirrors for the url at index i, if any.
+func (opts *DownloadOptions) mirrors(i int) []string {
+	if i < len(opts.Mirrors) {
+		return opts.Mirrors[i]
+	}
+	return nil
+}
+
+// lookup looks up url with a HEAD request, or a request for its first byte if NoHead
+// is set or the server doesn't support HEAD. A file:// url is looked up on disk. Unless
+// modifiedSince is zero, it is sent as If-Modified-Since.
+func (d *downloader) lookup(ctx context.Context, url string, modifiedSince time.Time) (remoteFile, error) {
+	if isFileURL(url) {
+		return lookupLocalFile(url)
+	}
+	// Sending the request twice could have side effects, so the file is only named after the url
+	if d.opts.Method != http.MethodGet {
+		return remoteFile{source: url, contentLength: -1, filename: getURLFileName(url, d.opts.KeepQuery), statusCode: http.StatusOK}, nil
+	}
+
+	header := d.opts.Header
+	if !modifiedSince.IsZero() {
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("If-Modified-Since", modifiedSince.UTC().Format(http.TimeFormat))
+	}
+
+	var remote remoteFile
+	var err error
+	if !d.opts.NoHead {
+		remote, err = getRemoteFile(ctx, d.client, url, header, d.opts.GuessExtension, d.opts.KeepQuery)
+		if err != nil {
+			return remote, err
+		}
+	}
+	if d.opts.NoHead || remote.statusCode == http.StatusMethodNotAllowed || remote.statusCode == http.StatusNotImplemented {
+		remote, err = probeRemoteFile(ctx, d.client, url, header, d.opts.GuessExtension, d.opts.KeepQuery)
+		if err != nil {
+			return remote, err
+		}
+	}
+	if !d.opts.NoDecompress && isCompressed(remote.contentEncoding) {
+		// Content-Length is the size of the compressed file, not of the file saved
+		remote.contentLength = -1
+	}
+	d.log.debugf("Looked up %v: status %d, %d bytes", url, remote.statusCode, remote.contentLength)
+	return remote, nil
+}
+
+// lookupStatusError returns the StatusError of a remote file that was looked up with an
+// error status that won't change if it is requested again, such as 404, or nil otherwise.
+// A missing file:// url is reported by the error opening it instead.
+func lookupStatusError(remote remoteFile) error {
+	if remote.statusCode < http.StatusBadRequest || isFileURL(remote.source) {
+		return nil
+	}
+	err := StatusError{StatusCode: remote.statusCode}
+	if isRetryable(err) {
+		return nil
+	}
+	return err
+}
+
+// downloadFile downloads a single url into the download location, reporting the bytes
+// written on d.bytesChan. remote is the file looked up for url, or for one of its mirrors
+// if url couldn't be reached. The other mirrors are tried in turn if it fails.
+func (d *downloader) downloadFile(ctx context.Context, url string, remote remoteFile, mirrors []string) (result FileResult) {
+	result = FileResult{URL: url}
+
+	if d.opts.Timeout > 0 {
+		fileCtx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+		defer cancel()
+		defer func() {
+			// Report the timeout rather than the error it caused
+			if result.Err != nil && ctx.Err() == nil && errors.Is(fileCtx.Err(), context.DeadlineExceeded) {
+				result.Err = fmt.Errorf("download timed out after %v: %w", d.opts.Timeout, context.DeadlineExceeded)
+			}
+		}()
+		ctx = fileCtx
+	}
+
+	var tr *requestTrace
+	if d.opts.Trace {
+		tr = &requestTrace{}
+		ctx = withRequestTrace(ctx, tr)
+	}
+
+	// Don't download a file that is already known to be too small
+	if remote.contentLength >= 0 && remote.contentLength < d.opts.MinFileSize {
+		result.Err = fmt.Errorf("%w: %v is %d bytes", ErrFileTooSmall, url, remote.contentLength)
+		return result
+	}
+
+	var err error
+	if d.opts.Destination == nil {
+		result.Path, err = d.getDestinationPath(remote)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		if len(remote.dir) != 0 {
+			err = os.MkdirAll(filepath.Dir(result.Path), 0777)
+			if err != nil {
+				result.Err = err
+				return result
+			}
+		}
+	}
+
+	// Start from scratch if asked to, even if the file is already complete
+	if d.opts.Destination == nil && d.opts.Force {
+		err := removeDownload(result.Path)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	// Compare the content length of each file with an existing file size. If they are equal,
+	// no need to download file because has already downloaded completely.
+	if d.opts.Destination == nil {
+		existingFileSize, err := getExistingFileSize(result.Path)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		// With TimeCond, an existing file is only kept if it wasn't modified since.
+		// An empty remote file is only complete if the file exists
+		if existingFileSize == remote.contentLength && !d.opts.TimeCond && fileExists(result.Path) {
+			result.Err = checkFile(d.opts, result.Path, d.checksum(result.Path))
+			if result.Err == nil && len(d.opts.Hash) != 0 {
+				result.Hash, result.Err = newFileHash(d.opts.Hash).sum(result.Path)
+			}
+			return result
+		}
+	}
+
+	// Restart from scratch if the remote file changed since an earlier run
+	var meta resumeMeta
+	if d.opts.Destination == nil {
+		meta, err = prepareResume(url, result.Path, remote)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	h := newFileHash(d.opts.Hash)
+	err = d.fetchWithRetries(ctx, url, remote, meta, &result, h)
+	source := remote.source
+	for _, mirror := range append([]string{url}, mirrors...) {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if mirror == remote.source {
+			continue
+		}
+		mirrorRemote, mirrorErr := d.lookupMirror(ctx, mirror, remote, result.Path, err)
+		if mirrorErr != nil {
+			err = mirrorErr
+			continue
+		}
+		err = d.fetchWithRetries(ctx, url, mirrorRemote, meta, &result, h)
+		source = mirror
+	}
+	if tr != nil {
+		result.Timings = tr.timings()
+	}
+	if err != nil && len(mirrors) > 0 {
+		err = fmt.Errorf("every mirror failed, the last with: %w", err)
+	}
+	if err == nil && source != url {
+		result.Mirror = source
+	}
+	if err == nil && d.opts.Destination == nil {
+		// The rest of the file was downloaded by an earlier run
+		info, statErr := os.Stat(result.Path)
+		result.Resumed = statErr == nil && result.BytesWritten < info.Size()
+	}
+	// The next run asks whether the file changed since the server last modified it
+	if err == nil && d.opts.TimeCond && d.opts.Destination == nil {
+		if lastModified, parseErr := http.ParseTime(remote.lastModified); parseErr == nil {
+			err = os.Chtimes(result.Path, lastModified, lastModified)
+		}
+	}
+	if err == nil && h != nil {
+		if d.opts.Destination != nil {
+			result.Hash = hex.EncodeToString(h.Sum(nil))
+		} else {
+			result.Hash, err = h.sum(result.Path)
+		}
+	}
+	result.Err = err
+	return result
+}
+
+// lookupMirror looks up the mirror source of remote, after remote failed with err. The data
+// already at path is kept for the mirror to resume from if the mirror reports the same size
+// as remote, and remote didn't fail its checksum. Otherwise it is deleted.
+func (d *downloader) lookupMirror(ctx context.Context, source string, remote remoteFile, path string, err error) (remoteFile, error) {
+	mirror, lookupErr := d.lookup(ctx, source, time.Time{})
+	if lookupErr != nil {
+		return mirror, lookupErr
+	}
+	if mirror.statusCode >= http.StatusBadRequest {
+		return mirror, StatusError{StatusCode: mirror.statusCode}
+	}
+	var checksumErr ChecksumError
+	if d.opts.Destination == nil && (errors.As(err, &checksumErr) || mirror.contentLength < 0 || mirror.contentLength != remote.contentLength) {
+		removeErr := os.Remove(getPartPath(path))
+		if removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			return mirror, removeErr
+		}
+	}
+	return mirror, nil
+}
+
+// fetchWithRetries downloads remote, retrying failed attempts, and adds the bytes written
+// to result. The progress of the download is reported under url, and the data written is
+// hashed by h, if not nil.
+func (d *downloader) fetchWithRetries(ctx context.Context, url string, remote remoteFile, meta resumeMeta, result *FileResult, h *fileHash) error {
+	// A .part file that is only partly written in segments can already have the full size,
+	// so the sidecar file records that it can't be taken as complete by a later run
+	if d.opts.Destination == nil && d.segmented(remote) {
+		meta.Segmented = true
+		err := writeResumeMeta(result.Path, meta)
+		if err != nil {
+			return err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		var written int64
+		var err error
+		if d.opts.Destination != nil {
+			written, err = d.streamFile(ctx, url, result.BytesWritten, remote, h)
+		} else {
+			written, err = d.fetchFile(ctx, url, getPartPath(result.Path), remote, h)
+		}
+		result.BytesWritten += written
+		if err == nil {
+			if d.opts.Destination == nil {
+				return completeFile(d.opts, result.Path, d.checksum(result.Path))
+			}
+			return nil
+		}
+		if d.opts.Destination == nil {
+			// Record how far the download got. It can still be resumed without the record
+			_ = writeResumeMeta(result.Path, meta)
+		}
+		if attempt >= d.opts.Retries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := d.retryDelay(err, attempt)
+		d.log.debugf("Attempt %d of %v failed, retrying in %v: %v", attempt+1, url, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// existingModTime returns the modification time of the file remote is saved to if TimeCond
+// is set and the file exists, or the zero time otherwise.
+func (d *downloader) existingModTime(remote remoteFile) time.Time {
+	if !d.opts.TimeCond || d.opts.Force || d.opts.Destination != nil {
+		return time.Time{}
+	}
+	path, err := d.getDestinationPath(remote)
+	if err != nil {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// notModified reports whether remote is the same file as one modified at modTime: the
+// server answered 304 Not Modified, or reported a Last-Modified time that isn't later
+// for a server that ignores If-Modified-Since.
+func notModified(remote remoteFile, modTime time.Time) bool {
+	if remote.statusCode == http.StatusNotModified {
+		return true
+	}
+	lastModified, err := http.ParseTime(remote.lastModified)
+	return err == nil && remote.statusCode < http.StatusBadRequest && !lastModified.After(modTime)
+}
+
+// limiterFor returns the rateLimiter throttling the transfer of source: the limiter of its
+// host if LimitRatePerHost is set, which is also throttled by LimitRate, or the limiter of
+// LimitRate otherwise.
+func (d *downloader) limiterFor(source string) *rateLimiter {
+	if d.hostLimiters == nil {
+		return d.limiter
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return d.limiter
+	}
+	return d.hostLimiters.get(u.Hostname())
+}
+
+// skipExisting returns the path remote is saved to, and whether it is skipped because
+// NoClobber is set and a file already exists there.
+func (d *downloader) skipExisting(remote remoteFile) (string, bool) {
+	if !d.opts.NoClobber || d.opts.Force || d.opts.Destination != nil {
+		return "", false
+	}
+	path, err := d.getDestinationPath(remote)
+	if err != nil {
+		return "", false
+	}
+	_, err = os.Stat(path)
+	return path, err == nil
+}
+
+// getDestinationPath returns the path url is saved to, which is named after
+// the file unless Filename is set.
+func (d *downloader) getDestinationPath(remote remoteFile) (string, error) {
+	if len(d.opts.Filename) != 0 {
+		return filepath.Join(d.opts.Location, d.opts.Filename), nil
+	}
+	if len(remote.filename) == 0 {
+		return "", ErrNoFilename
+	}
+	return filepath.Join(d.opts.Location, remote.dir, remote.filename), nil
+}
+
+// request sends the request for the file at source, for the bytes from offset onwards. Files
+// requested with a Method other than GET are always requested whole, with Body. A file://
+// source is opened instead.
+func (d *downloader) request(ctx context.Context, source string, offset int64, ifRange string) (*http.Response, error) {
+	if offset > 0 {
+		d.log.debugf("Requesting %v from byte %d", source, offset)
+	} else {
+		d.log.debugf("Requesting %v", source)
+	}
+	ctx = traceRequest(ctx)
+	var resp *http.Response
+	var err error
+	switch {
+	case isFileURL(source):
+		resp, err = openLocalFile(source, offset)
+	case d.opts.Method != http.MethodGet:
+		resp, err = sendHTTPRequestWithBody(ctx, d.opts.Method, source, d.client, d.opts.Header, d.opts.Body)
+	default:
+		resp, err = sendHTTPRequestWithHeader(ctx, source, d.client, d.opts.Header, offset, ifRange)
+	}
+	if err == nil {
+		d.log.debugf("%v responded with %d %s", source, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return resp, err
+}
+
+// streamFile makes a single attempt at downloading url to Destination and returns the number
+// of bytes written. The first offset bytes have already been written by an earlier attempt,
+// so they are skipped. The data written is hashed by h, if not nil.
+func (d *downloader) streamFile(ctx context.Context, url string, offset int64, remote remoteFile, h *fileHash) (int64, error) {
+	// The offset into a decompressed file can't be requested as a range of the compressed file
+	rangeStart := offset
+	if !d.opts.NoDecompress && isCompressed(remote.contentEncoding) {
+		rangeStart = 0
+	}
+	resp, err := d.request(ctx, remote.source, rangeStart, "")
+	if err != nil {
+		return 0, err
+	}
+	resp.Body = newIdleReader(resp.Body, d.opts.IdleTimeout)
+	defer resp.Body.Close()
+
+	if !d.opts.NoDecompress && resp.StatusCode == http.StatusOK {
+		_, err := decodeBody(resp)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if !d.opts.NoDecompress && resp.StatusCode == http.StatusPartialContent && isCompressed(resp.Header.Get("Content-Encoding")) {
+		return 0, fmt.Errorf("server sent part of a %s encoded file, which can't be resumed", resp.Header.Get("Content-Encoding"))
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		start, err := getContentRangeStart(resp)
+		if err != nil {
+			return 0, err
+		}
+		if start != offset {
+			return 0, fmt.Errorf("server resumed download at byte %d instead of byte %d", start, offset)
+		}
+	case resp.StatusCode == http.StatusOK:
+		// The server sent the whole file, so skip what was already written
+		_, err := io.CopyN(io.Discard, resp.Body, offset)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, newStatusError(resp)
+	}
+
+	decoded := resp.Uncompressed || (!d.opts.NoDecompress && isCompressed(resp.Header.Get("Content-Encoding")))
+	// Each attempt carries on from the last, so the hash does too
+	dst := d.opts.Destination
+	if h != nil {
+		dst = io.MultiWriter(dst, h)
+	}
+	written, err := copyBody(ctx, dst, resp, url, d.bytesChan, d.limiterFor(remote.source), d.opts.BufferSize)
+	if err != nil || decoded {
+		return written, err
+	}
+	return written, d.checkSize(remote, offset+written)
+}
+
+// checksum returns the checksum the file saved to path is verified against: Checksum, or
+// the entry of path in ChecksumFile. A warning is written if ChecksumFile doesn't list path.
+func (d *downloader) checksum(path string) string {
+	if d.checksums == nil {
+		return d.opts.Checksum
+	}
+	name, err := filepath.Rel(d.opts.Location, path)
+	if err != nil {
+		name = filepath.Base(path)
+	}
+	checksum, ok := d.checksums.lookup(filepath.ToSlash(name))
+	if !ok {
+		d.log.infof("Warning: %s isn't listed in %s, so it isn't verified", path, d.opts.ChecksumFile)
+	}
+	return checksum
+}
+
+// completeFile verifies the downloaded .part file of path against checksum, if not empty,
+// renames it to path and deletes its sidecar file.
+func completeFile(opts *DownloadOptions, path, checksum string) error {
+	partPath := getPartPath(path)
+	err := checkFile(opts, partPath, checksum)
+	if err != nil {
+		// Nothing is left to resume if the .part file was deleted
+		var checksumErr ChecksumError
+		if (errors.As(err, &checksumErr) && opts.DeleteOnChecksumMismatch) || errors.Is(err, ErrFileTooSmall) {
+			if removeErr := removeResumeMeta(path); removeErr != nil {
+				return removeErr
+			}
+		}
+		return err
+	}
+	err = os.Rename(partPath, path)
+	if err != nil {
+		return err
+	}
+	return removeResumeMeta(path)
+}
+
+// removeDownload deletes the file at path, along with its .part and sidecar files.
+func removeDownload(path string) error {
+	for _, p := range []string{path, getPartPath(path), getMetaPath(path)} {
+		err := os.Remove(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFile verifies a completed download against checksum, if not empty. A file smaller
+// than MinFileSize is deleted.
+func checkFile(opts *DownloadOptions, path, checksum string) error {
+	if opts.MinFileSize > 0 {
+		size, err := getExistingFileSize(path)
+		if err != nil {
+			return err
+		}
+		if size < opts.MinFileSize {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %s was %d bytes", ErrFileTooSmall, path, size)
+		}
+	}
+	if len(checksum) == 0 {
+		return nil
+	}
+	err := verifyChecksum(path, checksum)
+	var checksumErr ChecksumError
+	if errors.As(err, &checksumErr) && opts.DeleteOnChecksumMismatch {
+		if removeErr := os.Remove(path); removeErr != nil {
+			return removeErr
+		}
+	}
+	return err
+}
+
+// fetchFile makes a single attempt at downloading url to destinationPath, which is the .part
+// file of the download, and returns the number of bytes written. If part of the file is already
+// at destinationPath, the download resumes from there, unless it is downloaded in segments.
+// The data of the file is hashed by h, if not nil, unless it is downloaded in segments.
+func (d *downloader) fetchFile(ctx context.Context, url, destinationPath string, remote remoteFile, h *fileHash) (int64, error) {
+	// Get file size from download destination
+	existingFileSize, err := getExistingFileSize(destinationPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// The .part file may be complete if an earlier run stopped before renaming it
+	if existingFileSize == remote.contentLength && fileExists(destinationPath) {
+		return 0, nil
+	}
+
+	// Appending to a .part file larger than the remote file would only make it larger
+	if remote.contentLength >= 0 && existingFileSize > remote.contentLength {
+		d.log.infof("Warning: %s is %d bytes, larger than the %d bytes of %v", destinationPath, existingFileSize, remote.contentLength, url)
+		if d.opts.OnOversize == OversizeError {
+			return 0, fmt.Errorf("%w: %s is %d bytes, the remote file %d", ErrOversize, destinationPath, existingFileSize, remote.contentLength)
+		}
+		err := os.Truncate(destinationPath, 0)
+		if err != nil {
+			return 0, err
+		}
+		existingFileSize = 0
+	}
+
+	// A decompressed file can't be resumed from a range of the compressed file,
+	// so it is downloaded from scratch
+	decompress := !d.opts.NoDecompress
+	if decompress && isCompressed(remote.contentEncoding) {
+		existingFileSize = 0
+	}
+
+	if d.segmented(remote) {
+		// Segments are written out of order, so the file is hashed once it is complete
+		if h != nil {
+			h.Reset()
+		}
+		return d.fetchSegments(ctx, url, destinationPath, remote)
+	}
+
+	// Make the HTTP request to download file
+	resp, err := d.request(ctx, remote.source, existingFileSize, remote.validator())
+	if err != nil {
+		return 0, err
+	}
+
+	// The .part file reaches the end of the remote file, e.g. because the remote file shrank.
+	// It is complete if it is exactly as large, otherwise the download restarts from scratch.
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && existingFileSize > 0 {
+		resp.Body.Close()
+		size := getContentRangeSize(resp)
+		if size < 0 {
+			size = remote.contentLength
+		}
+		if size == existingFileSize {
+			return 0, nil
+		}
+		err := os.Truncate(destinationPath, 0)
+		if err != nil {
+			return 0, err
+		}
+		resp, err = d.request(ctx, remote.source, 0, "")
+		if err != nil {
+			return 0, err
+		}
+	}
+	resp.Body = newIdleReader(resp.Body, d.opts.IdleTimeout)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, newStatusError(resp)
+	}
+
+	// Write to destination file
+	decoded := resp.Uncompressed || (decompress && isCompressed(resp.Header.Get("Content-Encoding")))
+	written, err := writeToDestinationFile(ctx, destinationPath, resp, url, d.bytesChan, d.limiterFor(remote.source), decompress, d.opts.BufferSize, h)
+	if err != nil || decoded {
+		return written, err
+	}
+	size, err := getExistingFileSize(destinationPath)
+	if err != nil {
+		return written, err
+	}
+	return written, d.checkSize(remote, size)
+}
+
+// checkSize returns an error wrapping ErrSizeMismatch if size, the size of the file downloaded
+// for remote, isn't the size the server reported, e.g. because the connection was closed early
+// without an error. The download can then be retried. It returns nil if the size is unknown or
+// the Range of Header asks for part of the file.
+func (d *downloader) checkSize(remote remoteFile, size int64) error {
+	if remote.contentLength < 0 || len(d.opts.Header.Values("Range")) != 0 || size == remote.contentLength {
+		return nil
+	}
+	return fmt.Errorf("%w: got %d of %d bytes", ErrSizeMismatch, size, remote.contentLength)
+}
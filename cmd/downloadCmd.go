@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,17 +10,112 @@ import (
 	"io/fs"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
 )
 
+// passwordEnv is the environment variable the basic authentication password
+// is read from when it isn't given on the command line.
+const passwordEnv = "DLMANAGER_PASSWORD"
+
+// stdin is where urls are read from if none are given, and where the basic
+// authentication password is read from as a last resort.
+var stdin io.Reader = os.Stdin
+
+// stderr receives messages when the downloaded file is written to stdout.
+var stderr io.Writer = os.Stderr
+
+// stringsFlag is a repeatable flag collecting every value it is given.
+type stringsFlag []string
+
+func (h *stringsFlag) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *stringsFlag) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+// hashFlag is the -print-hash flag. Given without a value it selects sha256, otherwise
+// the algorithm named by its value, e.g. -print-hash=sha512.
+type hashFlag string
+
+func (h *hashFlag) String() string {
+	return string(*h)
+}
+
+func (h *hashFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*h = "sha256"
+	case "false":
+		*h = ""
+	default:
+		*h = hashFlag(value)
+	}
+	return nil
+}
+
+func (h *hashFlag) IsBoolFlag() bool {
+	return true
+}
+
+// downloadConfig holds the options of the download sub-command.
 type downloadConfig struct {
-	url      []string
-	location string
-	numFiles int
-	mu       *sync.Mutex
+	DownloadOptions
+	numFiles  int
+	limitRate string
+	headers   stringsFlag
+	// bufferSize holds the -buffer-size option, such as 64k
+	bufferSize string
+	// minFileSize holds the -min-filesize option, such as 1k
+	minFileSize string
+	// limitRatePerHost holds the -limit-rate-per-host option, such as 500k
+	limitRatePerHost string
+	// output holds the -output option, where - writes the file to stdout
+	output string
+	// maxRedirects holds the -max-redirects option, where 0 follows no redirects
+	maxRedirects int
+	// user holds the -user option, either a username or username:password
+	user string
+	// proxy holds the -proxy option
+	proxy string
+	// urlsFromStdin is set if the urls are read from stdin
+	urlsFromStdin bool
+	// continueOnError holds the -continue-on-error option, the inverse of StopOnError
+	continueOnError bool
+	// mirrors holds the -mirror options, the mirrors of the single url downloaded
+	mirrors stringsFlag
+	// data and dataFile hold the -data and -data-file options, the request body
+	data     string
+	dataFile string
+	// quiet holds the -quiet option, which hides progress and the summary
+	quiet bool
+	// tokenFile and tokenEnv hold the -token-file and -token-env options, where the
+	// bearer token is read from
+	tokenFile string
+	tokenEnv  string
+	// netrc holds the -netrc option, which reads credentials from $NETRC or ~/.netrc
+	netrc bool
+	// deadline holds the -deadline option, how long the whole batch may take
+	deadline time.Duration
+	// stripQuery holds the -strip-query option, the inverse of KeepQuery
+	stripQuery bool
+	// printHash holds the -print-hash option, the algorithm of the hashes printed
+	printHash hashFlag
+	// sync holds the -sync option, which downloads the files listed in index pages
+	sync bool
+	// level holds the -level option, how many links deep -sync follows pages
+	level int
 }
 
 // validateConfig validates downloadConfig and returns an error if it finds any.
@@ -29,6 +125,13 @@ func validateConfig(file string, config *downloadConfig, fs *flag.FlagSet) error
 		isFile = true
 	}
 
+	// Without -url-file, -x or positional arguments, urls are read from stdin if it
+	// is piped rather than a terminal. The urls are then validated like a -url-file
+	if !isFile && config.numFiles == 0 && fs.NArg() == 0 && isStdinPiped() {
+		config.urlsFromStdin = true
+		isFile = true
+	}
+
 	// guard against -x option and -url-file options both specified
 	if isFile && config.numFiles != 0 {
 		return InvalidInputError{ErrNumFilesMustBeZero}
@@ -44,37 +147,343 @@ func validateConfig(file string, config *downloadConfig, fs *flag.FlagSet) error
 		return InvalidInputError{ErrNumDownloadFiles}
 	}
 
+	// expand numeric ranges such as file[1-10].zip in the urls given as arguments
+	var urls []string
+	if !isFile {
+		for _, arg := range fs.Args() {
+			expanded, err := expandURLRange(arg)
+			if err != nil {
+				return InvalidInputError{err}
+			}
+			urls = append(urls, expanded...)
+		}
+	}
+
+	// guard against specifying 0 or a negative number for -max-concurrent option
+	if config.MaxConcurrent < 1 {
+		return InvalidInputError{ErrMaxConcurrent}
+	}
+
+	// guard against specifying 0 or a negative number for -segments option
+	if config.Segments < 1 {
+		return InvalidInputError{ErrNumSegments}
+	}
+
+	// guard against specifying a negative number for -retries option
+	if config.Retries < 0 {
+		return InvalidInputError{ErrNumRetries}
+	}
+
+	if config.RetryBackoff < 0 {
+		return InvalidInputError{ErrRetryBackoff}
+	}
+
+	if config.MaxRetryAfter <= 0 {
+		return InvalidInputError{ErrMaxRetryAfter}
+	}
+
+	if err := validateRenameTemplate(config.RenameTemplate); err != nil {
+		return InvalidInputError{err}
+	}
+
+	if config.deadline < 0 {
+		return InvalidInputError{ErrDeadline}
+	}
+
+	if config.Timeout < 0 {
+		return InvalidInputError{ErrTimeout}
+	}
+
+	if config.IdleTimeout < 0 {
+		return InvalidInputError{ErrIdleTimeout}
+	}
+
+	if config.ProgressInterval <= 0 {
+		return InvalidInputError{ErrProgressInterval}
+	}
+
+	if config.MaxIdleConns < 1 {
+		return InvalidInputError{ErrMaxIdleConns}
+	}
+
+	if config.IdleConnTimeout <= 0 {
+		return InvalidInputError{ErrIdleConnTimeout}
+	}
+
+	// -http-version defaults to 2, so it only conflicts with -disable-http2 if it's given
+	if config.DisableHTTP2 && config.HTTPVersion == HTTPVersion2 {
+		var httpVersionSet bool
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "http-version" {
+				httpVersionSet = true
+			}
+		})
+		if httpVersionSet {
+			return InvalidInputError{ErrHTTP2Conflict}
+		}
+	}
+
+	// parse the human-readable -buffer-size option into bytes
+	if len(config.bufferSize) != 0 {
+		size, err := parseByteSize(config.bufferSize)
+		if err != nil || size <= 0 || size > MaxBufferSize {
+			return InvalidInputError{ErrInvalidBufferSize}
+		}
+		config.BufferSize = int(size)
+	}
+
+	// parse the human-readable -limit-rate option into bytes per second
+	if len(config.limitRate) != 0 {
+		rate, err := parseByteSize(config.limitRate)
+		if err != nil || rate <= 0 {
+			return InvalidInputError{ErrInvalidLimitRate}
+		}
+		config.LimitRate = rate
+	}
+	if len(config.limitRatePerHost) != 0 {
+		rate, err := parseByteSize(config.limitRatePerHost)
+		if err != nil || rate <= 0 {
+			return InvalidInputError{ErrInvalidHostRate}
+		}
+		config.LimitRatePerHost = rate
+	}
+
+	// parse the human-readable -min-filesize option into bytes
+	if len(config.minFileSize) != 0 {
+		size, err := parseByteSize(config.minFileSize)
+		if err != nil {
+			return InvalidInputError{ErrInvalidMinFileSize}
+		}
+		config.MinFileSize = size
+	}
+
+	// guard against specifying a negative number for -max-redirects option
+	if config.maxRedirects < 0 {
+		return InvalidInputError{ErrMaxRedirects}
+	}
+	config.MaxRedirects = config.maxRedirects
+	if config.MaxRedirects == 0 {
+		config.MaxRedirects = -1
+	}
+
+	// parse the -header options into the request header
+	if len(config.headers) != 0 {
+		header, err := parseHeaders(config.headers)
+		if err != nil {
+			return InvalidInputError{err}
+		}
+		config.Header = header
+	}
+
+	// parse -proxy, guarding against unsupported schemes
+	if len(config.proxy) != 0 {
+		proxyURL, err := parseProxyURL(config.proxy)
+		if err != nil {
+			return InvalidInputError{err}
+		}
+		config.Proxy = proxyURL
+	}
+
+	config.StopOnError = !config.continueOnError
+	config.KeepQuery = !config.stripQuery
+	config.Hash = string(config.printHash)
+
+	// -print-hash can be given without a value, so -print-hash sha512 leaves sha512 as a url
+	if len(config.Hash) != 0 && newHash(fs.Arg(0)) != nil {
+		return InvalidInputError{fmt.Errorf("%w, as in -print-hash=%s", ErrPrintHashValue, strings.ToLower(fs.Arg(0)))}
+	}
+
+	// read the request body from -data or -data-file, which need a method other than GET
+	config.Method = strings.ToUpper(config.Method)
+	if len(config.data) != 0 && len(config.dataFile) != 0 {
+		return InvalidInputError{ErrDataTwice}
+	}
+	if len(config.data) != 0 {
+		config.Body = []byte(config.data)
+	}
+	if len(config.dataFile) != 0 {
+		body, err := os.ReadFile(config.dataFile)
+		if err != nil {
+			return err
+		}
+		config.Body = body
+	}
+	if config.Method == http.MethodHead {
+		return InvalidInputError{ErrInvalidMethod}
+	}
+	if config.Method == http.MethodGet && config.Body != nil {
+		return InvalidInputError{ErrBodyWithGet}
+	}
+
+	// an empty -user-agent sends no User-Agent at all
+	if len(config.UserAgent) == 0 {
+		if config.Header == nil {
+			config.Header = http.Header{}
+		}
+		if _, ok := config.Header["User-Agent"]; !ok {
+			config.Header["User-Agent"] = []string{""}
+		}
+	}
+
+	// split -user into username and password, and guard against a password without a user
+	if len(config.user) != 0 {
+		username, password, ok := strings.Cut(config.user, ":")
+		if ok && len(config.Password) != 0 {
+			return InvalidInputError{ErrPasswordTwice}
+		}
+		config.Username = username
+		if ok {
+			config.Password = password
+		}
+	}
+	if len(config.Password) != 0 && len(config.Username) == 0 {
+		return InvalidInputError{ErrPasswordWithoutUser}
+	}
+
+	// read the bearer token from -token-file or -token-env, keeping it out of the process listing
+	if len(config.tokenFile) != 0 && len(config.tokenEnv) != 0 {
+		return InvalidInputError{ErrTokenTwice}
+	}
+	if len(config.tokenFile) != 0 {
+		token, err := os.ReadFile(config.tokenFile)
+		if err != nil {
+			return InvalidInputError{fmt.Errorf("%w: %v", ErrInvalidTokenFile, err)}
+		}
+		config.BearerToken = strings.TrimSpace(string(token))
+		if len(config.BearerToken) == 0 {
+			return InvalidInputError{fmt.Errorf("%w: %s is empty", ErrInvalidTokenFile, config.tokenFile)}
+		}
+	}
+	if len(config.tokenEnv) != 0 {
+		config.BearerToken = strings.TrimSpace(os.Getenv(config.tokenEnv))
+		if len(config.BearerToken) == 0 {
+			return InvalidInputError{fmt.Errorf("%w: $%s", ErrTokenEnvNotSet, config.tokenEnv)}
+		}
+	}
+	if len(config.BearerToken) != 0 && len(config.user) != 0 {
+		return InvalidInputError{ErrAuthTwice}
+	}
+	if config.netrc {
+		path, err := getNetrcPath()
+		if err != nil {
+			return InvalidInputError{fmt.Errorf("%w: %v", ErrInvalidNetrc, err)}
+		}
+		config.NetrcFile = path
+	}
+
+	// guard against -sync with anything but index pages given as arguments, or with
+	// options for a single file, since an index lists several
+	if config.level < 0 {
+		return InvalidInputError{ErrInvalidLevel}
+	}
+	if config.level > 0 && !config.sync {
+		return InvalidInputError{ErrLevelWithoutSync}
+	}
+	if config.sync {
+		if isFile {
+			return InvalidInputError{ErrSyncURLFile}
+		}
+		if len(config.output) != 0 || len(config.Checksum) != 0 || len(config.mirrors) != 0 {
+			return InvalidInputError{ErrSyncSingleFile}
+		}
+	}
+
+	// guard against -output applied to several files
+	if len(config.output) != 0 {
+		if isFile || config.numFiles > 1 || len(urls) > 1 {
+			return InvalidInputError{ErrOutputSingleFile}
+		}
+		if config.output != "-" {
+			config.Filename = config.output
+		}
+	}
+
+	// guard against an invalid -checksum, or a checksum applied to several files
+	if len(config.Checksum) != 0 {
+		_, _, err := parseChecksum(config.Checksum)
+		if err != nil {
+			return InvalidInputError{err}
+		}
+		if isFile || config.numFiles > 1 || len(urls) > 1 {
+			return InvalidInputError{ErrChecksumSingleFile}
+		}
+		if config.output == "-" {
+			return InvalidInputError{ErrChecksumStdout}
+		}
+	}
+
+	// guard against invalid mirrors, or mirrors of several files
+	if len(config.mirrors) != 0 {
+		if isFile || config.numFiles > 1 || len(urls) > 1 {
+			return InvalidInputError{ErrMirrorSingleFile}
+		}
+		for _, mirror := range config.mirrors {
+			if !isHTTPURL(mirror) && !isFileURL(mirror) {
+				return InvalidInputError{fmt.Errorf("%w: %s", ErrInvalidURL, mirror)}
+			}
+		}
+		config.Mirrors = [][]string{config.mirrors}
+	}
+
 	// validate positional arguments
 	if !(fs.NArg() > 0) && !isFile {
 		return InvalidInputError{ErrNoServerSpecified}
 	}
-	if !isFile && fs.NArg() != config.numFiles {
-		return InvalidInputError{ErrNoServerSpecified}
+	if !isFile && fs.NArg() < config.numFiles {
+		return InvalidInputError{fmt.Errorf("%w: -x is %d, but %d given", ErrTooFewServers, config.numFiles, fs.NArg())}
+	}
+	if !isFile && fs.NArg() > config.numFiles {
+		return InvalidInputError{fmt.Errorf("%w: -x is %d, but %d given", ErrTooManyServers, config.numFiles, fs.NArg())}
+	}
+	if !isFile {
+		config.URLs = urls
 	}
 
 	return nil
 }
 
 // setDownloadLocation sets the download location of the file.
-// If the given file path does not exist, it creates all the missing directories in the path.
-func setDownloadLocation(location string) (string, error) {
+// If the given file path does not exist, it creates all the missing directories in the path,
+// unless mustExist is set. It then checks that files can be created in the location, so a
+// location that isn't writable fails before anything is requested.
+func setDownloadLocation(location string, mustExist bool) (string, error) {
 	_, err := os.Stat(location)
 	if err != nil {
 		if !errors.Is(err, fs.ErrNotExist) {
 			return "", errors.New("error checking download directory" + err.Error())
 		}
+		if mustExist {
+			return "", fmt.Errorf("%w: %s", ErrLocationNotExist, location)
+		}
 		locationPath := filepath.FromSlash(location)
 		err := os.MkdirAll(locationPath, 0777)
 		if err != nil {
 			return "", errors.New("error creating download directory" + err.Error())
 		}
 	}
+
+	f, err := os.CreateTemp(location, ".dlmanager-*")
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return "", InvalidInputError{fmt.Errorf("%w: %s: %v", ErrLocationNotWritable, location, err)}
+	}
+	f.Close()
+	err = os.Remove(f.Name())
+	if err != nil {
+		return "", err
+	}
 	return location, nil
 }
 
-// getFileName fetches the name of the downloadable file.
-func getFileName(r *http.Response) (string, error) {
-	filename := r.Request.URL.Path
+// getFileName fetches the name of the downloadable file. Unless the response names it
+// in its Content-Disposition header, it is named after its url by urlFileName, so the
+// query and fragment are stripped unless keepQuery is set. If guessExtension is set and
+// the name has no extension, one is added based on the Content-Type of the response.
+func getFileName(r *http.Response, guessExtension, keepQuery bool) (string, error) {
+	filename := urlFileName(r.Request.URL, keepQuery)
 	contentDisposition := r.Header.Get("Content-Disposition")
 	if len(contentDisposition) != 0 {
 		_, params, err := mime.ParseMediaType(contentDisposition)
@@ -85,13 +494,264 @@ func getFileName(r *http.Response) (string, error) {
 			}
 		}
 	}
-	filename = filepath.Base(path.Clean("/" + filename))
-	if len(filename) == 0 || filename == "." || filename == "/" {
-		return "", errors.New("filename couldn't be determined")
+	filename = sanitizeFileName(filename)
+	if len(filename) == 0 {
+		return "", ErrNoFilename
+	}
+	if guessExtension && len(filepath.Ext(filename)) == 0 {
+		filename += getExtension(r.Header.Get("Content-Type"))
 	}
 	return filename, nil
 }
 
+// preferredExtensions holds the extension of common download content types, which
+// mime.ExtensionsByType either doesn't know on every system or lists after a less usual
+// one. An empty extension means the content type says nothing about the file.
+var preferredExtensions = map[string]string{
+	"application/gzip":         ".gz",
+	"application/x-tar":        ".tar",
+	"application/zip":          ".zip",
+	"text/plain":               ".txt",
+	"application/octet-stream": "",
+}
+
+// getExtension returns the usual extension of files of contentType, or an empty
+// string if there is none.
+func getExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	// Prefer the extension named after the subtype, e.g. .html over .htm for text/html
+	subtype := mediaType[strings.Index(mediaType, "/")+1:]
+	for _, ext := range exts {
+		if ext == "."+subtype {
+			return ext
+		}
+	}
+	return exts[0]
+}
+
+// getURLFileName returns the name a file is saved as if the server doesn't name it,
+// or an empty string if it can't be determined from rawURL.
+func getURLFileName(rawURL string, keepQuery bool) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return urlFileName(u, keepQuery)
+}
+
+// urlFileName returns the last element of the path of u. The query and fragment aren't
+// part of it, so a signed url such as /file.zip?token=abc&v=2 is named file.zip. If
+// keepQuery is set the query is appended instead, e.g. file.zip?token=abc&v=2, with
+// any slash or colon in it escaped so it stays part of the name.
+func urlFileName(u *url.URL, keepQuery bool) string {
+	name := u.Path
+	if keepQuery && len(u.RawQuery) != 0 {
+		name += "?" + strings.NewReplacer("/", "%2F", ":", "%3A").Replace(u.RawQuery)
+	}
+	return sanitizeFileName(name)
+}
+
+// getURLDir returns the directories of the path of rawURL, relative to the download
+// location, or an empty string if it has none. Each directory is sanitized like a
+// filename, and .. can't lead above the download location.
+func getURLDir(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	// Colons are replaced in each name by sanitizeFileName rather than splitting it
+	dir := strings.ReplaceAll(u.Path, "\\", "/")
+	dir = path.Dir(path.Clean("/" + dir))
+	var names []string
+	for _, name := range strings.Split(dir, "/") {
+		name = sanitizeFileName(name)
+		if len(name) != 0 {
+			names = append(names, name)
+		}
+	}
+	return filepath.Join(names...)
+}
+
+// getURLHostDir returns the host of rawURL, without its port, as a directory name
+// relative to the download location, or an empty string if it has none.
+func getURLHostDir(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	// The colons of an IPv6 address would be taken as separators
+	return sanitizeFileName(strings.ReplaceAll(u.Hostname(), ":", "-"))
+}
+
+// sanitizeFileName strips any directory components and control characters from a
+// server-supplied filename, so the file can't be saved outside the download location.
+// It returns an empty string if nothing usable is left.
+func sanitizeFileName(filename string) string {
+	// Treat backslashes as separators whatever the platform. A colon, as in a drive letter
+	// or a time such as 12:30, isn't allowed in Windows names, so it's replaced
+	filename = strings.NewReplacer("\\", "/", ":", "_").Replace(filename)
+	filename = path.Base(path.Clean("/" + filename))
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(filename)
+	if filename == "." || filename == ".." || filename == "/" {
+		return ""
+	}
+	return filename
+}
+
+// resolveConflicts handles files that resolve to the same filename as an earlier one, so
+// concurrent downloads don't write to the same file. Depending on policy, the file is renamed
+// by appending a numeric suffix, e.g. file(1).zip, marked as a duplicate to be skipped, or
+// an error wrapping ErrFilenameConflict is returned.
+func resolveConflicts(urls []string, remotes []remoteFile, policy string) error {
+	// used maps each path to the index of the url saved to it
+	used := make(map[string]int)
+	for i := range remotes {
+		filename := remotes[i].filename
+		if len(filename) == 0 {
+			continue
+		}
+		dir := remotes[i].dir
+		if j, ok := used[filepath.Join(dir, filename)]; ok {
+			switch policy {
+			case ConflictSkip:
+				remotes[i].duplicate = true
+				continue
+			case ConflictError:
+				return fmt.Errorf("%w: %v and %v are both saved as %s", ErrFilenameConflict, urls[j], urls[i], filepath.Join(dir, filename))
+			}
+		}
+		ext := filepath.Ext(filename)
+		base := strings.TrimSuffix(filename, ext)
+		for n := 1; ; n++ {
+			if _, ok := used[filepath.Join(dir, filename)]; !ok {
+				break
+			}
+			filename = fmt.Sprintf("%s(%d)%s", base, n, ext)
+		}
+		used[filepath.Join(dir, filename)] = i
+		remotes[i].filename = filename
+	}
+	return nil
+}
+
+// parseHeaders parses -header options given as "Key: Value" into a request header.
+func parseHeaders(fields []string) (http.Header, error) {
+	header := http.Header{}
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, ":")
+		key = strings.TrimSpace(key)
+		if !ok || len(key) == 0 {
+			return nil, ErrInvalidHeader
+		}
+		header.Add(key, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// validatePath returns ErrInvalidPath if path, which is relative to the download
+// location, is absolute or leads outside of it.
+func validatePath(path string) error {
+	clean := filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(clean) || len(filepath.VolumeName(clean)) != 0 ||
+		clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return ErrInvalidPath
+	}
+	return nil
+}
+
+// validateURLs returns ErrInvalidURL listing every url and mirror that isn't an absolute
+// http, https or file url, so they are all reported before any request is sent.
+func validateURLs(urls []string, mirrors [][]string) error {
+	var invalid []string
+	for i, rawURL := range urls {
+		candidates := []string{rawURL}
+		if i < len(mirrors) {
+			candidates = append(candidates, mirrors[i]...)
+		}
+		for _, candidate := range candidates {
+			if !isHTTPURL(candidate) && !isFileURL(candidate) {
+				invalid = append(invalid, strconv.Quote(candidate))
+			}
+		}
+	}
+	if len(invalid) != 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidURL, strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// withPath returns r saved to path inside the download location instead of under its
+// own name. A path ending in / names the directory r is saved in under its own name.
+func (r remoteFile) withPath(path string) remoteFile {
+	if len(path) == 0 {
+		return r
+	}
+	path = filepath.FromSlash(path)
+	if strings.HasSuffix(path, string(filepath.Separator)) {
+		r.dir = filepath.Clean(path)
+		return r
+	}
+	r.dir, r.filename = filepath.Split(filepath.Clean(path))
+	return r
+}
+
+// getContentRangeStart returns the offset of the first byte in a 206 Partial Content response.
+func getContentRangeStart(r *http.Response) (int64, error) {
+	var start int64
+	contentRange := r.Header.Get("Content-Range")
+	_, err := fmt.Sscanf(contentRange, "bytes %d-", &start)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+	}
+	return start, nil
+}
+
+// getContentRangeSize returns the size of the whole file in a 206 Partial Content response,
+// or -1 if the server didn't report it.
+func getContentRangeSize(r *http.Response) int64 {
+	contentRange := r.Header.Get("Content-Range")
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// partSuffix is appended to the name of a file while it is being downloaded.
+const partSuffix = ".part"
+
+// getPartPath returns the path a file is downloaded to before it is complete.
+// Once complete, it is renamed to path.
+func getPartPath(path string) string {
+	return path + partSuffix
+}
+
+// fileExists reports whether filename exists and isn't a directory.
+func fileExists(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && !info.IsDir()
+}
+
 // getExistingFileSize checks for the existence of the file in the download destination directory.
 // If the file already exists, it returns an integer > 0. If the file does not exist, it returns 0.
 func getExistingFileSize(filename string) (int64, error) {
@@ -110,141 +770,656 @@ func getExistingFileSize(filename string) (int64, error) {
 	return fileSize, nil
 }
 
-// writeToDestinationFile writes data to destination file.
-func writeToDestinationFile(filepath string, r *http.Response, bytesChan chan int64) error {
+// writeToDestinationFile writes data to destination file and returns the number of bytes written.
+// If decompress is set, a gzip or deflate encoded response is decompressed before it is written.
+// If ctx is cancelled, it stops between chunks and leaves the data written so far in place.
+// If h is not nil, it is reset and hashes the whole file, including any data resumed from.
+func writeToDestinationFile(ctx context.Context, filepath string, r *http.Response, url string, bytesChan chan progressEvent, limiter *rateLimiter, decompress bool, bufferSize int, h *fileHash) (int64, error) {
 	fInfo, err := getExistingFileSize(filepath)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	if decompress && isCompressed(r.Header.Get("Content-Encoding")) {
+		if r.StatusCode == http.StatusPartialContent {
+			// Part of a compressed file can't be decompressed, so the next attempt starts from scratch
+			if fInfo > 0 {
+				err := os.Truncate(filepath, 0)
+				if err != nil {
+					return 0, err
+				}
+			}
+			return 0, fmt.Errorf("server sent part of a %s encoded file, which can't be resumed", r.Header.Get("Content-Encoding"))
+		}
+		_, err := decodeBody(r)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Only append to the existing data if the server honoured the range request.
+	// A 200 response carries the whole file, so the existing data is discarded.
+	resume := fInfo > 0 && r.StatusCode == http.StatusPartialContent
+	if resume {
+		start, err := getContentRangeStart(r)
+		if err != nil {
+			return 0, err
+		}
+		if start != fInfo {
+			return 0, fmt.Errorf("server resumed download at byte %d instead of byte %d", start, fInfo)
+		}
 	}
 
 	// Set flag based on the existence of file in download destination
-	flag := os.O_CREATE | os.O_WRONLY
-	if fInfo > 0 {
-		flag = os.O_APPEND | os.O_WRONLY
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flag = os.O_APPEND | os.O_RDWR
 	}
 
 	file, err := os.OpenFile(filepath, flag, 0666)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer file.Close()
 
 	// Move to the end of the file if some data is already downloaded into file
 	whence := io.SeekStart
-	if fInfo > 0 {
+	if resume {
 		whence = io.SeekEnd
 	}
 	_, err = file.Seek(0, whence)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	mu := sync.Mutex{}
-	chunkSize := 32 * 1024
-	bytes := make([]byte, chunkSize)
-	var written int64
-
-	for {
-		// Populate the bytes slice
-		bytesRead, err := r.Body.Read(bytes)
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return err
-			}
-		}
-		if bytesRead > 0 {
-			// Write the data from the bytes slice to destination file
-			fw, err := file.Write(bytes[0:bytesRead])
+	var dst io.Writer = file
+	if h != nil {
+		h.Reset()
+		// The data already downloaded is read once, so that the hash covers the whole file
+		if resume {
+			_, err := io.Copy(h, io.NewSectionReader(file, 0, fInfo))
 			if err != nil {
-				return err
-			}
-			if fw > 0 {
-				mu.Lock()
-				written += int64(fw)
-				mu.Unlock()
-				bytesChan <- written
+				return 0, err
 			}
 		}
+		dst = io.MultiWriter(file, h)
 	}
-	return nil
+	return copyBody(ctx, dst, r, url, bytesChan, limiter, bufferSize)
 }
 
-// getContentLength returns an int64 of the Content-Length of each single file to be downloaded.
-func getContentLength(client *http.Client, url string) (int64, error) {
-	resp, err := sendHTTPHeadRequest(url, client)
-	if err != nil {
+// copyBody copies the response body to dst in chunks of up to bufferSize bytes, reporting the
+// bytes written by each chunk on bytesChan, and returns the number of bytes written. If ctx is
+// cancelled, it stops between chunks. The transfer is throttled by limiter, if not nil.
+func copyBody(ctx context.Context, dst io.Writer, r *http.Response, url string, bytesChan chan progressEvent, limiter *rateLimiter, bufferSize int) (int64, error) {
+	w := &progressWriter{ctx: ctx, w: dst, url: url, bytesChan: bytesChan, limiter: limiter}
+	// Hide any WriteTo method of the body, which would bypass the buffer and its chunk size
+	src := struct{ io.Reader }{r.Body}
+	written, err := io.CopyBuffer(w, src, make([]byte, bufferSize))
+	if err == nil {
+		err = ctx.Err()
+	}
+	return written, err
+}
+
+// progressWriter writes to w, reporting the bytes of each write on bytesChan under url.
+// Each write waits for limiter to allow it, and fails once ctx is cancelled.
+type progressWriter struct {
+	ctx       context.Context
+	w         io.Writer
+	url       string
+	bytesChan chan progressEvent
+	limiter   *rateLimiter
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := p.limiter.wait(p.ctx, len(b)); err != nil {
 		return 0, err
 	}
-	return resp.ContentLength, nil
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.bytesChan <- progressEvent{url: p.url, bytes: int64(n)}
+	}
+	return n, err
+}
+
+// remoteFile describes a file to be downloaded, as reported by a HEAD request.
+type remoteFile struct {
+	// contentLength is -1 if the server didn't report it
+	contentLength int64
+	// acceptRanges reports whether the server supports byte range requests
+	acceptRanges bool
+	// filename is the name the file is saved as, or empty if it couldn't be determined
+	filename string
+	// dir is the directory inside the download location the file is saved in,
+	// if it isn't saved in the download location itself
+	dir string
+	// statusCode is the status code of the HEAD response
+	statusCode int
+	// etag and lastModified identify the version of the file, if the server reported them
+	etag         string
+	lastModified string
+	// contentEncoding is the Content-Encoding of the file, if it is sent compressed
+	contentEncoding string
+	// duplicate is set if an earlier file is saved to the same path, and this one is skipped
+	duplicate bool
+	// notModified is set if the file saved to the same path is up to date, see TimeCond
+	notModified bool
+	// source is the url the file is downloaded from, which is a mirror if the file
+	// is downloaded for another url
+	source string
+}
+
+// validator returns the If-Range value that makes a range request for the file fail
+// over to the whole file if it has changed. Weak ETags can't be used with If-Range.
+// It is empty if the server reported neither a strong ETag nor Last-Modified.
+func (r remoteFile) validator() string {
+	if len(r.etag) != 0 && !strings.HasPrefix(r.etag, "W/") {
+		return r.etag
+	}
+	return r.lastModified
+}
+
+// getRemoteFile returns the Content-Length of a single file to be downloaded,
+// whether it can be fetched in byte ranges and the name it is saved as.
+func getRemoteFile(ctx context.Context, client *http.Client, url string, header http.Header, guessExtension, keepQuery bool) (remoteFile, error) {
+	resp, err := sendHTTPHeadRequest(ctx, url, client, header)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	return newRemoteFile(url, resp, guessExtension, keepQuery), nil
+}
+
+// probeRemoteFile is getRemoteFile for servers that don't support HEAD requests. It requests
+// the first byte of the file instead, and reads the size of the file from the Content-Range.
+// If the server ignores the range, the Content-Length of the whole file is used.
+func probeRemoteFile(ctx context.Context, client *http.Client, url string, header http.Header, guessExtension, keepQuery bool) (remoteFile, error) {
+	resp, err := sendHTTPRangeRequest(ctx, url, client, header, 0, 0)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	// Closing the body without reading it drops the connection if the whole file is being sent
+	resp.Body.Close()
+
+	remote := newRemoteFile(url, resp, guessExtension, keepQuery)
+	if resp.StatusCode == http.StatusPartialContent {
+		remote.contentLength = getContentRangeSize(resp)
+		remote.acceptRanges = true
+	}
+	return remote, nil
+}
+
+// newRemoteFile returns the file described by a response to a request for url.
+func newRemoteFile(url string, resp *http.Response, guessExtension, keepQuery bool) remoteFile {
+	// A missing filename only matters if Filename isn't set, so it is reported
+	// when the file is downloaded
+	filename, _ := getFileName(resp, guessExtension, keepQuery)
+	return remoteFile{
+		source:          url,
+		contentLength:   resp.ContentLength,
+		acceptRanges:    resp.Header.Get("Accept-Ranges") == "bytes",
+		filename:        filename,
+		statusCode:      resp.StatusCode,
+		etag:            resp.Header.Get("ETag"),
+		lastModified:    resp.Header.Get("Last-Modified"),
+		contentEncoding: resp.Header.Get("Content-Encoding"),
+	}
 }
 
 // getTotalContentLength returns int64 of the total Content-Length of all files to be downloaded.
 // The total content length returned is used to calculate the download progress percentage.
-func getTotalContentLength(client *http.Client, config *downloadConfig) (int64, error) {
+// It is -1 if the Content-Length of any file is unknown.
+func getTotalContentLength(remotes []remoteFile) int64 {
 	var contentLength int64
-	for _, u := range config.url {
-		resp, err := sendHTTPHeadRequest(u, client)
-		if err != nil {
-			return contentLength, err
+	for _, remote := range remotes {
+		if remote.contentLength < 0 {
+			return -1
 		}
-		contentLength += resp.ContentLength
+		contentLength += remote.contentLength
 	}
-	return contentLength, nil
+	return contentLength
 }
 
 // calculateDownloadPercentage returns a float64 of the total download percentage.
+// It is 0 if contentLength is unknown.
 func calculateDownloadPercentage(bytes, contentLength int64) float64 {
+	if contentLength <= 0 {
+		return 0
+	}
 	x := float64(bytes) / 1e+6
 	y := float64(contentLength) / 1e+6
 	return (x / y) * 100
 }
 
-// displayDownloadInfo shows download progress info to the output stream.
-func displayDownloadInfo(w io.Writer, contentLength int64, bytes chan int64, err chan error) {
+// rateInterval is how often the transfer rate shown in the progress info is recomputed.
+// Computing it per chunk would make it too noisy to read.
+const rateInterval = time.Second
+
+// displayDownloadInfo shows download progress info on progress, and the result of each download
+// on w. remotes holds the file looked up for each url. Each event received on bytes reports the
+// bytes written by a single chunk of a download, or the result of a finished download, which is
+// shown as a summary line. Progress is shown at most once per interval for each file, or for every
+// chunk if interval is 0. When several files are downloaded, each line shows the progress of a file
+// as well as of all files combined. If progress is a terminal, the progress of all files is instead
+// shown as a single bar updated in place. It returns once the bytes channel is closed.
+func displayDownloadInfo(w, progress io.Writer, urls []string, remotes []remoteFile, bytes chan progressEvent, interval time.Duration) {
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+	throttle := newProgressThrottle(interval)
+	defer throttle.stop()
+
+	contentLength := getTotalContentLength(remotes)
+	totals := make(map[string]int64, len(urls))
+	for i, url := range urls {
+		totals[url] = remotes[i].contentLength
+	}
+	files := make(map[string]*fileProgress, len(urls))
+
+	var transferred, lastTransferred int64
+	var rate float64
+	sw, bar := progress.(*syncWriter)
+	bar = bar && sw.bar
+	show := func(url string) {
+		if bar {
+			sw.updateBar(formatBar(transferred, contentLength, rate))
+			return
+		}
+		line := formatProgress(transferred, contentLength)
+		if len(urls) > 1 {
+			line = fmt.Sprintf("%s: %s; all files: %s", url, formatProgress(files[url].transferred, totals[url]), line)
+		}
+		fmt.Fprintf(progress, "\t%s at %s, ETA %s\n", line, formatRate(rate), estimateTimeRemaining(transferred, contentLength, rate))
+	}
+
+	lastTick := time.Now()
 	for {
 		select {
-		case <-bytes:
-			// TODO: FIX downloadPercentage to not calculate wrongly when showing progress
-			downloadPercentage := calculateDownloadPercentage(<-bytes, contentLength)
-			fmt.Fprintf(w, "\ttransferred %d / %d bytes (%.2f%%)\n", <-bytes, contentLength, downloadPercentage)
-		case <-err:
-			func() error {
-				return <-err
-			}()
+		case event, ok := <-bytes:
+			if !ok {
+				for _, url := range throttle.flush() {
+					show(url)
+				}
+				if bar {
+					sw.finishBar()
+				}
+				return
+			}
+			file := files[event.url]
+			if file == nil {
+				file = &fileProgress{started: time.Now()}
+				files[event.url] = file
+			}
+			if event.started {
+				continue
+			}
+
+			if event.result != nil {
+				// Bring the progress of the file up to date before its summary
+				if throttle.take(event.url) {
+					show(event.url)
+				}
+				if event.result.Err != nil {
+					fmt.Fprintf(w, "\tfailed %s: %v\n", event.url, event.result.Err)
+					continue
+				}
+				if event.result.Skipped {
+					continue
+				}
+				elapsed := time.Since(file.started).Round(time.Millisecond)
+				fmt.Fprintf(w, "\tcompleted %s (%s in %v)\n", event.url, formatByteSize(float64(file.transferred)), elapsed)
+				if bar && transferred != contentLength {
+					// Redraw the bar below the summary while other files are downloading
+					show(event.url)
+				}
+				continue
+			}
+
+			file.transferred += event.bytes
+			transferred += event.bytes
+			if throttle.add(event.url) {
+				show(event.url)
+			}
+		case <-throttle.c:
+			for _, url := range throttle.flush() {
+				show(url)
+			}
+		case now := <-ticker.C:
+			rate = float64(transferred-lastTransferred) / now.Sub(lastTick).Seconds()
+			lastTransferred, lastTick = transferred, now
 		}
 	}
 }
 
-// readUrlFromFile reads a list of urls from a file.
+// formatProgress returns the number of bytes transferred out of contentLength, and the percentage
+// it makes up. Without the total size, only the bytes transferred so far are shown.
+func formatProgress(transferred, contentLength int64) string {
+	if contentLength < 0 {
+		return "transferred " + formatByteSize(float64(transferred))
+	}
+	downloadPercentage := calculateDownloadPercentage(transferred, contentLength)
+	return fmt.Sprintf("transferred %d / %d bytes (%.2f%%)", transferred, contentLength, downloadPercentage)
+}
+
+// barWidth is the number of characters in the progress bar shown on a terminal.
+const barWidth = 30
+
+// formatBar returns a progress bar of the bytes transferred out of contentLength, with the
+// percentage, rate and time remaining. Without the total size, no bar can be drawn, so only
+// the bytes transferred so far and the rate are shown.
+func formatBar(transferred, contentLength int64, rate float64) string {
+	if contentLength < 0 {
+		return fmt.Sprintf("%s at %s", formatByteSize(float64(transferred)), formatRate(rate))
+	}
+	percentage := calculateDownloadPercentage(transferred, contentLength)
+	filled := int(percentage / 100 * barWidth)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled > 0 && filled < barWidth {
+		bar = bar[:filled-1] + ">"
+	}
+	bar += strings.Repeat(" ", barWidth-filled)
+	return fmt.Sprintf("[%s] %5.1f%% %s at %s, ETA %s", bar, percentage, formatByteSize(float64(transferred)), formatRate(rate), estimateTimeRemaining(transferred, contentLength, rate))
+}
+
+// formatByteSize returns a number of bytes as a human-readable string, e.g. 5.0 MB.
+// Units are powers of 1024, matching -limit-rate.
+func formatByteSize(size float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+// formatRate returns a transfer rate in bytes per second as a human-readable string, e.g. 1.2 MB/s.
+func formatRate(rate float64) string {
+	return formatByteSize(rate) + "/s"
+}
+
+// estimateTimeRemaining returns how long the rest of the download takes at rate bytes per second.
+// It is unknown if the server didn't report the Content-Length or nothing was transferred recently.
+func estimateTimeRemaining(transferred, contentLength int64, rate float64) string {
+	if contentLength < 0 || rate <= 0 {
+		return "unknown"
+	}
+	remaining := contentLength - transferred
+	if remaining < 0 {
+		remaining = 0
+	}
+	eta := time.Duration(float64(remaining) / rate * float64(time.Second))
+	return eta.Round(time.Second).String()
+}
+
+// readUrlFromFile reads a list of urls from a file, or from the body of a GET request
+// if file is an http or https url.
 func readUrlFromFile(file string, config *downloadConfig) error {
 	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		config.url = append(config.url, scanner.Text())
+	return readUrls(f, file, false, config)
+}
+
+// fetchUrlFile reads a list of urls from the body of a GET request to rawURL, sent with
+// the same client, headers and credentials as the downloads. The list may only hold
+// http and https urls, so a server can't make the files on this machine be copied.
+func fetchUrlFile(ctx context.Context, rawURL string, config *downloadConfig) error {
+	client, err := config.newClient(config.Output)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return InvalidInputError{fmt.Errorf("%w %s: %v", ErrFetchURLFile, rawURL, err)}
+	}
+	req.Header = config.requestHeader()
+	resp, err := client.Do(req)
+	if err != nil {
+		return InvalidInputError{fmt.Errorf("%w %s: %v", ErrFetchURLFile, rawURL, err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return InvalidInputError{fmt.Errorf("%w %s: %d %s", ErrFetchURLFile, rawURL, resp.StatusCode, http.StatusText(resp.StatusCode))}
+	}
+	err = readUrls(resp.Body, rawURL, true, config)
+	if err != nil {
+		return err
+	}
+	// An empty body is more likely a misconfigured server than an empty list
+	if len(config.URLs) == 0 {
+		return InvalidInputError{fmt.Errorf("%w %s: no urls found", ErrFetchURLFile, rawURL)}
+	}
+	return nil
+}
+
+// readUrls reads a list of urls from source, one per line, skipping blank lines and
+// comments starting with #. A url may be followed by mirrors of it, separated by |, and
+// then by whitespace and the path it is saved to inside the download location. If any
+// line isn't a valid url and path, the returned error lists the numbers of all such lines.
+// If httpOnly is set, as for a list fetched from a server, file:// urls aren't valid.
+func readUrls(r io.Reader, source string, httpOnly bool, config *downloadConfig) error {
+	var invalid []string
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// A url may be followed by the path it is saved to
+		fields := strings.Fields(line)
+		var path string
+		if len(fields) > 1 {
+			path = fields[1]
+		}
+		urls := strings.Split(fields[0], "|")
+		valid := len(fields) <= 2 && validatePath(path) == nil
+		for _, rawURL := range urls {
+			u, err := url.Parse(rawURL)
+			if (err != nil || len(u.Scheme) == 0 || len(u.Host) == 0) && !isFileURL(rawURL) {
+				valid = false
+			}
+			if httpOnly && !isHTTPURL(rawURL) {
+				valid = false
+			}
+		}
+		if !valid {
+			invalid = append(invalid, strconv.Itoa(lineNum))
+			continue
+		}
+
+		// A url with a range expands into several lines, each mirror
+		// expanding alongside it
+		expanded, err := expandURLRanges(urls)
+		if err != nil {
+			return InvalidInputError{fmt.Errorf("%w on line %d of %s", err, lineNum, source)}
+		}
+		if len(expanded) > 1 && len(path) != 0 && !strings.HasSuffix(path, "/") {
+			return InvalidInputError{fmt.Errorf("%w on line %d of %s: the path of a url that expands into several has to be a directory ending in /", ErrInvalidRange, lineNum, source)}
+		}
+		for _, urls := range expanded {
+			config.URLs = append(config.URLs, urls[0])
+			config.Paths = append(config.Paths, path)
+			config.Mirrors = append(config.Mirrors, urls[1:])
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		return err
 	}
+	if len(invalid) == 1 {
+		return InvalidInputError{fmt.Errorf("%w on line %s of %s", ErrInvalidURL, invalid[0], source)}
+	}
+	if len(invalid) > 1 {
+		return InvalidInputError{fmt.Errorf("%w on lines %s of %s", ErrInvalidURL, strings.Join(invalid, ", "), source)}
+	}
 	return nil
 }
 
-// HandleDownload handles the download sub-command.
-func HandleDownload(w io.Writer, args []string) error {
-	var urlFile string
-	c := &downloadConfig{}
-	c.mu = new(sync.Mutex)
+// isStdinPiped reports whether stdin is piped or redirected rather than a terminal.
+func isStdinPiped() bool {
+	f, ok := stdin.(*os.File)
+	if !ok {
+		return true
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice == 0
+}
 
+// isTerminal reports whether w is a terminal rather than a file or pipe.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// readPassword returns the basic authentication password from the environment, or
+// reads it from stdin if it isn't set and stdin isn't taken by the urls. On a terminal
+// the password is prompted for on stderr, without echoing what is typed.
+func readPassword(username string, urlsFromStdin bool) (string, error) {
+	password, ok := os.LookupEnv(passwordEnv)
+	if ok {
+		return password, nil
+	}
+	if urlsFromStdin {
+		return "", InvalidInputError{ErrPasswordStdin}
+	}
+	if f, ok := stdin.(*os.File); ok && !isStdinPiped() {
+		restore, err := disableEcho(f)
+		if err != nil {
+			return "", InvalidInputError{fmt.Errorf("%w: %v", ErrPasswordEcho, err)}
+		}
+		defer restore()
+		fmt.Fprintf(stderr, "Password for %s: ", username)
+		// The Enter that ends the password isn't echoed either
+		defer fmt.Fprintln(stderr)
+	}
+	scanner := bufio.NewScanner(stdin)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", InvalidInputError{ErrNoPassword}
+	}
+	return scanner.Text(), nil
+}
+
+// abandonAtDeadline reports the downloads of result that were abandoned when the -deadline
+// of the batch was reached, and returns the DownloadErrors of every download that didn't
+// complete, so the files downloaded before the deadline count as a partial success.
+func abandonAtDeadline(result *DownloadResult, deadline time.Duration) error {
+	var failed []DownloadError
+	for i := range result.Files {
+		file := &result.Files[i]
+		if errors.Is(file.Err, context.DeadlineExceeded) {
+			file.Err = fmt.Errorf("%w of %v", ErrDeadlineReached, deadline)
+		}
+		if file.Err != nil {
+			failed = append(failed, DownloadError{URL: file.URL, Err: file.Err})
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return DownloadErrors{Errs: failed, Total: len(result.Files)}
+}
+
+// newDownloadFlagSet returns the flags of the download sub-command, which set c, urlFile
+// and configFile, and print their usage to w.
+func newDownloadFlagSet(w io.Writer, c *downloadConfig, urlFile, configFile *string) *flag.FlagSet {
 	fs := flag.NewFlagSet("download", flag.ContinueOnError)
 	fs.SetOutput(w)
-	fs.StringVar(&c.location, "location", "./downloads", "Download location")
+	fs.StringVar(&c.Location, "location", DefaultLocation, "Download location")
+	fs.BoolVar(&c.LocationMustExist, "location-must-exist", false, "Fail if the download location doesn't exist instead of creating it")
 	fs.IntVar(&c.numFiles, "x", 0, "Number of files to download")
-	fs.StringVar(&urlFile, "url-file", "", "File containing list of url")
+	fs.StringVar(configFile, "config", "", "Config `file` of default option values, one name: value per line without the -, such as limit-rate: 500k. Lines starting with # are skipped and a value may be quoted. Defaults to ~/"+configFileName+" if it exists")
+	fs.StringVar(urlFile, "url-file", "", "File, or http(s) url, containing list of url, each optionally followed by the path it is saved to")
+	fs.StringVar(&c.output, "output", "", "Name of the downloaded file inside the download location, or - to write it to stdout")
+	fs.StringVar(&c.output, "o", "", "Shorthand for -output")
+	fs.IntVar(&c.MaxConcurrent, "max-concurrent", DefaultMaxConcurrent, "Maximum number of concurrent downloads")
+	fs.DurationVar(&c.Wait, "wait", 0, "Pause before starting each download after the first, e.g. 1s. Use with -max-concurrent 1 to pause between downloads")
+	fs.IntVar(&c.Segments, "segments", 1, "Number of parallel range requests used to download each file")
+	fs.StringVar(&c.MergeStrategy, "merge-strategy", MergeWriteAt, "How the segments of a file are written: writeat, at their offset in the file, or concat, to files joined at the end")
+	fs.IntVar(&c.Retries, "retries", 3, "Number of times to retry a failed download")
+	fs.DurationVar(&c.RetryBackoff, "retry-backoff", time.Second, "Delay before the first retry, doubled on each retry up to -max-retry-after")
+	fs.DurationVar(&c.MaxRetryAfter, "max-retry-after", DefaultMaxRetryAfter, "Longest delay waited for before a retry, including when a 429 or 503 response asks to retry later in its Retry-After header")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 0, "Abort and retry a download if no data arrives for this long. 0 means no limit")
+	fs.DurationVar(&c.Timeout, "timeout", 0, "Maximum total time to spend downloading each file, including retries. 0 means no limit")
+	fs.DurationVar(&c.deadline, "deadline", 0, "Maximum total time to spend downloading all files. Unfinished downloads are abandoned and can be resumed later. 0 means no limit")
+	fs.StringVar(&c.bufferSize, "buffer-size", "32k", "Size of the chunks files are read and written in, e.g. 64k or 1m")
+	fs.StringVar(&c.limitRate, "limit-rate", "", "Limit the combined download rate in bytes per second, e.g. 500k or 2m")
+	fs.StringVar(&c.limitRatePerHost, "limit-rate-per-host", "", "Limit the combined download rate from each host in bytes per second, e.g. 500k or 2m")
+	fs.StringVar(&c.minFileSize, "min-filesize", "", "Fail files smaller than this many bytes, e.g. 1k, as likely error pages. Smaller files that were downloaded are deleted")
+	fs.StringVar(&c.Checksum, "checksum", "", "Expected checksum of the downloaded file, as algorithm:hex (md5, sha1, sha256 or sha512)")
+	fs.StringVar(&c.ChecksumFile, "checksum-file", "", "Checksums file, such as SHA256SUMS, to verify each downloaded file listed in it against")
+	fs.BoolVar(&c.DeleteOnChecksumMismatch, "checksum-delete", false, "Delete the downloaded file if its checksum doesn't match")
+	fs.Var(&c.printHash, "print-hash", "Print the hash of each downloaded file, computed as it is written. It is sha256 unless md5, sha1 or sha512 is picked with -print-hash=algorithm, which needs the =")
+	fs.BoolVar(&c.JSONProgress, "json", false, "Print progress and the summary as newline-delimited JSON objects")
+	fs.DurationVar(&c.ProgressInterval, "progress-interval", DefaultProgressInterval, "How often the progress of each file is shown")
+	fs.BoolVar(&c.quiet, "quiet", false, "Don't print progress or the summary")
+	fs.StringVar(&c.OnConflict, "on-conflict", ConflictRename, "What to do when urls are saved to the same file: rename, skip or error")
+	fs.StringVar(&c.OnOversize, "on-oversize", OversizeRestart, "What to do when a partial download is larger than the remote file: restart or error")
+	fs.StringVar(&c.RenameTemplate, "rename", "", "Template files are renamed by, with the placeholders {basename}, {host}, {date} and {index}, e.g. {date}-{basename}")
+	fs.BoolVar(&c.PreservePath, "preserve-path", false, "Save files under the directories of their url path inside the download location")
+	fs.BoolVar(&c.PerHost, "per-host", false, "Save files in a directory named after the host of their url inside the download location")
+	fs.BoolVar(&c.GuessExtension, "guess-extension", false, "Add an extension based on the Content-Type to filenames that have none")
+	fs.BoolVar(&c.stripQuery, "strip-query", true, "Strip the query and fragment of urls from filenames. If false, the query is kept in the name")
+	fs.BoolVar(&c.NoHead, "no-head", false, "Look up files with a GET of their first byte instead of a HEAD request")
+	fs.BoolVar(&c.NoClobber, "no-clobber", false, "Skip urls whose file already exists, without checking its size. -force takes precedence")
+	fs.BoolVar(&c.TimeCond, "time-cond", false, "Only download urls whose file changed since the existing file was downloaded, using If-Modified-Since. -force takes precedence")
+	fs.BoolVar(&c.continueOnError, "continue-on-error", true, "Keep downloading the other files when one fails. If false, the first failure cancels the rest")
+	fs.BoolVar(&c.Force, "force", false, "Download files again from scratch, even if they are already complete")
+	fs.BoolVar(&c.DryRun, "dry-run", false, "Print what would be downloaded without downloading anything")
+	fs.BoolVar(&c.sync, "sync", false, "Download the files listed in the index pages given as urls, such as the listing of a directory")
+	fs.IntVar(&c.level, "level", 0, "Number of links deep -sync follows subdirectories and HTML pages inside the directory of the index")
+	fs.BoolVar(&c.Spider, "spider", false, "Check that every url responds with a success status and report broken links, without downloading anything")
+	fs.BoolVar(&c.NoSpaceCheck, "no-space-check", false, "Skip checking for enough free disk space before downloading")
+	fs.BoolVar(&c.NoDecompress, "no-decompress", false, "Save gzip and deflate encoded files as sent instead of decompressing them")
+	fs.IntVar(&c.maxRedirects, "max-redirects", DefaultMaxRedirects, "Maximum number of redirects to follow")
+	fs.Var(&c.mirrors, "mirror", "Mirror `url` tried if the url fails. May be repeated, in order of preference")
+	fs.StringVar(&c.Method, "method", http.MethodGet, "HTTP method files are requested with, e.g. POST. Files requested with another method than GET aren't resumed")
+	fs.StringVar(&c.data, "data", "", "Request body sent with -method")
+	fs.StringVar(&c.dataFile, "data-file", "", "File holding the request body sent with -method")
+	fs.Var(&c.headers, "header", "Extra request `header` as \"Key: Value\". May be repeated")
+	fs.StringVar(&c.user, "user", "", "Username for basic authentication, optionally as user:password")
+	fs.StringVar(&c.Password, "password", "", "Password for basic authentication. If omitted, it is read from $"+passwordEnv+" or stdin")
+	fs.StringVar(&c.tokenFile, "token-file", "", "File holding a bearer token sent with every request as Authorization: Bearer")
+	fs.StringVar(&c.tokenEnv, "token-env", "", "Environment `variable` holding a bearer token sent with every request as Authorization: Bearer")
+	fs.BoolVar(&c.netrc, "netrc", false, "Send the login and password for each host in $"+netrcEnv+" or ~/.netrc using basic authentication")
+	fs.StringVar(&c.Referer, "referer", "", "Referer `url` sent with every request")
+	fs.StringVar(&c.Cookie, "cookie", "", "Cookie sent with every request, as name=value. Separate multiple cookies with ;")
+	fs.StringVar(&c.UserAgent, "user-agent", DefaultUserAgent, "User-Agent sent with every request. Empty sends none")
+	fs.StringVar(&c.proxy, "proxy", "", "Proxy `url` as http://, https:// or socks5://host:port. Defaults to $HTTP_PROXY and $HTTPS_PROXY")
+	fs.IntVar(&c.MaxIdleConns, "max-idle-conns", DefaultMaxIdleConns, "Maximum number of idle connections kept open for reuse")
+	fs.DurationVar(&c.IdleConnTimeout, "idle-conn-timeout", DefaultIdleConnTimeout, "How long an idle connection is kept open for reuse")
+	fs.BoolVar(&c.DisableHTTP2, "disable-http2", false, "Only use HTTP/1.1, even if the server supports HTTP/2")
+	fs.StringVar(&c.HTTPVersion, "http-version", HTTPVersion2, "HTTP `version` to use: 2 negotiates HTTP/2 and falls back to HTTP/1.1, 1.1 only uses HTTP/1.1")
+	fs.BoolVar(&c.IPv4, "4", false, "Only connect to IPv4 addresses")
+	fs.BoolVar(&c.IPv6, "6", false, "Only connect to IPv6 addresses")
+	fs.BoolVar(&c.Insecure, "insecure", false, "Don't verify the server's TLS certificate")
+	fs.BoolVar(&c.Insecure, "k", false, "Shorthand for -insecure")
+	fs.StringVar(&c.CACertFile, "cacert", "", "File of PEM encoded CA certificates used to verify the server's TLS certificate")
+	fs.BoolVar(&c.Verbose, "verbose", false, "Log the details of every request and response")
+	fs.BoolVar(&c.Trace, "trace", false, "Print the DNS, connect, TLS, first byte and total time of the request downloading each file")
+	fs.StringVar(&c.LogLevel, "log-level", LogInfo, "Messages to print: error for the outcome of each download, info to also print when it starts, debug to also print each request, resume and retry")
 	fs.Usage = func() {
 		var usageString = `
 download: An HTTP sub-command for downloading files
@@ -255,12 +1430,30 @@ download: <options> server`
 		fmt.Fprintln(w)
 		fmt.Fprintln(w, "options: ")
 		fs.PrintDefaults()
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "exit codes: ")
+		fmt.Fprintf(w, "  %d\tAll files were downloaded\n", ExitOK)
+		fmt.Fprintf(w, "  %d\tInvalid command or options\n", ExitInvalidInput)
+		fmt.Fprintf(w, "  %d\tSome files were downloaded, but others failed\n", ExitPartialFailure)
+		fmt.Fprintf(w, "  %d\tNo file was downloaded\n", ExitFailure)
 	}
+	return fs
+}
 
+// HandleDownload handles the download sub-command.
+func HandleDownload(w io.Writer, args []string) error {
+	var urlFile, configFile string
+	c := &downloadConfig{}
+
+	fs := newDownloadFlagSet(w, c, &urlFile, &configFile)
 	err := fs.Parse(args)
 	if err != nil {
 		return FlagParsingError{err}
 	}
+	err = loadConfigFile(fs, configFile)
+	if err != nil {
+		return err
+	}
 
 	// Validate the config
 	err = validateConfig(urlFile, c, fs)
@@ -268,102 +1461,106 @@ download: <options> server`
 		return err
 	}
 
-	// Read from file if -url-file flag is provided,
-	// otherwise read urls from positional args specified
-	if len(urlFile) != 0 {
-		err := readUrlFromFile(urlFile, c)
+	// Keep the password out of the process listing by reading it from the environment
+	// or stdin when only a username is given. It comes before the urls, which may be
+	// read from stdin too
+	if len(c.Username) != 0 && len(c.Password) == 0 {
+		c.Password, err = readPassword(c.Username, c.urlsFromStdin)
 		if err != nil {
 			return err
 		}
-	} else {
-		switch {
-		case c.numFiles > 1:
-			for i := 0; i < c.numFiles; i++ {
-				c.url = append(c.url, fs.Arg(i))
-			}
-		case c.numFiles == 1:
-			c.url = append(c.url, fs.Arg(0))			
-		}	
 	}
 
-	httpClient := httpClient()
-
-	bytesChan := make(chan int64)
-	errorChan := make(chan error)
-
-	// Get the Content-Length of all files to download
-	totalContentLength, err := getTotalContentLength(httpClient, c)
-	if err != nil {
-		return err
+	// Read from file if -url-file flag is provided, or from stdin if it is piped
+	// and nothing else is given. Otherwise validateConfig set the urls from the
+	// positional args. A url file on a server is fetched once the request can be
+	// cancelled, below
+	switch {
+	case isHTTPURL(urlFile):
+	case len(urlFile) != 0:
+		err := readUrlFromFile(urlFile, c)
+		if err != nil {
+			return err
+		}
+	case c.urlsFromStdin:
+		err := readUrls(stdin, "stdin", false, c)
+		if err != nil {
+			return err
+		}
+		if len(c.URLs) == 0 {
+			return InvalidInputError{ErrNoServerSpecified}
+		}
 	}
 
-	// Display download progress info
-	go displayDownloadInfo(w, totalContentLength, bytesChan, errorChan)
-
-	var wg sync.WaitGroup
-	for _, u := range c.url {
-		fmt.Fprintf(w, "Downloading %v...\n", u)
-		wg.Add(1)
-		go func(url string, config *downloadConfig) {
-			defer wg.Done()
-			c.mu.Lock()
-			defer c.mu.Unlock()
-
-			// Get filename before download
-			r, err := sendHTTPRequest(url, httpClient)
-			if err != nil {
-				errorChan <- err
-			}
-			defer r.Body.Close()
-			filename, err := getFileName(r)
-			if err != nil {
-				errorChan <- err
-			}
+	// Stop downloading on Ctrl-C, leaving partial files to be resumed later
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-			// Set download destination
-			setDownloadLocation, err := setDownloadLocation(c.location)
-			if err != nil {
-				errorChan <- err
-			}
-			destinationPath := filepath.Join(setDownloadLocation, filename)
+	// Bound the whole batch, keeping the files downloaded before the deadline
+	var deadlineCtx context.Context
+	if c.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.deadline)
+		defer cancel()
+		deadlineCtx = ctx
+	}
 
-			// Get file size from download destination
-			existingFileSize, err := getExistingFileSize(destinationPath)
-			if err != nil {
-				errorChan <- err
-			}
+	// When the file itself goes to stdout, everything else goes to stderr
+	// so that it doesn't corrupt the piped data
+	if c.output == "-" {
+		c.Destination = w
+		w = stderr
+	}
 
-			// Get the content length of each file
-			contentLength, err := getContentLength(httpClient, url)
-			if err != nil {
-				errorChan <- err
-			}
+	c.Output = w
+	if c.quiet {
+		c.Output = io.Discard
+	}
 
-			// Compare the content length of each file with an existing file size. If they are equal,
-			// no need to download file because has already downloaded completely.
-			if existingFileSize == contentLength {
-				return
-			}
+	// The location is checked before a url file or index page is requested, so a location
+	// that can't be written to fails before anything is sent over the network
+	if c.Destination == nil && !c.DryRun && !c.Spider {
+		c.Location, err = setDownloadLocation(c.Location, c.LocationMustExist)
+		if err != nil {
+			return err
+		}
+	}
 
-			// Make the HTTP request to download file
-			resp, err := sendHTTPRequestWithHeader(url, httpClient, existingFileSize)
-			if err != nil {
-				errorChan <- err
-			}
-			defer resp.Body.Close()
+	if isHTTPURL(urlFile) {
+		err := fetchUrlFile(ctx, urlFile, c)
+		if err != nil {
+			return err
+		}
+	}
 
-			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-				errorChan <- fmt.Errorf("unexpected Status Code: %v", resp.StatusCode)
-			}
+	// With -sync, the urls are index pages listing the files to download
+	if c.sync {
+		err := syncIndexes(ctx, c)
+		if err != nil {
+			return err
+		}
+	}
 
-			// Write to destination file
-			err = writeToDestinationFile(destinationPath, resp, bytesChan)
-			if err != nil {
-				errorChan <- err
+	result, err := Download(ctx, c.DownloadOptions)
+	if deadlineCtx != nil && result != nil && errors.Is(deadlineCtx.Err(), context.DeadlineExceeded) && errors.Is(err, context.DeadlineExceeded) {
+		err = abandonAtDeadline(result, c.deadline)
+	}
+	if result != nil && !c.DryRun && !c.Spider && !c.quiet {
+		if c.JSONProgress {
+			printJSONSummary(w, result)
+		} else {
+			printSummary(w, result)
+			if c.Destination == nil {
+				printOutcome(w, result, c.Location)
 			}
-		}(u, c)
+		}
 	}
-	wg.Wait()
-	fmt.Fprintf(w, "File(s) downloaded to %s\n", c.location)
-	return nil
+	// The hashes and timings are printed even with -quiet, since they were asked for
+	if result != nil && len(c.Hash) != 0 && !c.JSONProgress {
+		printHashes(w, result)
+	}
+	if result != nil && c.Trace && !c.JSONProgress {
+		printTimings(w, result)
+	}
+	return err
 }
@@ -2,18 +2,36 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func startTestHTTPServer() *httptest.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/new-url", http.StatusMovedPermanently)
-	}) 
-	return httptest.NewServer(mux) 
+	})
+	return httptest.NewServer(mux)
 }
 
 func TestHandleDownload(t *testing.T) {
@@ -23,34 +41,255 @@ download: An HTTP sub-command for downloading files
 download: <options> server
 
 options: 
+  -4	Only connect to IPv4 addresses
+  -6	Only connect to IPv6 addresses
+  -buffer-size string
+    	Size of the chunks files are read and written in, e.g. 64k or 1m (default "32k")
+  -cacert string
+    	File of PEM encoded CA certificates used to verify the server's TLS certificate
+  -checksum string
+    	Expected checksum of the downloaded file, as algorithm:hex (md5, sha1, sha256 or sha512)
+  -checksum-delete
+    	Delete the downloaded file if its checksum doesn't match
+  -checksum-file string
+    	Checksums file, such as SHA256SUMS, to verify each downloaded file listed in it against
+  -config file
+    	Config file of default option values, one name: value per line without the -, such as limit-rate: 500k. Lines starting with # are skipped and a value may be quoted. Defaults to ~/.dlmanagerrc if it exists
+  -continue-on-error
+    	Keep downloading the other files when one fails. If false, the first failure cancels the rest (default true)
+  -cookie string
+    	Cookie sent with every request, as name=value. Separate multiple cookies with ;
+  -data string
+    	Request body sent with -method
+  -data-file string
+    	File holding the request body sent with -method
+  -deadline duration
+    	Maximum total time to spend downloading all files. Unfinished downloads are abandoned and can be resumed later. 0 means no limit
+  -disable-http2
+    	Only use HTTP/1.1, even if the server supports HTTP/2
+  -dry-run
+    	Print what would be downloaded without downloading anything
+  -force
+    	Download files again from scratch, even if they are already complete
+  -guess-extension
+    	Add an extension based on the Content-Type to filenames that have none
+  -header header
+    	Extra request header as "Key: Value". May be repeated
+  -http-version version
+    	HTTP version to use: 2 negotiates HTTP/2 and falls back to HTTP/1.1, 1.1 only uses HTTP/1.1 (default "2")
+  -idle-conn-timeout duration
+    	How long an idle connection is kept open for reuse (default 1m30s)
+  -idle-timeout duration
+    	Abort and retry a download if no data arrives for this long. 0 means no limit
+  -insecure
+    	Don't verify the server's TLS certificate
+  -json
+    	Print progress and the summary as newline-delimited JSON objects
+  -k	Shorthand for -insecure
+  -level int
+    	Number of links deep -sync follows subdirectories and HTML pages inside the directory of the index
+  -limit-rate string
+    	Limit the combined download rate in bytes per second, e.g. 500k or 2m
+  -limit-rate-per-host string
+    	Limit the combined download rate from each host in bytes per second, e.g. 500k or 2m
   -location string
     	Download location (default "./downloads")
+  -location-must-exist
+    	Fail if the download location doesn't exist instead of creating it
+  -log-level string
+    	Messages to print: error for the outcome of each download, info to also print when it starts, debug to also print each request, resume and retry (default "info")
+  -max-concurrent int
+    	Maximum number of concurrent downloads (default 4)
+  -max-idle-conns int
+    	Maximum number of idle connections kept open for reuse (default 25)
+  -max-redirects int
+    	Maximum number of redirects to follow (default 10)
+  -max-retry-after duration
+    	Longest delay waited for before a retry, including when a 429 or 503 response asks to retry later in its Retry-After header (default 5m0s)
+  -merge-strategy string
+    	How the segments of a file are written: writeat, at their offset in the file, or concat, to files joined at the end (default "writeat")
+  -method string
+    	HTTP method files are requested with, e.g. POST. Files requested with another method than GET aren't resumed (default "GET")
+  -min-filesize string
+    	Fail files smaller than this many bytes, e.g. 1k, as likely error pages. Smaller files that were downloaded are deleted
+  -mirror url
+    	Mirror url tried if the url fails. May be repeated, in order of preference
+  -netrc
+    	Send the login and password for each host in $NETRC or ~/.netrc using basic authentication
+  -no-clobber
+    	Skip urls whose file already exists, without checking its size. -force takes precedence
+  -no-decompress
+    	Save gzip and deflate encoded files as sent instead of decompressing them
+  -no-head
+    	Look up files with a GET of their first byte instead of a HEAD request
+  -no-space-check
+    	Skip checking for enough free disk space before downloading
+  -o string
+    	Shorthand for -output
+  -on-conflict string
+    	What to do when urls are saved to the same file: rename, skip or error (default "rename")
+  -on-oversize string
+    	What to do when a partial download is larger than the remote file: restart or error (default "restart")
+  -output string
+    	Name of the downloaded file inside the download location, or - to write it to stdout
+  -password string
+    	Password for basic authentication. If omitted, it is read from $DLMANAGER_PASSWORD or stdin
+  -per-host
+    	Save files in a directory named after the host of their url inside the download location
+  -preserve-path
+    	Save files under the directories of their url path inside the download location
+  -print-hash
+    	Print the hash of each downloaded file, computed as it is written. It is sha256 unless md5, sha1 or sha512 is picked with -print-hash=algorithm, which needs the =
+  -progress-interval duration
+    	How often the progress of each file is shown (default 200ms)
+  -proxy url
+    	Proxy url as http://, https:// or socks5://host:port. Defaults to $HTTP_PROXY and $HTTPS_PROXY
+  -quiet
+    	Don't print progress or the summary
+  -referer url
+    	Referer url sent with every request
+  -rename string
+    	Template files are renamed by, with the placeholders {basename}, {host}, {date} and {index}, e.g. {date}-{basename}
+  -retries int
+    	Number of times to retry a failed download (default 3)
+  -retry-backoff duration
+    	Delay before the first retry, doubled on each retry up to -max-retry-after (default 1s)
+  -segments int
+    	Number of parallel range requests used to download each file (default 1)
+  -spider
+    	Check that every url responds with a success status and report broken links, without downloading anything
+  -strip-query
+    	Strip the query and fragment of urls from filenames. If false, the query is kept in the name (default true)
+  -sync
+    	Download the files listed in the index pages given as urls, such as the listing of a directory
+  -time-cond
+    	Only download urls whose file changed since the existing file was downloaded, using If-Modified-Since. -force takes precedence
+  -timeout duration
+    	Maximum total time to spend downloading each file, including retries. 0 means no limit
+  -token-env variable
+    	Environment variable holding a bearer token sent with every request as Authorization: Bearer
+  -token-file string
+    	File holding a bearer token sent with every request as Authorization: Bearer
+  -trace
+    	Print the DNS, connect, TLS, first byte and total time of the request downloading each file
+  -url-file string
+    	File, or http(s) url, containing list of url, each optionally followed by the path it is saved to
+  -user string
+    	Username for basic authentication, optionally as user:password
+  -user-agent string
+    	User-Agent sent with every request. Empty sends none (default "dlmanager/0.1.0")
+  -verbose
+    	Log the details of every request and response
+  -wait duration
+    	Pause before starting each download after the first, e.g. 1s. Use with -max-concurrent 1 to pause between downloads
   -x int
     	Number of files to download
+
+exit codes: 
+  0	All files were downloaded
+  1	Invalid command or options
+  2	Some files were downloaded, but others failed
+  3	No file was downloaded
 `
 	ts := startTestHTTPServer()
 	defer ts.Close()
 
-	tests := []struct{
-		args []string
+	tests := []struct {
+		args   []string
 		output string
-		err error
+		err    error
 	}{
 		{
 			args: []string{},
-			err: ErrNoServerSpecified,
+			err:  ErrNoServerSpecified,
 		},
 		{
-			args: []string{"-h"},
+			args:   []string{"-h"},
 			output: usageMessage,
-			err: errors.New("flag: help requested"),
+			err:    errors.New("flag: help requested"),
+		},
+		{
+			args: []string{"-max-concurrent", "0", ts.URL},
+			err:  ErrMaxConcurrent,
+		},
+		{
+			args: []string{"-checksum", "md5:zz", ts.URL},
+			err:  ErrInvalidChecksum,
+		},
+		{
+			args: []string{"-x", "2", "-checksum", "md5:5d41402abc4b2a76b9719d911017c592", ts.URL, ts.URL},
+			err:  ErrChecksumSingleFile,
+		},
+		{
+			args: []string{"-limit-rate", "5x", ts.URL},
+			err:  ErrInvalidLimitRate,
+		},
+		{
+			args: []string{"-limit-rate-per-host", "0", ts.URL},
+			err:  ErrInvalidHostRate,
+		},
+		{
+			args: []string{"-buffer-size", "0", ts.URL},
+			err:  ErrInvalidBufferSize,
+		},
+		{
+			args: []string{"-buffer-size", "1g", ts.URL},
+			err:  ErrInvalidBufferSize,
+		},
+		{
+			args: []string{"-password", "secret", ts.URL},
+			err:  ErrPasswordWithoutUser,
+		},
+		{
+			args: []string{"-user", "alice:secret", "-password", "secret", ts.URL},
+			err:  ErrPasswordTwice,
+		},
+		{
+			args: []string{"-x", "2", "-o", "file.txt", ts.URL, ts.URL},
+			err:  ErrOutputSingleFile,
+		},
+		{
+			args: []string{"-o", "-", "-checksum", "md5:5d41402abc4b2a76b9719d911017c592", ts.URL},
+			err:  ErrChecksumStdout,
+		},
+		{
+			args: []string{"-header", "X-Token", ts.URL},
+			err:  ErrInvalidHeader,
+		},
+		{
+			args: []string{"-max-redirects", "0", ts.URL + "/redirect"},
+			err:  fmt.Errorf(`failed to download: %s/redirect: Head "/new-url": too many redirects, the limit is 0`, ts.URL),
+		},
+		{
+			args: []string{"-max-redirects", "-1", ts.URL},
+			err:  ErrMaxRedirects,
+		},
+		{
+			args: []string{"-timeout", "-1s", ts.URL},
+			err:  ErrTimeout,
 		},
 		{
-			args: []string{ts.URL + "/redirect"},
-			err: errors.New(`Get "/new-url": stopped after 1 redirect`),
+			args: []string{"-idle-timeout", "-1s", ts.URL},
+			err:  ErrIdleTimeout,
+		},
+		{
+			args: []string{"-proxy", "ftp://proxy.example.com", ts.URL},
+			err:  ErrInvalidProxy,
+		},
+		{
+			args: []string{"-max-idle-conns", "0", ts.URL},
+			err:  ErrMaxIdleConns,
+		},
+		{
+			args: []string{"-idle-conn-timeout", "0s", ts.URL},
+			err:  ErrIdleConnTimeout,
 		},
 	}
 
+	// Nothing is piped to stdin, so no urls are read from it
+	stdin = strings.NewReader("")
+	defer func() { stdin = os.Stdin }()
+
 	byteBuf := new(bytes.Buffer)
 	for _, tc := range tests {
 		err := HandleDownload(byteBuf, tc.args)
@@ -71,4 +310,3101 @@ options:
 		}
 		byteBuf.Reset()
 	}
-}
\ No newline at end of file
+}
+
+func TestHandleDownloadConcurrent(t *testing.T) {
+	delay := 200 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			time.Sleep(delay)
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	numFiles := 3
+	args := []string{"-x", fmt.Sprint(numFiles), "-location", t.TempDir()}
+	for i := 0; i < numFiles; i++ {
+		args = append(args, fmt.Sprintf("%s/file%d", ts.URL, i))
+	}
+
+	byteBuf := new(bytes.Buffer)
+	start := time.Now()
+	err := HandleDownload(byteBuf, args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+
+	// Running the downloads one after the other would take at least numFiles * delay
+	elapsed := time.Since(start)
+	if elapsed >= time.Duration(numFiles)*delay {
+		t.Fatalf("Expected downloads to run concurrently. Took: %v", elapsed)
+	}
+}
+
+func TestHandleDownloadMaxConcurrent(t *testing.T) {
+	var inFlight, maxInFlight int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	numFiles, maxConcurrent := 6, 2
+	args := []string{"-x", fmt.Sprint(numFiles), "-max-concurrent", fmt.Sprint(maxConcurrent), "-location", t.TempDir()}
+	for i := 0; i < numFiles; i++ {
+		args = append(args, fmt.Sprintf("%s/file%d", ts.URL, i))
+	}
+
+	err := HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got > int32(maxConcurrent) {
+		t.Fatalf("Expected at most %d concurrent downloads, Got: %d", maxConcurrent, got)
+	}
+}
+
+func TestDisplayDownloadInfo(t *testing.T) {
+	bytesChan := make(chan progressEvent)
+	go func() {
+		for _, b := range []int64{25, 25, 25, 25} {
+			bytesChan <- progressEvent{url: "http://example.com/file.txt", bytes: b}
+		}
+		close(bytesChan)
+	}()
+
+	byteBuf := new(bytes.Buffer)
+	displayDownloadInfo(byteBuf, byteBuf, []string{"http://example.com/file.txt"}, []remoteFile{{contentLength: 100}}, bytesChan, 0)
+
+	// No rate is known before the first rate interval has passed
+	expected := "\ttransferred 25 / 100 bytes (25.00%) at 0 B/s, ETA unknown\n" +
+		"\ttransferred 50 / 100 bytes (50.00%) at 0 B/s, ETA unknown\n" +
+		"\ttransferred 75 / 100 bytes (75.00%) at 0 B/s, ETA unknown\n" +
+		"\ttransferred 100 / 100 bytes (100.00%) at 0 B/s, ETA unknown\n"
+	if gotOutput := byteBuf.String(); gotOutput != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, gotOutput)
+	}
+}
+
+func TestDisplayDownloadInfoMultipleFiles(t *testing.T) {
+	a, b := "http://example.com/a.txt", "http://example.com/b.txt"
+	bytesChan := make(chan progressEvent)
+	go func() {
+		bytesChan <- progressEvent{url: a, bytes: 50}
+		bytesChan <- progressEvent{url: b, bytes: 100}
+		bytesChan <- progressEvent{url: b, result: &FileResult{URL: b, Err: errors.New("connection reset")}}
+		bytesChan <- progressEvent{url: a, bytes: 50}
+		bytesChan <- progressEvent{url: a, result: &FileResult{URL: a}}
+		close(bytesChan)
+	}()
+
+	byteBuf := new(bytes.Buffer)
+	displayDownloadInfo(byteBuf, byteBuf, []string{a, b}, []remoteFile{{contentLength: 100}, {contentLength: 300}}, bytesChan, 0)
+
+	lines := strings.Split(strings.TrimSuffix(byteBuf.String(), "\n"), "\n")
+	expected := []string{
+		"\t" + a + ": transferred 50 / 100 bytes (50.00%); all files: transferred 50 / 400 bytes (12.50%) at 0 B/s, ETA unknown",
+		"\t" + b + ": transferred 100 / 300 bytes (33.33%); all files: transferred 150 / 400 bytes (37.50%) at 0 B/s, ETA unknown",
+		"\tfailed " + b + ": connection reset",
+		"\t" + a + ": transferred 100 / 100 bytes (100.00%); all files: transferred 200 / 400 bytes (50.00%) at 0 B/s, ETA unknown",
+		"\tcompleted " + a + " (100 B in ",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, Got: %s", len(expected), byteBuf.String())
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Errorf("Expected: %s, Got: %s", expected[i], line)
+		}
+	}
+}
+
+func TestDisplayDownloadInfoInterval(t *testing.T) {
+	a, b := "http://example.com/a.txt", "http://example.com/b.txt"
+	bytesChan := make(chan progressEvent)
+	go func() {
+		bytesChan <- progressEvent{url: a, bytes: 25}
+		bytesChan <- progressEvent{url: b, bytes: 100}
+		bytesChan <- progressEvent{url: a, bytes: 25}
+		bytesChan <- progressEvent{url: b, result: &FileResult{URL: b, Err: errors.New("connection reset")}}
+		bytesChan <- progressEvent{url: a, bytes: 25}
+		bytesChan <- progressEvent{url: a, bytes: 25}
+		bytesChan <- progressEvent{url: a, result: &FileResult{URL: a}}
+		close(bytesChan)
+	}()
+
+	// The interval never passes, so progress is only shown before each file's summary
+	byteBuf := new(bytes.Buffer)
+	displayDownloadInfo(byteBuf, byteBuf, []string{a, b}, []remoteFile{{contentLength: 100}, {contentLength: 300}}, bytesChan, time.Hour)
+
+	lines := strings.Split(strings.TrimSuffix(byteBuf.String(), "\n"), "\n")
+	expected := []string{
+		"\t" + b + ": transferred 100 / 300 bytes (33.33%); all files: transferred 150 / 400 bytes (37.50%) at 0 B/s, ETA unknown",
+		"\tfailed " + b + ": connection reset",
+		"\t" + a + ": transferred 100 / 100 bytes (100.00%); all files: transferred 200 / 400 bytes (50.00%) at 0 B/s, ETA unknown",
+		"\tcompleted " + a + " (100 B in ",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, Got: %s", len(expected), byteBuf.String())
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Errorf("Expected: %s, Got: %s", expected[i], line)
+		}
+	}
+
+	// Progress still pending when the downloads end is shown
+	bytesChan = make(chan progressEvent)
+	go func() {
+		for _, b := range []int64{25, 25, 25, 25} {
+			bytesChan <- progressEvent{url: a, bytes: b}
+		}
+		close(bytesChan)
+	}()
+	byteBuf.Reset()
+	displayDownloadInfo(byteBuf, byteBuf, []string{a}, []remoteFile{{contentLength: 100}}, bytesChan, time.Hour)
+	if expected := "\ttransferred 100 / 100 bytes (100.00%) at 0 B/s, ETA unknown\n"; byteBuf.String() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, byteBuf.String())
+	}
+}
+
+func TestDisplayDownloadInfoUnknownLength(t *testing.T) {
+	bytesChan := make(chan progressEvent)
+	go func() {
+		for _, b := range []int64{512, 1024} {
+			bytesChan <- progressEvent{url: "http://example.com/file.txt", bytes: b}
+		}
+		close(bytesChan)
+	}()
+
+	byteBuf := new(bytes.Buffer)
+	displayDownloadInfo(byteBuf, byteBuf, []string{"http://example.com/file.txt"}, []remoteFile{{contentLength: -1}}, bytesChan, 0)
+
+	expected := "\ttransferred 512 B at 0 B/s, ETA unknown\n" +
+		"\ttransferred 1.5 KB at 0 B/s, ETA unknown\n"
+	if gotOutput := byteBuf.String(); gotOutput != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, gotOutput)
+	}
+}
+
+func TestHandleDownloadUnknownLength(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before writing the body sends it chunked, without a Content-Length
+		w.(http.Flusher).Flush()
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, "hello")
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	byteBuf := new(bytes.Buffer)
+	err := HandleDownload(byteBuf, []string{"-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if got := byteBuf.String(); strings.Contains(got, "NaN") || strings.Contains(got, "%") {
+		t.Fatalf("Expected no percentage in progress output, Got: %s", got)
+	}
+	if got := byteBuf.String(); !strings.Contains(got, "transferred 5 B") {
+		t.Fatalf("Expected bytes transferred in progress output, Got: %s", got)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+}
+
+func TestDisplayDownloadInfoBar(t *testing.T) {
+	a, b := "http://example.com/a.txt", "http://example.com/b.txt"
+	bytesChan := make(chan progressEvent)
+	go func() {
+		bytesChan <- progressEvent{url: a, bytes: 100}
+		bytesChan <- progressEvent{url: a, result: &FileResult{URL: a}}
+		bytesChan <- progressEvent{url: b, bytes: 100}
+		bytesChan <- progressEvent{url: b, bytes: 200}
+		bytesChan <- progressEvent{url: b, result: &FileResult{URL: b}}
+		close(bytesChan)
+	}()
+
+	byteBuf := new(bytes.Buffer)
+	w := &syncWriter{w: byteBuf, bar: true}
+	displayDownloadInfo(w, w, []string{a, b}, []remoteFile{{contentLength: 100}, {contentLength: 300}}, bytesChan, 0)
+
+	// The bar is cleared before each summary line, and redrawn below it until every file completes
+	clear := "\r\033[K"
+	expected := []string{
+		clear + "[======>                       ]  25.0% 100 B at 0 B/s, ETA unknown",
+		clear + "\tcompleted " + a + " (100 B in ",
+		clear + "[======>                       ]  25.0% 100 B at 0 B/s, ETA unknown",
+		clear + "[==============>               ]  50.0% 200 B at 0 B/s, ETA unknown",
+		clear + "[==============================] 100.0% 400 B at 0 B/s, ETA unknown",
+		clear + "\tcompleted " + b + " (300 B in ",
+	}
+	output := byteBuf.String()
+	for _, part := range expected {
+		i := strings.Index(output, part)
+		if i < 0 {
+			t.Fatalf("Expected %q next, Got: %q", part, output)
+		}
+		output = output[i+len(part):]
+	}
+	if strings.Contains(output, clear) || !strings.HasSuffix(output, "\n") {
+		t.Fatalf("Expected the output to end with the last summary line, Got: %q", output)
+	}
+}
+
+func TestFormatBar(t *testing.T) {
+	testCases := []struct {
+		transferred   int64
+		contentLength int64
+		rate          float64
+		expected      string
+	}{
+		{0, 1000, 0, "[                              ]   0.0% 0 B at 0 B/s, ETA unknown"},
+		{500, 1000, 100, "[==============>               ]  50.0% 500 B at 100 B/s, ETA 5s"},
+		{1000, 1000, 100, "[==============================] 100.0% 1000 B at 100 B/s, ETA 0s"},
+		{2048, -1, 1024, "2.0 KB at 1.0 KB/s"},
+	}
+	for _, tc := range testCases {
+		if got := formatBar(tc.transferred, tc.contentLength, tc.rate); got != tc.expected {
+			t.Errorf("Expected: %q, Got: %q", tc.expected, got)
+		}
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "output.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, w := range []io.Writer{new(bytes.Buffer), f} {
+		if isTerminal(w) {
+			t.Errorf("Expected %T not to be a terminal", w)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	testCases := []struct {
+		rate     float64
+		expected string
+	}{
+		{0, "0 B/s"},
+		{512, "512 B/s"},
+		{1536, "1.5 KB/s"},
+		{1.2 * 1024 * 1024, "1.2 MB/s"},
+		{3 * 1024 * 1024 * 1024, "3.0 GB/s"},
+	}
+	for _, tc := range testCases {
+		if got := formatRate(tc.rate); got != tc.expected {
+			t.Errorf("formatRate(%v): Expected: %s, Got: %s", tc.rate, tc.expected, got)
+		}
+	}
+}
+
+func TestEstimateTimeRemaining(t *testing.T) {
+	testCases := []struct {
+		transferred   int64
+		contentLength int64
+		rate          float64
+		expected      string
+	}{
+		{0, 100, 10, "10s"},
+		{50, 100, 10, "5s"},
+		{100, 100, 10, "0s"},
+		{0, 6000, 1, "1h40m0s"},
+		{0, 100, 0, "unknown"},
+		{0, -1, 10, "unknown"},
+	}
+	for _, tc := range testCases {
+		got := estimateTimeRemaining(tc.transferred, tc.contentLength, tc.rate)
+		if got != tc.expected {
+			t.Errorf("estimateTimeRemaining(%d, %d, %v): Expected: %s, Got: %s", tc.transferred, tc.contentLength, tc.rate, tc.expected, got)
+		}
+	}
+}
+
+func TestGetFileName(t *testing.T) {
+	testCases := []struct {
+		path               string
+		contentDisposition string
+		expected           string
+		err                error
+	}{
+		{"/files/report.pdf", "", "report.pdf", nil},
+		{"/files/report.pdf", `attachment; filename="summary.pdf"`, "summary.pdf", nil},
+		{"/", `attachment; filename="../../etc/passwd"`, "passwd", nil},
+		{"/", `attachment; filename="/etc/passwd"`, "passwd", nil},
+		{"/", `attachment; filename="..\\..\\windows\\evil.exe"`, "evil.exe", nil},
+		{"/", `attachment; filename="C:evil.exe"`, "C_evil.exe", nil},
+		{"/", `attachment; filename="C:\\windows\\evil.exe"`, "evil.exe", nil},
+		{"/", `attachment; filename="report-12:30.csv"`, "report-12_30.csv", nil},
+		{"/", "attachment; filename=\"bad\x01name.txt\"", "badname.txt", nil},
+		{"/", `attachment; filename=".."`, "", ErrNoFilename},
+		{"/", "", "", ErrNoFilename},
+	}
+	for _, tc := range testCases {
+		r := &http.Response{
+			Request: &http.Request{URL: &url.URL{Path: tc.path}},
+			Header:  http.Header{},
+		}
+		if len(tc.contentDisposition) != 0 {
+			r.Header.Set("Content-Disposition", tc.contentDisposition)
+		}
+		got, err := getFileName(r, false, false)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("Content-Disposition %q: Expected error: %v, Got: %v", tc.contentDisposition, tc.err, err)
+		}
+		if got != tc.expected {
+			t.Fatalf("Content-Disposition %q: Expected: %q, Got: %q", tc.contentDisposition, tc.expected, got)
+		}
+	}
+}
+
+func TestGetFileNameGuessExtension(t *testing.T) {
+	testCases := []struct {
+		path        string
+		contentType string
+		expected    string
+	}{
+		{"/download", "application/zip", "download.zip"},
+		{"/download", "text/html; charset=utf-8", "download.html"},
+		{"/download", "text/plain", "download.txt"},
+		{"/download", "image/jpeg", "download.jpeg"},
+		{"/download", "application/octet-stream", "download"},
+		{"/download", "application/x-unknown", "download"},
+		{"/download", "", "download"},
+		{"/report.pdf", "application/zip", "report.pdf"},
+	}
+	for _, tc := range testCases {
+		r := &http.Response{
+			Request: &http.Request{URL: &url.URL{Path: tc.path}},
+			Header:  http.Header{"Content-Type": []string{tc.contentType}},
+		}
+		got, err := getFileName(r, true, false)
+		if err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+		if got != tc.expected {
+			t.Fatalf("%s with Content-Type %q: Expected: %q, Got: %q", tc.path, tc.contentType, tc.expected, got)
+		}
+	}
+}
+
+func TestGetFileNameQuery(t *testing.T) {
+	testCases := []struct {
+		rawURL    string
+		keepQuery bool
+		expected  string
+	}{
+		{"https://example.com/file.zip?token=abc&v=2", false, "file.zip"},
+		{"https://example.com/file.zip?token=abc&v=2#top", false, "file.zip"},
+		{"https://example.com/dir/file.zip?sig=a/b:c", false, "file.zip"},
+		{"https://example.com/file.zip?token=abc&v=2", true, "file.zip?token=abc&v=2"},
+		{"https://example.com/file.zip?sig=a/b:c#top", true, "file.zip?sig=a%2Fb%3Ac"},
+		{"https://example.com/file.zip", true, "file.zip"},
+	}
+	for _, tc := range testCases {
+		u, err := url.Parse(tc.rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &http.Response{Request: &http.Request{URL: u}, Header: http.Header{}}
+		got, err := getFileName(r, false, tc.keepQuery)
+		if err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+		if got != tc.expected {
+			t.Fatalf("%s with keepQuery %v: Expected: %q, Got: %q", tc.rawURL, tc.keepQuery, tc.expected, got)
+		}
+	}
+}
+
+func TestHandleDownloadStripQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{nil, "file.zip"},
+		{[]string{"-strip-query=false"}, "file.zip?v=2"},
+	}
+	for _, tc := range tests {
+		location := t.TempDir()
+		args := append(tc.args, "-location", location, ts.URL+"/file.zip?v=2#part")
+		err := HandleDownload(new(bytes.Buffer), args)
+		if err != nil {
+			t.Fatalf("%v: Expected nil error. Got: %v", tc.args, err)
+		}
+		if _, err := os.Stat(filepath.Join(location, tc.expected)); err != nil {
+			t.Fatalf("%v: Expected the file to be saved as %s, Got: %v", tc.args, tc.expected, err)
+		}
+	}
+}
+
+func TestHandleDownloadGuessExtension(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/archive", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		args     []string
+		filename string
+	}{
+		{[]string{}, "archive"},
+		{[]string{"-guess-extension"}, "archive.zip"},
+	}
+	for _, tc := range tests {
+		location := t.TempDir()
+		err := HandleDownload(new(bytes.Buffer), append(tc.args, "-location", location, ts.URL+"/archive"))
+		if err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(location, tc.filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("Expected: hello, Got: %s", data)
+		}
+	}
+}
+
+func TestHandleDownloadDuplicateFilenames(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="file.zip"`)
+		fmt.Fprint(w, r.URL.Path)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-x", "3", "-location", location, ts.URL + "/a", ts.URL + "/b", ts.URL + "/c"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	for filename, expected := range map[string]string{"file.zip": "/a", "file(1).zip": "/b", "file(2).zip": "/c"} {
+		data, err := os.ReadFile(filepath.Join(location, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("Expected %s to contain %s, Got: %s", filename, expected, data)
+		}
+	}
+}
+
+func TestHandleDownloadOnConflict(t *testing.T) {
+	var mu sync.Mutex
+	var gets []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			gets = append(gets, r.URL.Path)
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="file.zip"`)
+		fmt.Fprint(w, r.URL.Path)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		policy string
+		files  map[string]string
+		gets   int
+		err    error
+		notice string
+	}{
+		{policy: "rename", files: map[string]string{"file.zip": "/a", "file(1).zip": "/b"}, gets: 2},
+		{
+			policy: "skip",
+			files:  map[string]string{"file.zip": "/a"},
+			gets:   1,
+			notice: "Skipping " + ts.URL + "/b, which is saved to ",
+		},
+		{policy: "error", err: ErrFilenameConflict},
+	}
+	for _, tc := range tests {
+		gets = nil
+		location := t.TempDir()
+		byteBuf := new(bytes.Buffer)
+		err := HandleDownload(byteBuf, []string{"-on-conflict", tc.policy, "-x", "2", "-location", location, ts.URL + "/a", ts.URL + "/b"})
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("%s: Expected %v, Got: %v", tc.policy, tc.err, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: Expected nil error. Got: %v", tc.policy, err)
+		}
+		if len(gets) != tc.gets {
+			t.Fatalf("%s: Expected %d downloads, Got: %v", tc.policy, tc.gets, gets)
+		}
+		if !strings.Contains(byteBuf.String(), tc.notice) {
+			t.Fatalf("%s: Expected output containing %q, Got: %v", tc.policy, tc.notice, byteBuf.String())
+		}
+
+		entries, err := os.ReadDir(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(tc.files) {
+			t.Fatalf("%s: Expected %d files, Got: %d", tc.policy, len(tc.files), len(entries))
+		}
+		for filename, expected := range tc.files {
+			data, err := os.ReadFile(filepath.Join(location, filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != expected {
+				t.Fatalf("%s: Expected %s to contain %s, Got: %s", tc.policy, filename, expected, data)
+			}
+		}
+	}
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-on-conflict", "overwrite", ts.URL + "/a"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || inputErr.Err != ErrInvalidOnConflict {
+		t.Fatalf("Expected ErrInvalidOnConflict, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadMirror(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/primary/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/mirror/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-retries", "0", "-mirror", ts.URL + "/missing.txt", "-mirror", ts.URL + "/mirror/file.txt", "-location", location, ts.URL + "/primary/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"-x", "2", "-mirror", ts.URL + "/mirror/file.txt", ts.URL, ts.URL}, ErrMirrorSingleFile},
+		{[]string{"-mirror", "mirror/file.txt", ts.URL}, ErrInvalidURL},
+	}
+	for _, tc := range tests {
+		err := HandleDownload(new(bytes.Buffer), tc.args)
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, tc.err) {
+			t.Fatalf("%v: Expected %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHandleDownloadNumFilesMismatch(t *testing.T) {
+	a, b, c := "http://example.com/a.txt", "http://example.com/b.txt", "http://example.com/c.txt"
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{[]string{}, ErrNoServerSpecified},
+		{[]string{"-x", "2"}, ErrNoServerSpecified},
+		{[]string{"-x", "2", a}, ErrTooFewServers},
+		{[]string{"-x", "3", a, b}, ErrTooFewServers},
+		{[]string{a, b}, ErrTooManyServers},
+		{[]string{"-x", "1", a, b}, ErrTooManyServers},
+		{[]string{"-x", "2", a, b, c}, ErrTooManyServers},
+		{[]string{"-x", "-1", a}, ErrNumDownloadFiles},
+	}
+	for _, tc := range tests {
+		err := HandleDownload(new(bytes.Buffer), tc.args)
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, tc.err) {
+			t.Fatalf("%v: Expected %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHandleDownloadInvalidURLs(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+
+	location := t.TempDir()
+	args := []string{"-x", "4", "-location", location, ts.URL + "/a.txt", "example.com/b.txt", "ftp://example.com/c.txt", "http:///d.txt"}
+	err := HandleDownload(new(bytes.Buffer), args)
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidURL) {
+		t.Fatalf("Expected ErrInvalidURL, Got: %v", err)
+	}
+	expected := `invalid url: "example.com/b.txt", "ftp://example.com/c.txt", "http:///d.txt"`
+	if err.Error() != expected {
+		t.Fatalf("Expected: %v, Got: %v", expected, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 0 {
+		t.Fatalf("Expected no requests to be sent, Got: %d", requests)
+	}
+}
+
+func TestHandleDownloadFileURL(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "file.txt")
+	err := os.WriteFile(source, []byte("hello world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileURL := "file://" + filepath.ToSlash(source)
+
+	location := t.TempDir()
+	byteBuf := new(bytes.Buffer)
+	err = HandleDownload(byteBuf, []string{"-location", location, fileURL})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected: hello world, Got: %q, %v", data, err)
+	}
+	if !strings.Contains(byteBuf.String(), "100.00%") {
+		t.Fatalf("Expected the progress to be shown, Got: %q", byteBuf.String())
+	}
+
+	// A partial copy is resumed
+	location = t.TempDir()
+	err = os.WriteFile(filepath.Join(location, "file.txt.part"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Download(context.Background(), DownloadOptions{URLs: []string{fileURL}, Location: location, Output: io.Discard})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err = os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected: hello world, Got: %q, %v", data, err)
+	}
+	if result.Files[0].BytesWritten != 6 || !result.Files[0].Resumed {
+		t.Fatalf("Expected the last 6 bytes to be copied, Got: %+v", result.Files[0])
+	}
+
+	// A missing file fails that download only
+	err = HandleDownload(new(bytes.Buffer), []string{"-location", t.TempDir(), fileURL + ".missing"})
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected a missing file error, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadNoHead(t *testing.T) {
+	var mu sync.Mutex
+	var heads int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranges/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			mu.Lock()
+			heads++
+			mu.Unlock()
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader("hello"))
+	})
+	mux.HandleFunc("/noranges/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		args  []string
+		url   string
+		heads int
+	}{
+		{url: ts.URL + "/ranges/file.txt", heads: 1},
+		{url: ts.URL + "/noranges/file.txt"},
+		{args: []string{"-no-head"}, url: ts.URL + "/ranges/file.txt"},
+	}
+	for _, tc := range tests {
+		heads = 0
+		location := t.TempDir()
+		byteBuf := new(bytes.Buffer)
+		err := HandleDownload(byteBuf, append(tc.args, "-location", location, tc.url))
+		if err != nil {
+			t.Fatalf("%v: Expected nil error. Got: %v", tc.url, err)
+		}
+		if heads != tc.heads {
+			t.Fatalf("%v: Expected %d HEAD requests, Got: %d", tc.url, tc.heads, heads)
+		}
+		// The size of the file is known without a HEAD request
+		if !strings.Contains(byteBuf.String(), "transferred 5 / 5 bytes (100.00%)") {
+			t.Fatalf("%v: Expected the progress of 5 bytes, Got: %v", tc.url, byteBuf.String())
+		}
+		data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("Expected: hello, Got: %s", data)
+		}
+	}
+}
+
+func TestHandleDownloadPartialFailure(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	badURL := ts.URL + "/missing.txt"
+	err := HandleDownload(new(bytes.Buffer), []string{"-x", "2", "-retry-backoff", "0", "-location", location, badURL, ts.URL + "/file.txt"})
+	if err == nil {
+		t.Fatal("Expected non-nil error, Got: nil")
+	}
+
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected DownloadErrors, Got: %T", err)
+	}
+	if len(downloadErrs.Errs) != 1 || downloadErrs.Errs[0].URL != badURL {
+		t.Fatalf("Expected only %v to fail, Got: %v", badURL, err)
+	}
+
+	_, err = os.Stat(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatalf("Expected file.txt to be downloaded. Got: %v", err)
+	}
+}
+
+func TestHandleDownloadDeadURL(t *testing.T) {
+	var gets int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		if r.URL.Path != "/mirror/file.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// A url whose HEAD request fails with 404 isn't requested again
+	byteBuf := new(bytes.Buffer)
+	location := t.TempDir()
+	err := HandleDownload(byteBuf, []string{"-location", location, ts.URL + "/missing.txt"})
+	var downloadErrs DownloadErrors
+	var statusErr StatusError
+	if !errors.As(err, &downloadErrs) || !errors.As(downloadErrs.Errs[0].Err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a 404 status error, Got: %v", err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Fatalf("Expected no GET requests, Got: %d", n)
+	}
+	if strings.Contains(byteBuf.String(), "Downloading") {
+		t.Fatalf("Expected the download not to start, Got: %q", byteBuf.String())
+	}
+
+	// A dead url falls back to its mirrors
+	err = HandleDownload(new(bytes.Buffer), []string{"-mirror", ts.URL + "/mirror/file.txt", "-location", location, ts.URL + "/primary/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %q, %v", data, err)
+	}
+}
+
+func TestHandleDownloadWait(t *testing.T) {
+	var mu sync.Mutex
+	var starts []time.Time
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	wait := 100 * time.Millisecond
+	args := []string{"-x", "3", "-wait", wait.String(), "-location", t.TempDir(), ts.URL + "/a.txt", ts.URL + "/b.txt", ts.URL + "/c.txt"}
+	err := HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if len(starts) != 3 {
+		t.Fatalf("Expected 3 downloads, Got: %d", len(starts))
+	}
+	for i := 1; i < len(starts); i++ {
+		if gap := starts[i].Sub(starts[i-1]); gap < wait {
+			t.Fatalf("Expected downloads to start at least %v apart, Got: %v", wait, gap)
+		}
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-wait", "-1s", ts.URL + "/a.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrWait) {
+		t.Fatalf("Expected ErrWait, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadStopOnError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		if r.Method == http.MethodHead {
+			return
+		}
+		// Send half of the file, then stall until the client goes away
+		fmt.Fprint(w, "hello")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	badURL := ts.URL + "/missing.txt"
+	urls := []string{ts.URL + "/slow.txt", badURL, ts.URL + "/file.txt"}
+	start := time.Now()
+	err := HandleDownload(new(bytes.Buffer), append([]string{"-continue-on-error=false", "-x", "3", "-max-concurrent", "2", "-retry-backoff", "0", "-location", location}, urls...))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the stalled download to be cancelled, took %v", elapsed)
+	}
+
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected DownloadErrors, Got: %v", err)
+	}
+	if len(downloadErrs.Errs) != 3 {
+		t.Fatalf("Expected every download to fail, Got: %v", err)
+	}
+	for _, downloadErr := range downloadErrs.Errs {
+		if downloadErr.URL == badURL {
+			continue
+		}
+		// The stalled download is cancelled and the last one never starts
+		if !errors.Is(downloadErr, ErrStopped) {
+			t.Fatalf("Expected %v to be stopped, Got: %v", downloadErr.URL, downloadErr.Err)
+		}
+	}
+	_, err = os.Stat(filepath.Join(location, "file.txt"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected file.txt not to be downloaded. Got: %v", err)
+	}
+}
+
+func TestHandleDownloadRetry(t *testing.T) {
+	var gets int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first two download attempts
+		if r.Method == http.MethodGet {
+			n := atomic.AddInt32(&gets, 1)
+			if n == 1 || n == 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprint(w, "hello")
+	})
+	// The file is only missing once it is downloaded
+	mux.HandleFunc("/missing.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+			http.NotFound(w, r)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-retry-backoff", "1ms", "-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+
+	// 4xx responses are not retried
+	atomic.StoreInt32(&gets, 0)
+	err = HandleDownload(new(bytes.Buffer), []string{"-retry-backoff", "1ms", "-location", location, ts.URL + "/missing.txt"})
+	if err == nil {
+		t.Fatal("Expected non-nil error, Got: nil")
+	}
+	if got := atomic.LoadInt32(&gets); got != 1 {
+		t.Fatalf("Expected 1 GET request, Got: %d", got)
+	}
+}
+
+func TestHandleDownloadLogLevel(t *testing.T) {
+	var gets int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first download attempt
+		if r.Method == http.MethodGet && atomic.AddInt32(&gets, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	url := ts.URL + "/file.txt"
+
+	tests := []struct {
+		level    string
+		expected []string
+		hidden   []string
+	}{
+		{LogError, []string{"completed " + url}, []string{"Downloading", "debug:"}},
+		{LogInfo, []string{"Downloading " + url, "completed " + url}, []string{"debug:"}},
+		{LogDebug, []string{
+			"debug: Looked up " + url + ": status 200, 5 bytes",
+			"debug: Requesting " + url + "\n",
+			"debug: " + url + " responded with 503 Service Unavailable",
+			"debug: Attempt 1 of " + url + " failed, retrying in 1ms: unexpected Status Code: 503",
+			"debug: " + url + " responded with 200 OK",
+		}, nil},
+	}
+	for _, tc := range tests {
+		atomic.StoreInt32(&gets, 0)
+		byteBuf := new(bytes.Buffer)
+		err := HandleDownload(byteBuf, []string{"-log-level", tc.level, "-retry-backoff", "1ms", "-location", t.TempDir(), url})
+		if err != nil {
+			t.Fatalf("%s: Expected nil error. Got: %v", tc.level, err)
+		}
+		for _, expected := range tc.expected {
+			if !strings.Contains(byteBuf.String(), expected) {
+				t.Fatalf("%s: Expected output to contain %q, Got: %q", tc.level, expected, byteBuf.String())
+			}
+		}
+		for _, hidden := range tc.hidden {
+			if strings.Contains(byteBuf.String(), hidden) {
+				t.Fatalf("%s: Expected output not to contain %q, Got: %q", tc.level, hidden, byteBuf.String())
+			}
+		}
+	}
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-log-level", "trace", url})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidLogLevel) {
+		t.Fatalf("Expected ErrInvalidLogLevel, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadRetryAfter(t *testing.T) {
+	var gets int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		// Rate limit the first download attempt
+		if r.Method == http.MethodGet && atomic.AddInt32(&gets, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		args     []string
+		minDelay time.Duration
+		maxDelay time.Duration
+	}{
+		// Retry-After takes precedence over the backoff
+		{args: []string{"-retry-backoff", "1ms"}, minDelay: time.Second, maxDelay: 3 * time.Second},
+		// The delay is capped by -max-retry-after
+		{args: []string{"-retry-backoff", "1ms", "-max-retry-after", "10ms"}, minDelay: 10 * time.Millisecond, maxDelay: 500 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		atomic.StoreInt32(&gets, 0)
+		location := t.TempDir()
+		start := time.Now()
+		err := HandleDownload(new(bytes.Buffer), append(tc.args, "-location", location, ts.URL+"/file.txt"))
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatalf("%v: Expected nil error. Got: %v", tc.args, err)
+		}
+		if got := atomic.LoadInt32(&gets); got != 2 {
+			t.Fatalf("%v: Expected 2 GET requests, Got: %d", tc.args, got)
+		}
+		if elapsed < tc.minDelay || elapsed > tc.maxDelay {
+			t.Fatalf("%v: Expected the retry to wait between %v and %v, Got: %v", tc.args, tc.minDelay, tc.maxDelay, elapsed)
+		}
+	}
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-max-retry-after", "0", ts.URL + "/file.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrMaxRetryAfter) {
+		t.Fatalf("Expected ErrMaxRetryAfter, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadRetryResume(t *testing.T) {
+	body := strings.Repeat("a", 1000) + strings.Repeat("b", 1000)
+	var ranges []string
+	var mu sync.Mutex
+	var dropped int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+
+		// Drop the connection halfway through the first download attempt
+		if r.Header.Get("Range") == "" && atomic.AddInt32(&dropped, 1) == 1 {
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			fmt.Fprint(w, body[:1000])
+			return
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-retry-backoff", "1ms", "-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Fatalf("Expected downloaded file to match the source, Got %d bytes", len(data))
+	}
+	if last := ranges[len(ranges)-1]; last != "bytes=1000-" {
+		t.Fatalf("Expected retry to resume with Range: bytes=1000-, Got: %q", last)
+	}
+}
+
+func TestHandleDownloadSizeMismatch(t *testing.T) {
+	body := "hello world"
+	var ranges []string
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+
+		// Without a Content-Length, ending the response early isn't an error
+		if r.Header.Get("Range") == "" {
+			w.Header().Set("Transfer-Encoding", "chunked")
+			fmt.Fprint(w, body[:5])
+			return
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-retries", "0", "-location", location, ts.URL + "/file.txt"})
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) || !errors.Is(downloadErrs.Errs[0].Err, ErrSizeMismatch) {
+		t.Fatalf("Expected ErrSizeMismatch, Got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(location, "file.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected the short file not to be completed, Got: %v", err)
+	}
+
+	// Downloading again resumes from the bytes received
+	err = HandleDownload(new(bytes.Buffer), []string{"-retry-backoff", "1ms", "-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil || string(data) != body {
+		t.Fatalf("Expected: %s, Got: %q, %v", body, data, err)
+	}
+	if last := ranges[len(ranges)-1]; last != "bytes=5-" {
+		t.Fatalf("Expected the download to resume with Range: bytes=5-, Got: %q", last)
+	}
+}
+
+func TestHandleDownloadTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		if r.Method == http.MethodHead {
+			return
+		}
+		// Send half of the file, then stall until the client goes away
+		fmt.Fprint(w, "hello")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-timeout", "100ms", "-retry-backoff", "1ms", "-location", location, ts.URL + "/file.txt"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the download to time out, Got: %v", err)
+	}
+
+	// The partial file is kept for resuming
+	data, err := os.ReadFile(filepath.Join(location, "file.txt.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+}
+
+func TestHandleDownloadDeadline(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fast.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	mux.HandleFunc("/slow.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		if r.Method == http.MethodHead {
+			return
+		}
+		// Send half of the file, then stall until the client goes away
+		fmt.Fprint(w, "hello")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	byteBuf := new(bytes.Buffer)
+	start := time.Now()
+	err := HandleDownload(byteBuf, []string{"-x", "2", "-deadline", "200ms", "-location", location, ts.URL + "/fast.txt", ts.URL + "/slow.txt"})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the batch to stop at the deadline, Got: %v", elapsed)
+	}
+	if !errors.Is(err, ErrDeadlineReached) || ExitCode(err) != ExitPartialFailure {
+		t.Fatalf("Expected a partial failure at the deadline, Got: %v", err)
+	}
+
+	// The completed file and the partial file are both kept
+	data, err := os.ReadFile(filepath.Join(location, "fast.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Expected the completed file to be kept, Got: %q, %v", data, err)
+	}
+	data, err = os.ReadFile(filepath.Join(location, "slow.txt.part"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Expected the partial file to be kept, Got: %q, %v", data, err)
+	}
+
+	// The summary reports which files finished
+	output := byteBuf.String()
+	if !regexp.MustCompile(`fast.txt\s+5 B\s+completed`).MatchString(output) || !regexp.MustCompile(`slow.txt\s+5 B\s+failed`).MatchString(output) {
+		t.Fatalf("Expected the summary to report the completed and abandoned files, Got: %q", output)
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-deadline", "-1s", ts.URL + "/fast.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrDeadline) {
+		t.Fatalf("Expected ErrDeadline, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadIdleTimeout(t *testing.T) {
+	body := "hello world"
+	var stalls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		// Drip-feed the first download attempt, then stall until the client goes away
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" && atomic.AddInt32(&stalls, 1) == 1 {
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			for _, c := range body[:5] {
+				fmt.Fprint(w, string(c))
+				w.(http.Flusher).Flush()
+				time.Sleep(10 * time.Millisecond)
+			}
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// The stalled attempt is retried and resumes where it stopped
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-idle-timeout", "100ms", "-retry-backoff", "1ms", "-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Fatalf("Expected: %s, Got: %s", body, data)
+	}
+
+	atomic.StoreInt32(&stalls, 0)
+	err = HandleDownload(new(bytes.Buffer), []string{"-idle-timeout", "100ms", "-retries", "0", "-location", t.TempDir(), ts.URL + "/file.txt"})
+	if !errors.Is(err, ErrStalled) {
+		t.Fatalf("Expected ErrStalled, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadResume(t *testing.T) {
+	body := "hello world"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranges/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	mux.HandleFunc("/no-ranges/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		url     string
+		partial string
+	}{
+		{url: ts.URL + "/ranges/file.txt", partial: "hello"},
+		{url: ts.URL + "/no-ranges/file.txt", partial: "hello"},
+		{url: ts.URL + "/no-ranges/file.txt", partial: "xxxxx"},
+	}
+
+	for _, tc := range tests {
+		location := t.TempDir()
+		destinationPath := filepath.Join(location, "file.txt")
+		err := os.WriteFile(destinationPath+".part", []byte(tc.partial), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = HandleDownload(new(bytes.Buffer), []string{"-location", location, tc.url})
+		if err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+		data, err := os.ReadFile(destinationPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatalf("Expected: %s, Got: %s", body, data)
+		}
+		_, err = os.Stat(destinationPath + ".part")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Expected .part file to be renamed. Got: %v", err)
+		}
+	}
+}
+
+func TestHandleDownloadForce(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// A corrupt file of the right size looks complete
+	location := t.TempDir()
+	path := filepath.Join(location, "file.txt")
+	err := os.WriteFile(path, []byte("HELLO"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	err = os.Chtimes(path, past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{args: []string{}, expected: "HELLO"},
+		{args: []string{"-force"}, expected: "hello"},
+	}
+	for _, tc := range tests {
+		args := append(tc.args, "-location", location, ts.URL+"/file.txt")
+		err := HandleDownload(new(bytes.Buffer), args)
+		if err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.expected {
+			t.Fatalf("%v: Expected: %s, Got: %s", tc.args, tc.expected, data)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(past) {
+		t.Fatalf("Expected the file to be replaced, Got mtime: %v", info.ModTime())
+	}
+}
+
+func TestHandleDownloadTimeCond(t *testing.T) {
+	var mu sync.Mutex
+	var gets int
+	modTime := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		m := modTime
+		mu.Unlock()
+		http.ServeContent(w, r, "", m, strings.NewReader("hello"))
+	})
+	// ignored.txt answers without looking at If-Modified-Since
+	mux.HandleFunc("/ignored.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	path := filepath.Join(location, "file.txt")
+	args := []string{"-time-cond", "-location", location, ts.URL + "/file.txt"}
+	err := HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	// The file gets the modification time of the remote file
+	info, err := os.Stat(path)
+	if err != nil || !info.ModTime().Equal(modTime) {
+		t.Fatalf("Expected %s to be modified at %v, Got: %v, %v", path, modTime, info, err)
+	}
+
+	// The server answers 304 Not Modified, so the file is left untouched
+	if err := os.WriteFile(path, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	byteBuf := new(bytes.Buffer)
+	err = HandleDownload(byteBuf, args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if !strings.Contains(byteBuf.String(), "Skipping "+path+", which is up to date\n") {
+		t.Fatalf("Expected a notice skipping %v, Got: %v", path, byteBuf.String())
+	}
+	if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(path) + ` +0 B +up-to-date `).Match(byteBuf.Bytes()) {
+		t.Fatalf("Expected %v to be reported as up-to-date, Got: %v", path, byteBuf.String())
+	}
+	mu.Lock()
+	n := gets
+	mu.Unlock()
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "local" || n != 1 {
+		t.Fatalf("Expected %v to be left alone after 1 GET request, Got: %q, %v, %d GET requests", path, data, err, n)
+	}
+
+	// The same file is downloaded again once the remote file changes
+	mu.Lock()
+	modTime = modTime.Add(time.Hour)
+	mu.Unlock()
+	err = HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Expected %v to be downloaded again, Got: %q, %v", path, data, err)
+	}
+
+	// A server that ignores If-Modified-Since is compared by its Last-Modified time
+	ignored := filepath.Join(location, "ignored.txt")
+	if err := os.WriteFile(ignored, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = HandleDownload(new(bytes.Buffer), []string{"-time-cond", "-location", location, ts.URL + "/ignored.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if data, err := os.ReadFile(ignored); err != nil || string(data) != "local" {
+		t.Fatalf("Expected %v to be left alone, Got: %q, %v", ignored, data, err)
+	}
+}
+
+func TestHandleDownloadNoClobber(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/download" {
+			w.Header().Set("Content-Disposition", `attachment; filename="report.pdf"`)
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	for _, name := range []string{"file.txt", "report.pdf"} {
+		err := os.WriteFile(filepath.Join(location, name), []byte("old"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byteBuf := new(bytes.Buffer)
+	err := HandleDownload(byteBuf, []string{"-no-clobber", "-x", "3", "-location", location, ts.URL + "/file.txt", ts.URL + "/download", ts.URL + "/new.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	// The file named after the url isn't requested, the one named by the server is only looked up
+	sort.Strings(requests)
+	if expected := "GET /new.txt,HEAD /download,HEAD /new.txt"; strings.Join(requests, ",") != expected {
+		t.Fatalf("Expected requests %v, Got: %v", expected, requests)
+	}
+	for _, name := range []string{"file.txt", "report.pdf"} {
+		path := filepath.Join(location, name)
+		if !strings.Contains(byteBuf.String(), "Skipping existing file "+path+"\n") {
+			t.Fatalf("Expected a notice skipping %v, Got: %v", path, byteBuf.String())
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "old" {
+			t.Fatalf("Expected %v to be left alone, Got: %s", name, data)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(location, "new.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+
+	// -force wins over -no-clobber
+	err = HandleDownload(new(bytes.Buffer), []string{"-no-clobber", "-force", "-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err = os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+}
+
+func TestHandleDownloadChecksum(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// A file that fails verification is not renamed from its .part file, and keeps its sidecar file
+	tests := []struct {
+		args     []string
+		checksum string
+		kept     []string
+		mismatch bool
+	}{
+		{checksum: "md5:5d41402abc4b2a76b9719d911017c592", kept: []string{"file.txt"}},
+		{checksum: "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", kept: []string{"file.txt"}},
+		{checksum: "sha256:0000000000000000000000000000000000000000000000000000000000000000", kept: []string{"file.txt.dlmeta", "file.txt.part"}, mismatch: true},
+		{args: []string{"-checksum-delete"}, checksum: "md5:00000000000000000000000000000000", mismatch: true},
+	}
+
+	for _, tc := range tests {
+		location := t.TempDir()
+		args := append(tc.args, "-checksum", tc.checksum, "-location", location, ts.URL+"/file.txt")
+		err := HandleDownload(new(bytes.Buffer), args)
+
+		var checksumErr ChecksumError
+		if tc.mismatch != errors.As(err, &checksumErr) {
+			t.Fatalf("Expected checksum mismatch: %v, Got: %v", tc.mismatch, err)
+		}
+		if !tc.mismatch && err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+
+		entries, err := os.ReadDir(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kept []string
+		for _, entry := range entries {
+			kept = append(kept, entry.Name())
+		}
+		if fmt.Sprint(kept) != fmt.Sprint(tc.kept) {
+			t.Fatalf("Expected: %v, Got: %v", tc.kept, kept)
+		}
+	}
+}
+
+func TestParseChecksumFile(t *testing.T) {
+	sums := `# release 1.0
+2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  hello.txt
+5D41402ABC4B2A76B9719D911017C592 *bin/hello.exe
+
+aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d  ./docs/hello.md
+`
+	manifest, err := parseChecksumFile(strings.NewReader(sums))
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"hello.txt", "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{"sub/hello.txt", "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{"bin/hello.exe", "md5:5d41402abc4b2a76b9719d911017c592"},
+		{"docs/hello.md", "sha1:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"},
+		{"hello.exe", ""},
+	}
+	for _, tc := range tests {
+		checksum, _ := manifest.lookup(tc.name)
+		if checksum != tc.expected {
+			t.Errorf("%s: Expected: %q, Got: %q", tc.name, tc.expected, checksum)
+		}
+	}
+
+	for _, sums := range []string{"2cf24dba  hello.txt", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "zz41402abc4b2a76b9719d911017c592  hello.txt"} {
+		if _, err := parseChecksumFile(strings.NewReader(sums)); err == nil {
+			t.Errorf("%q: Expected an error", sums)
+		}
+	}
+}
+
+func TestHandleDownloadChecksumFile(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tampered.txt" {
+			fmt.Fprint(w, "hellp")
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	const sha256Hello = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	sums := filepath.Join(t.TempDir(), "SHA256SUMS")
+	lines := []string{
+		sha256Hello + "  hello.txt",
+		sha256Hello + "  tampered.txt",
+		sha256Hello + "  not-downloaded.txt",
+	}
+	err := os.WriteFile(sums, []byte(strings.Join(lines, "\n")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := t.TempDir()
+	urls := []string{ts.URL + "/hello.txt", ts.URL + "/tampered.txt", ts.URL + "/unlisted.txt"}
+	byteBuf := new(bytes.Buffer)
+	err = HandleDownload(byteBuf, append([]string{"-checksum-file", sums, "-x", "3", "-location", location}, urls...))
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected DownloadErrors, Got: %v", err)
+	}
+	var checksumErr ChecksumError
+	if len(downloadErrs.Errs) != 1 || downloadErrs.Errs[0].URL != urls[1] || !errors.As(downloadErrs.Errs[0].Err, &checksumErr) {
+		t.Fatalf("Expected only %v to fail its checksum, Got: %v", urls[1], err)
+	}
+	warning := fmt.Sprintf("Warning: %s isn't listed in %s", filepath.Join(location, "unlisted.txt"), sums)
+	if !strings.Contains(byteBuf.String(), warning) {
+		t.Fatalf("Expected output containing %q, Got: %q", warning, byteBuf.String())
+	}
+	for _, name := range []string{"hello.txt", "unlisted.txt"} {
+		if _, err := os.Stat(filepath.Join(location, name)); err != nil {
+			t.Fatalf("Expected %s to be downloaded, Got: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"-checksum-file", filepath.Join(t.TempDir(), "missing")}, ErrInvalidChecksumFile},
+		{[]string{"-checksum-file", sums, "-checksum", "sha256:" + sha256Hello}, ErrChecksumConflict},
+		{[]string{"-checksum-file", sums, "-output", "-"}, ErrChecksumFileStdout},
+	}
+	for _, tc := range tests {
+		err := HandleDownload(new(bytes.Buffer), append(tc.args, "-location", t.TempDir(), urls[0]))
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, tc.err) {
+			t.Fatalf("%v: Expected %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHandleDownloadPrintHash(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("hello"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	const sha256Hello = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	tests := []struct {
+		args     []string
+		part     string
+		expected string
+	}{
+		{args: []string{"-print-hash"}, expected: sha256Hello},
+		{args: []string{"-print-hash=md5"}, expected: "5d41402abc4b2a76b9719d911017c592"},
+		{args: []string{"-print-hash=SHA256", "-quiet"}, expected: sha256Hello},
+		// The data resumed from is part of the hash
+		{args: []string{"-print-hash"}, part: "he", expected: sha256Hello},
+		{args: []string{"-print-hash", "-segments", "2"}, expected: sha256Hello},
+	}
+	for _, tc := range tests {
+		location := t.TempDir()
+		if len(tc.part) != 0 {
+			err := os.WriteFile(filepath.Join(location, "file.txt.part"), []byte(tc.part), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		byteBuf := new(bytes.Buffer)
+		err := HandleDownload(byteBuf, append(tc.args, "-location", location, ts.URL+"/file.txt"))
+		if err != nil {
+			t.Fatalf("%v: Expected nil error. Got: %v", tc.args, err)
+		}
+		expected := fmt.Sprintf("%s  %s\n", tc.expected, filepath.Join(location, "file.txt"))
+		if !strings.HasSuffix(byteBuf.String(), expected) {
+			t.Fatalf("%v: Expected output ending with %q, Got: %q", tc.args, expected, byteBuf.String())
+		}
+	}
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-print-hash=crc32", "-location", t.TempDir(), ts.URL + "/file.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidHash) {
+		t.Fatalf("Expected ErrInvalidHash, Got: %v", err)
+	}
+
+	// The algorithm given as a separate argument would be taken as a url
+	err = HandleDownload(new(bytes.Buffer), []string{"-location", t.TempDir(), "-print-hash", "SHA512", ts.URL + "/file.txt"})
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrPrintHashValue) || !strings.Contains(err.Error(), "-print-hash=sha512") {
+		t.Fatalf("Expected ErrPrintHashValue, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadBufferSize(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "helloworld")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	args := []string{"-buffer-size", "2", "-location", location, ts.URL + "/file.txt"}
+	err := HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+
+	// Every chunk of the file is reported separately
+	c := &downloadConfig{}
+	fs := newDownloadFlagSet(io.Discard, c, new(string), new(string))
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig("", c, fs); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(ts.URL + "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bytesChan := make(chan progressEvent)
+	chunks := make(chan int)
+	go func() {
+		var n int
+		for range bytesChan {
+			n++
+		}
+		chunks <- n
+	}()
+	_, err = copyBody(context.Background(), io.Discard, resp, ts.URL+"/file.txt", bytesChan, nil, c.BufferSize)
+	close(bytesChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := <-chunks; n != 5 {
+		t.Fatalf("Expected 5 chunks of 2 bytes, Got: %d", n)
+	}
+
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "helloworld" {
+		t.Fatalf("Expected: helloworld, Got: %s", data)
+	}
+}
+
+func TestHandleDownloadMinFileSize(t *testing.T) {
+	var gets int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		// An error page sent with a success status
+		if r.URL.Path == "/chunked.zip" {
+			w.Header().Set("Transfer-Encoding", "chunked")
+		}
+		fmt.Fprint(w, "<html>Not found</html>")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, name := range []string{"file.zip", "chunked.zip"} {
+		atomic.StoreInt32(&gets, 0)
+		location := t.TempDir()
+		err := HandleDownload(new(bytes.Buffer), []string{"-min-filesize", "1k", "-location", location, ts.URL + "/" + name})
+		var downloadErrs DownloadErrors
+		if !errors.As(err, &downloadErrs) || !errors.Is(downloadErrs.Errs[0].Err, ErrFileTooSmall) {
+			t.Fatalf("%s: Expected ErrFileTooSmall, Got: %v", name, err)
+		}
+		entries, err := os.ReadDir(location)
+		if err != nil || len(entries) != 0 {
+			t.Fatalf("%s: Expected nothing to be saved, Got: %v, %v", name, entries, err)
+		}
+		// The size is only known up front if the server reports it
+		expected := int32(0)
+		if name == "chunked.zip" {
+			expected = 1
+		}
+		if n := atomic.LoadInt32(&gets); n != expected {
+			t.Fatalf("%s: Expected %d GET requests, Got: %d", name, expected, n)
+		}
+	}
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-min-filesize", "10", "-location", location, ts.URL + "/file.zip"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-min-filesize", "small", ts.URL + "/file.zip"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidMinFileSize) {
+		t.Fatalf("Expected ErrInvalidMinFileSize, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadLimitRate(t *testing.T) {
+	body := strings.Repeat("a", 2048)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// Two files of 2k at a combined 8k per second take at least half a second
+	start := time.Now()
+	err := HandleDownload(new(bytes.Buffer), []string{"-x", "2", "-limit-rate", "8k", "-location", t.TempDir(), ts.URL + "/file1", ts.URL + "/file2"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected downloads to be throttled. Took: %v", elapsed)
+	}
+}
+
+func TestHandleDownloadLimitRatePerHost(t *testing.T) {
+	body := strings.Repeat("a", 2048)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+	other := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	// A file of 2k from each of two hosts at 4k per second per host takes about half a
+	// second, where sharing the rate between the hosts would take a second
+	start := time.Now()
+	err := HandleDownload(new(bytes.Buffer), []string{"-x", "2", "-limit-rate-per-host", "4k", "-location", t.TempDir(), ts.URL + "/file1", other + "/file2"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Fatalf("Expected each host to be throttled separately. Took: %v", elapsed)
+	}
+}
+
+func TestHandleDownloadBasicAuth(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "alice" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		args  []string
+		env   string
+		input string
+		err   bool
+	}{
+		{args: []string{"-user", "alice:secret"}},
+		{args: []string{"-user", "alice", "-password", "secret"}},
+		{args: []string{"-user", "alice"}, env: "secret"},
+		{args: []string{"-user", "alice"}, input: "secret\n"},
+		{args: []string{"-user", "alice:wrong"}, err: true},
+		{args: []string{}, err: true},
+	}
+
+	// Restore the environment and stdin once the test is done
+	t.Setenv(passwordEnv, "")
+	defer func() { stdin = os.Stdin }()
+
+	for _, tc := range tests {
+		if len(tc.env) != 0 {
+			os.Setenv(passwordEnv, tc.env)
+		} else {
+			os.Unsetenv(passwordEnv)
+		}
+		stdin = strings.NewReader(tc.input)
+
+		location := t.TempDir()
+		args := append(tc.args, "-retries", "0", "-location", location, ts.URL+"/file.txt")
+		err := HandleDownload(new(bytes.Buffer), args)
+		if tc.err && err == nil {
+			t.Fatalf("Expected non-nil error for %v, Got: %v", tc.args, err)
+		}
+		if !tc.err && err != nil {
+			t.Fatalf("Expected nil error for %v. Got: %v", tc.args, err)
+		}
+	}
+
+	// The password can't be read from stdin once the urls are, but the environment works
+	os.Unsetenv(passwordEnv)
+	stdin = strings.NewReader(ts.URL + "/file.txt\nsecret\n")
+	err := HandleDownload(new(bytes.Buffer), []string{"-user", "alice", "-location", t.TempDir()})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrPasswordStdin) {
+		t.Fatalf("Expected ErrPasswordStdin, Got: %v", err)
+	}
+	os.Setenv(passwordEnv, "secret")
+	stdin = strings.NewReader(ts.URL + "/file.txt\n")
+	err = HandleDownload(new(bytes.Buffer), []string{"-user", "alice", "-location", t.TempDir()})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+}
+
+func TestHandleDownloadBearerToken(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("  secret-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(t.TempDir(), "empty")
+	err = os.WriteFile(emptyFile, []byte("\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_DLMANAGER_TOKEN", "secret-token")
+	t.Setenv("TEST_DLMANAGER_WRONG_TOKEN", "wrong")
+
+	tests := []struct {
+		args     []string
+		inputErr error
+		err      bool
+	}{
+		{args: []string{"-token-file", tokenFile}},
+		{args: []string{"-token-env", "TEST_DLMANAGER_TOKEN"}},
+		{args: []string{"-token-env", "TEST_DLMANAGER_WRONG_TOKEN"}, err: true},
+		{args: []string{"-token-file", filepath.Join(t.TempDir(), "missing")}, inputErr: ErrInvalidTokenFile},
+		{args: []string{"-token-file", emptyFile}, inputErr: ErrInvalidTokenFile},
+		{args: []string{"-token-env", "TEST_DLMANAGER_UNSET_TOKEN"}, inputErr: ErrTokenEnvNotSet},
+		{args: []string{"-token-file", tokenFile, "-token-env", "TEST_DLMANAGER_TOKEN"}, inputErr: ErrTokenTwice},
+		{args: []string{"-token-file", tokenFile, "-user", "alice:secret"}, inputErr: ErrAuthTwice},
+	}
+	for _, tc := range tests {
+		location := t.TempDir()
+		args := append(tc.args, "-retries", "0", "-location", location, ts.URL+"/file.txt")
+		err := HandleDownload(new(bytes.Buffer), args)
+		var inputErr InvalidInputError
+		switch {
+		case tc.inputErr != nil:
+			if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, tc.inputErr) {
+				t.Fatalf("%v: Expected %v, Got: %v", tc.args, tc.inputErr, err)
+			}
+		case tc.err && err == nil:
+			t.Fatalf("Expected non-nil error for %v, Got: %v", tc.args, err)
+		case !tc.err && err != nil:
+			t.Fatalf("Expected nil error for %v. Got: %v", tc.args, err)
+		}
+	}
+}
+
+func TestReadUrlFromFile(t *testing.T) {
+	config := &downloadConfig{}
+	err := readUrlFromFile(filepath.Join("testdata", "urls.txt"), config)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	expected := []string{
+		"https://www.openmymind.net/assets/go/go.pdf",
+		"http://www.golang-book.com/public/pdf/gobook.pdf",
+		"https://example.com/file.txt",
+	}
+	if fmt.Sprint(config.URLs) != fmt.Sprint(expected) {
+		t.Fatalf("Expected: %v, Got: %v", expected, config.URLs)
+	}
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"https://example.com/a.txt\nexample.com/b.txt\n", "invalid url on line 2 of urls.txt"},
+		{"# comment\nnot a url\nhttps://example.com/a.txt\nhttp://%zz\n", "invalid url on lines 2, 4 of urls.txt"},
+		{"https://example.com/a.txt ../a.txt\nhttps://example.com/b.txt /tmp/b.txt\nhttps://example.com/c.txt c.txt extra\n", "invalid url on lines 1, 2, 3 of urls.txt"},
+		{"https://example.com/a.txt|example.com/a.txt\n", "invalid url on line 1 of urls.txt"},
+	}
+	for _, tc := range tests {
+		err := readUrls(strings.NewReader(tc.input), "urls.txt", false, &downloadConfig{})
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidURL) {
+			t.Fatalf("Expected ErrInvalidURL, Got: %v", err)
+		}
+		if err.Error() != tc.err {
+			t.Fatalf("Expected: %v, Got: %v", tc.err, err)
+		}
+	}
+
+	// Mirrors are separated by |
+	config = &downloadConfig{}
+	err = readUrls(strings.NewReader("https://a.com/f.zip|https://b.com/f.zip|https://c.com/f.zip files/\nhttps://a.com/g.zip\n"), "urls.txt", false, config)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if fmt.Sprint(config.URLs) != "[https://a.com/f.zip https://a.com/g.zip]" {
+		t.Fatalf("Expected the first url of each line, Got: %v", config.URLs)
+	}
+	if fmt.Sprint(config.Mirrors) != "[[https://b.com/f.zip https://c.com/f.zip] []]" {
+		t.Fatalf("Expected the other urls of each line as mirrors, Got: %v", config.Mirrors)
+	}
+	if fmt.Sprint(config.Paths) != "[files/ ]" {
+		t.Fatalf("Expected the path of each line, Got: %v", config.Paths)
+	}
+}
+
+func TestHandleDownloadUrlFilePaths(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	urlFile := filepath.Join(t.TempDir(), "urls.txt")
+	lines := []string{
+		ts.URL + "/a.txt",
+		ts.URL + "/b.txt\tdocs/",
+		ts.URL + "/c.txt   docs/reports/summary.txt",
+		ts.URL + "/d.txt renamed.txt",
+	}
+	err := os.WriteFile(urlFile, []byte(strings.Join(lines, "\n")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := t.TempDir()
+	err = HandleDownload(new(bytes.Buffer), []string{"-url-file", urlFile, "-location", location})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	expected := map[string]string{
+		"a.txt":                    "/a.txt",
+		"docs/b.txt":               "/b.txt",
+		"docs/reports/summary.txt": "/c.txt",
+		"renamed.txt":              "/d.txt",
+	}
+	for path, body := range expected {
+		data, err := os.ReadFile(filepath.Join(location, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatalf("Expected %s to contain %s, Got: %s", path, body, data)
+		}
+	}
+}
+
+func TestHandleDownloadRemoteUrlFileClient(t *testing.T) {
+	var ts *httptest.Server
+	var mu sync.Mutex
+	var userAgent, auth string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/urls.txt", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgent, auth = r.UserAgent(), r.Header.Get("Authorization")
+		mu.Unlock()
+		fmt.Fprintf(w, "%s/a.txt\n", ts.URL)
+	})
+	mux.HandleFunc("/local.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s/a.txt\nfile:///etc/passwd\n%s/b.txt|file:///etc/hosts\n", ts.URL, ts.URL)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	})
+	ts = httptest.NewTLSServer(mux)
+	defer ts.Close()
+
+	// The url file is fetched with the TLS settings, User-Agent and credentials of the downloads
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	err := os.WriteFile(caCert, certPEM, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := t.TempDir()
+	err = HandleDownload(new(bytes.Buffer), []string{"-cacert", caCert, "-user", "alice:secret", "-user-agent", "tester/1.0", "-url-file", ts.URL + "/urls.txt", "-location", location})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	mu.Lock()
+	gotUserAgent, gotAuth := userAgent, auth
+	mu.Unlock()
+	if gotUserAgent != "tester/1.0" || gotAuth != basicAuth("alice", "secret") {
+		t.Fatalf("Expected the User-Agent and credentials to be sent, Got: %q, %q", gotUserAgent, gotAuth)
+	}
+	if _, err := os.Stat(filepath.Join(location, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A list on a server can't name local files
+	err = HandleDownload(new(bytes.Buffer), []string{"-k", "-url-file", ts.URL + "/local.txt", "-location", t.TempDir()})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidURL) || !strings.Contains(err.Error(), "lines 2, 3") {
+		t.Fatalf("Expected ErrInvalidURL on lines 2, 3, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadURLRange(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	// A range given as an argument expands into a url for each number
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-location", location, ts.URL + "/file[1-3].txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	entries, err := os.ReadDir(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 files, Got: %d", len(entries))
+	}
+	for _, name := range []string{"file1.txt", "file2.txt", "file3.txt"} {
+		data, err := os.ReadFile(filepath.Join(location, name))
+		if err != nil || string(data) != "/"+name {
+			t.Fatalf("Expected %s to contain /%s, Got: %q, %v", name, name, data, err)
+		}
+	}
+
+	// A range in a url file keeps the directory the line gives
+	urlFile := filepath.Join(t.TempDir(), "urls.txt")
+	err = os.WriteFile(urlFile, []byte(ts.URL+"/log[08-10].txt logs/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location = t.TempDir()
+	err = HandleDownload(new(bytes.Buffer), []string{"-url-file", urlFile, "-location", location})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	for _, name := range []string{"log08.txt", "log09.txt", "log10.txt"} {
+		if _, err := os.Stat(filepath.Join(location, "logs", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.WriteFile(urlFile, []byte(ts.URL+"/log[1-2].txt log.txt\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{[]string{ts.URL + "/file[3-1].txt"}, ErrInvalidRange},
+		{[]string{"-o", "file.txt", ts.URL + "/file[1-2].txt"}, ErrOutputSingleFile},
+		{[]string{"-url-file", urlFile}, ErrInvalidRange},
+	}
+	for _, tc := range tests {
+		err := HandleDownload(new(bytes.Buffer), append([]string{"-location", t.TempDir()}, tc.args...))
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, tc.err) {
+			t.Fatalf("%v: Expected %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHandleDownloadRemoteUrlFile(t *testing.T) {
+	var ts *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/urls.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# shared manifest\n%s/a.txt\n%s/b.txt docs/\n", ts.URL, ts.URL)
+	})
+	mux.HandleFunc("/empty.txt", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/invalid.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>\n</html>\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	})
+	ts = httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-url-file", ts.URL + "/urls.txt", "-location", location})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	for path, body := range map[string]string{"a.txt": "/a.txt", "docs/b.txt": "/b.txt"} {
+		data, err := os.ReadFile(filepath.Join(location, filepath.FromSlash(path)))
+		if err != nil || string(data) != body {
+			t.Fatalf("Expected %s to contain %s, Got: %q, %v", path, body, data, err)
+		}
+	}
+
+	for _, name := range []string{"missing.txt", "empty.txt"} {
+		err = HandleDownload(new(bytes.Buffer), []string{"-url-file", ts.URL + "/" + name, "-location", t.TempDir()})
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrFetchURLFile) {
+			t.Fatalf("%s: Expected ErrFetchURLFile, Got: %v", name, err)
+		}
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-url-file", ts.URL + "/invalid.txt", "-location", t.TempDir()})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidURL) {
+		t.Fatalf("Expected ErrInvalidURL, Got: %v", err)
+	}
+}
+
+func TestGetURLDir(t *testing.T) {
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{"http://host/c.zip", ""},
+		{"http://host/a/b/c.zip", "a/b"},
+		{"http://host/a//b/./c.zip", "a/b"},
+		{"http://host/../../etc/passwd", "etc"},
+		{"http://host/a/%2e%2e/%2e%2e/b/c.zip", "b"},
+		{"http://host/a%5C..%5C..%5Cb/c.zip", "b"},
+		{"http://host/C:/windows/c.zip", "C_/windows"},
+		{"http://host/reports/12:30/c.zip", "reports/12_30"},
+		{"http://host/a%01b/c.zip", "ab"},
+	}
+	for _, tc := range testCases {
+		got := getURLDir(tc.url)
+		if got != filepath.FromSlash(tc.expected) {
+			t.Fatalf("%s: Expected: %q, Got: %q", tc.url, tc.expected, got)
+		}
+	}
+}
+
+func TestHandleDownloadPreservePath(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := filepath.Join(t.TempDir(), "downloads")
+	args := []string{"-x", "2", "-preserve-path", "-location", location, ts.URL + "/a/b/c.zip", ts.URL + "/d.zip"}
+	err := HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	expected := map[string]string{
+		"a/b/c.zip": "/a/b/c.zip",
+		"d.zip":     "/d.zip",
+	}
+	for path, body := range expected {
+		data, err := os.ReadFile(filepath.Join(location, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatalf("Expected %s to contain %s, Got: %s", path, body, data)
+		}
+	}
+}
+
+func TestHandleDownloadPerHost(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	// Reach the same server under a second host name
+	port := ts.URL[strings.LastIndex(ts.URL, ":")+1:]
+	other := "http://localhost:" + port
+
+	location := filepath.Join(t.TempDir(), "downloads")
+	args := []string{"-x", "3", "-per-host", "-preserve-path", "-location", location, ts.URL + "/a.zip", other + "/a.zip", other + "/b/c.zip"}
+	err := HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	expected := map[string]string{
+		"127.0.0.1/a.zip":   "127.0.0.1:" + port,
+		"localhost/a.zip":   "localhost:" + port,
+		"localhost/b/c.zip": "localhost:" + port,
+	}
+	for path, body := range expected {
+		data, err := os.ReadFile(filepath.Join(location, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatalf("Expected %s to contain %s, Got: %s", path, body, data)
+		}
+	}
+
+	for rawURL, expected := range map[string]string{"http://[::1]:8080/a.zip": "--1", "file:///tmp/a.zip": ""} {
+		if got := getURLHostDir(rawURL); got != expected {
+			t.Errorf("%s: Expected: %q, Got: %q", rawURL, expected, got)
+		}
+	}
+}
+
+func TestHandleDownloadStdin(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	stdin = strings.NewReader("# files to download\n" + ts.URL + "/a.txt\n\n" + ts.URL + "/b.txt\n")
+	defer func() { stdin = os.Stdin }()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-location", location})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	for _, filename := range []string{"a.txt", "b.txt"} {
+		_, err := os.Stat(filepath.Join(location, filename))
+		if err != nil {
+			t.Fatalf("Expected %s to be downloaded. Got: %v", filename, err)
+		}
+	}
+}
+
+func TestHandleDownloadMethod(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/export.csv", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, fmt.Sprintf("%s %s range=%q", r.Method, body, r.Header.Get("Range")))
+		mu.Unlock()
+		fmt.Fprint(w, "a,b\n1,2\n")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	dataFile := filepath.Join(t.TempDir(), "query.json")
+	err := os.WriteFile(dataFile, []byte(`{"id":2}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-method", "post", "-data", `{"id":1}`}, `POST {"id":1} range=""`},
+		{[]string{"-method", "PUT", "-data-file", dataFile}, `PUT {"id":2} range=""`},
+		{[]string{"-method", "POST"}, `POST  range=""`},
+	}
+	for _, tc := range tests {
+		location := t.TempDir()
+		// A partial file isn't resumed, since the range of a POST can't be requested
+		err := os.WriteFile(filepath.Join(location, "export.csv.part"), []byte("xxx"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = nil
+
+		args := append(tc.args, "-location", location, ts.URL+"/export.csv")
+		err = HandleDownload(new(bytes.Buffer), args)
+		if err != nil {
+			t.Fatalf("%v: Expected nil error. Got: %v", tc.args, err)
+		}
+		// The file isn't looked up with a HEAD request first
+		if len(requests) != 1 || requests[0] != tc.expected {
+			t.Fatalf("%v: Expected a single request %s, Got: %q", tc.args, tc.expected, requests)
+		}
+		data, err := os.ReadFile(filepath.Join(location, "export.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "a,b\n1,2\n" {
+			t.Fatalf("%v: Expected the whole file, Got: %q", tc.args, data)
+		}
+	}
+
+	errTests := []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"-data", "x"}, ErrBodyWithGet},
+		{[]string{"-method", "POST", "-data", "x", "-data-file", dataFile}, ErrDataTwice},
+		{[]string{"-method", "head"}, ErrInvalidMethod},
+	}
+	for _, tc := range errTests {
+		err := HandleDownload(new(bytes.Buffer), append(tc.args, ts.URL+"/export.csv"))
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, tc.err) {
+			t.Fatalf("%v: Expected %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHandleDownloadHeader(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" || r.Header.Get("Accept") != "text/plain" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-header", "X-Token: secret", "-header", "Accept:text/plain", "-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+}
+
+func TestHandleDownloadUserAgent(t *testing.T) {
+	var mu sync.Mutex
+	var userAgents []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader("hello world"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	testCases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{}, DefaultUserAgent},
+		{[]string{"-user-agent", "custom/1.0"}, "custom/1.0"},
+		{[]string{"-user-agent", ""}, ""},
+	}
+	for _, tc := range testCases {
+		userAgents = nil
+		// Download in segments so the HEAD, GET and range requests are all checked
+		args := append(tc.args, "-segments", "2", "-location", t.TempDir(), ts.URL+"/file.txt")
+		err := HandleDownload(new(bytes.Buffer), args)
+		if err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+		if len(userAgents) < 3 {
+			t.Fatalf("Expected at least 3 requests, Got: %d", len(userAgents))
+		}
+		for _, userAgent := range userAgents {
+			if userAgent != tc.expected {
+				t.Fatalf("%v: Expected User-Agent %q, Got: %q", tc.args, tc.expected, userAgent)
+			}
+		}
+	}
+}
+
+func TestHandleDownloadVerbose(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader("hello"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	url := ts.URL + "/file.txt"
+	byteBuf := new(bytes.Buffer)
+	err := HandleDownload(byteBuf, []string{"-location", t.TempDir(), url})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if strings.Contains(byteBuf.String(), "HEAD ") {
+		t.Fatalf("Expected no request details without -verbose, Got: %s", byteBuf.String())
+	}
+
+	byteBuf.Reset()
+	err = HandleDownload(byteBuf, []string{"-verbose", "-location", t.TempDir(), url})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	for _, expected := range []string{
+		"HEAD " + url + ": 200 OK (Content-Type: text/plain; charset=utf-8, Content-Length: 5, accepts ranges: yes)\n",
+		"GET " + url + ": 200 OK (Content-Type: text/plain; charset=utf-8, Content-Length: 5, accepts ranges: yes)\n",
+	} {
+		if !strings.Contains(byteBuf.String(), expected) {
+			t.Fatalf("Expected output to contain %q, Got: %s", expected, byteBuf.String())
+		}
+	}
+}
+
+func TestHandleDownloadTLS(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewUnstartedServer(mux)
+	// Silence the handshake error logged when the certificate is rejected
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+	url := ts.URL + "/file.txt"
+
+	// The test server's certificate is self-signed
+	err := HandleDownload(new(bytes.Buffer), []string{"-location", t.TempDir(), url})
+	if err == nil {
+		t.Fatal("Expected non-nil error, Got: nil")
+	}
+
+	byteBuf := new(bytes.Buffer)
+	err = HandleDownload(byteBuf, []string{"-k", "-location", t.TempDir(), url})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if !strings.Contains(byteBuf.String(), "Warning: TLS certificate verification is disabled") {
+		t.Fatalf("Expected a warning, Got: %s", byteBuf.String())
+	}
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	err = os.WriteFile(caCert, certPEM, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := t.TempDir()
+	err = HandleDownload(new(bytes.Buffer), []string{"-cacert", caCert, "-location", location, url})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-cacert", filepath.Join(location, "file.txt"), "-location", t.TempDir(), url})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidCACert) {
+		t.Fatalf("Expected ErrInvalidCACert, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadDisableHTTP2(t *testing.T) {
+	var proto string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewUnstartedServer(mux)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{}, "HTTP/2.0"},
+		{[]string{"-disable-http2"}, "HTTP/1.1"},
+		{[]string{"-disable-http2", "-max-idle-conns", "1", "-idle-conn-timeout", "1s"}, "HTTP/1.1"},
+		{[]string{"-http-version", "1.1"}, "HTTP/1.1"},
+		{[]string{"-http-version", "2"}, "HTTP/2.0"},
+	}
+	for _, tc := range tests {
+		args := append(tc.args, "-k", "-location", t.TempDir(), ts.URL+"/file.txt")
+		err := HandleDownload(new(bytes.Buffer), args)
+		if err != nil {
+			t.Fatalf("%v: Expected nil error. Got: %v", tc.args, err)
+		}
+		if proto != tc.expected {
+			t.Fatalf("%v: Expected %s, Got: %s", tc.args, tc.expected, proto)
+		}
+	}
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-http-version", "3", ts.URL + "/file.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrHTTPVersion) {
+		t.Fatalf("Expected ErrHTTPVersion, Got: %v", err)
+	}
+	err = HandleDownload(new(bytes.Buffer), []string{"-disable-http2", "-http-version", "2", ts.URL + "/file.txt"})
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrHTTP2Conflict) {
+		t.Fatalf("Expected ErrHTTP2Conflict, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadProxy(t *testing.T) {
+	// The proxy receives requests for the remote server and answers them itself
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "files.example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&proxied, 1)
+		fmt.Fprint(w, "hello")
+	}))
+	defer proxy.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-proxy", proxy.URL, "-location", location, "http://files.example.com/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+	if atomic.LoadInt32(&proxied) == 0 {
+		t.Fatal("Expected requests to go through the proxy")
+	}
+}
+
+func TestHandleDownloadIPVersion(t *testing.T) {
+	// The test server only listens on 127.0.0.1
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-4", "-location", t.TempDir(), ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-6", "-retries", "0", "-location", t.TempDir(), ts.URL + "/file.txt"})
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Net != "tcp6" {
+		t.Fatalf("Expected a tcp6 dial error, Got: %v", err)
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-4", "-6", ts.URL + "/file.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrIPVersion) {
+		t.Fatalf("Expected ErrIPVersion, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/short", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/cdn", http.StatusFound)
+	})
+	mux.HandleFunc("/cdn", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/files/report.pdf", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/files/report.pdf", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-location", location, ts.URL + "/short"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+
+	// The file is named after the final url, not the original one
+	data, err := os.ReadFile(filepath.Join(location, "report.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-max-redirects", "1", "-location", location, ts.URL + "/short"})
+	if err == nil {
+		t.Fatal("Expected non-nil error, Got: nil")
+	}
+}
+
+func TestHandleDownloadReferer(t *testing.T) {
+	const referer = "https://example.com/downloads"
+	var mu sync.Mutex
+	var methods []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != referer {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-referer", referer, "-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if strings.Join(methods, " ") != "HEAD GET" {
+		t.Fatalf("Expected HEAD and GET requests with the Referer, Got: %v", methods)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+
+	for _, invalid := range []string{"example.com/downloads", "ftp://example.com", "://"} {
+		err = HandleDownload(new(bytes.Buffer), []string{"-referer", invalid, "-location", location, ts.URL + "/file.txt"})
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || inputErr.Err != ErrInvalidReferer {
+			t.Fatalf("%q: Expected ErrInvalidReferer, Got: %v", invalid, err)
+		}
+	}
+}
+
+func TestHandleDownloadCookie(t *testing.T) {
+	mux := http.NewServeMux()
+	// The download link sets the session cookie and redirects to the file, which requires it
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		http.Redirect(w, r, "/files/report.pdf", http.StatusFound)
+	})
+	mux.HandleFunc("/files/report.pdf", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err != nil || cookie.Value != "abc" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	mux.HandleFunc("/private.txt", func(w http.ResponseWriter, r *http.Request) {
+		token, err := r.Cookie("token")
+		if err != nil || token.Value != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	testCases := []struct {
+		args     []string
+		filename string
+	}{
+		{[]string{ts.URL + "/download"}, "report.pdf"},
+		{[]string{"-cookie", "lang=en; token=secret", ts.URL + "/private.txt"}, "private.txt"},
+	}
+	for _, tc := range testCases {
+		location := t.TempDir()
+		err := HandleDownload(new(bytes.Buffer), append([]string{"-location", location}, tc.args...))
+		if err != nil {
+			t.Fatalf("%v: Expected nil error. Got: %v", tc.args, err)
+		}
+		data, err := os.ReadFile(filepath.Join(location, tc.filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("Expected: hello, Got: %s", data)
+		}
+	}
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-location", t.TempDir(), ts.URL + "/private.txt"})
+	if err == nil {
+		t.Fatal("Expected non-nil error without the cookie, Got: nil")
+	}
+}
+
+func TestHandleDownloadOutput(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-output", "greeting.txt", "-location", location, ts.URL + "/download"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "greeting.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+
+	// With -o - only the file itself is written to the output stream
+	stderr = new(bytes.Buffer)
+	defer func() { stderr = os.Stderr }()
+	location = t.TempDir()
+	byteBuf := new(bytes.Buffer)
+	err = HandleDownload(byteBuf, []string{"-o", "-", "-location", location, ts.URL + "/download"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if byteBuf.String() != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", byteBuf.String())
+	}
+	entries, err := os.ReadDir(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected nothing to be saved to disk, Got: %v", entries)
+	}
+}
+
+func TestHandleDownloadOutputResume(t *testing.T) {
+	body := "hello world"
+	var gets int32
+	var mu sync.Mutex
+	var ranges []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		// The first download is cut off half way
+		if atomic.AddInt32(&gets, 1) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			fmt.Fprint(w, body[:5])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	args := []string{"-output", "greeting.txt", "-retries", "0", "-location", location, ts.URL + "/download"}
+	err := HandleDownload(new(bytes.Buffer), args)
+	if err == nil {
+		t.Fatal("Expected the first download to fail, Got: nil")
+	}
+	data, err := os.ReadFile(filepath.Join(location, "greeting.txt.part"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Expected the partial download under the -output name, Got: %q, %v", data, err)
+	}
+
+	// Resuming with the same -output continues the same file
+	err = HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err = os.ReadFile(filepath.Join(location, "greeting.txt"))
+	if err != nil || string(data) != body {
+		t.Fatalf("Expected: %s, Got: %q, %v", body, data, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 2 || ranges[1] != "bytes=5-" {
+		t.Fatalf("Expected the second download to resume with Range: bytes=5-, Got: %q", ranges)
+	}
+	entries, err := os.ReadDir(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected only greeting.txt in the download location, Got: %v", entries)
+	}
+}
+
+// dataErrReader returns its data together with err from a single Read.
+type dataErrReader struct {
+	data []byte
+	err  error
+}
+
+func (r *dataErrReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, r.err
+}
+
+func TestCopyBodyDataWithError(t *testing.T) {
+	bytesChan := make(chan progressEvent)
+	reported := make(chan int64)
+	go func() {
+		var n int64
+		for event := range bytesChan {
+			n += event.bytes
+		}
+		reported <- n
+	}()
+
+	// The bytes read together with an error are written before it is returned
+	resetErr := errors.New("connection reset")
+	r := &http.Response{Body: io.NopCloser(&dataErrReader{data: []byte("hello"), err: resetErr})}
+	dst := new(bytes.Buffer)
+	written, err := copyBody(context.Background(), dst, r, "", bytesChan, nil, 512)
+	close(bytesChan)
+	if !errors.Is(err, resetErr) {
+		t.Fatalf("Expected %v, Got: %v", resetErr, err)
+	}
+	if written != 5 || dst.String() != "hello" || <-reported != 5 {
+		t.Fatalf("Expected hello to be written and reported, Got: %d bytes, %q", written, dst.String())
+	}
+}
+
+func BenchmarkCopyBody(b *testing.B) {
+	body := bytes.Repeat([]byte("a"), 1<<20)
+	bytesChan := make(chan progressEvent)
+	go func() {
+		for range bytesChan {
+		}
+	}()
+	defer close(bytesChan)
+
+	// Small chunks make the per-chunk overhead visible
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		r := &http.Response{Body: io.NopCloser(bytes.NewReader(body))}
+		_, err := copyBody(context.Background(), io.Discard, r, "", bytesChan, nil, 512)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHandleDownloadLocationNotWritable(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("directory permissions don't stop this user from writing")
+	}
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+
+	location := t.TempDir()
+	if err := os.Chmod(location, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(location, 0755)
+
+	// Neither the files nor a url file or index page listing them are requested
+	tests := [][]string{
+		{ts.URL + "/file.txt"},
+		{"-url-file", ts.URL + "/urls.txt"},
+		{"-sync", ts.URL + "/files/"},
+	}
+	for _, args := range tests {
+		err := HandleDownload(new(bytes.Buffer), append([]string{"-location", location}, args...))
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrLocationNotWritable) {
+			t.Fatalf("%v: Expected ErrLocationNotWritable, Got: %v", args, err)
+		}
+		if n := atomic.LoadInt32(&requests); n != 0 {
+			t.Fatalf("%v: Expected nothing to be requested, Got: %d requests", args, n)
+		}
+	}
+}
+
+func TestHandleDownloadLocationMustExist(t *testing.T) {
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// A missing location isn't created
+	location := filepath.Join(t.TempDir(), "typo")
+	err := HandleDownload(new(bytes.Buffer), []string{"-location-must-exist", "-location", location, ts.URL + "/file.txt"})
+	if !errors.Is(err, ErrLocationNotExist) {
+		t.Fatalf("Expected ErrLocationNotExist, Got: %v", err)
+	}
+	if _, err := os.Stat(location); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected %s not to be created. Got: %v", location, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("Expected no file to be downloaded, Got: %d requests", n)
+	}
+
+	// An existing location is used as usual
+	location = t.TempDir()
+	err = HandleDownload(new(bytes.Buffer), []string{"-location-must-exist", "-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(location, "file.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
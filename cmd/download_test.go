@@ -0,0 +1,576 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownload(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	opts := DownloadOptions{
+		URLs:     []string{ts.URL + "/file.txt", ts.URL + "/missing.txt"},
+		Location: location,
+		Header:   http.Header{"X-Token": []string{"secret"}},
+	}
+	result, err := Download(context.Background(), opts)
+
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected DownloadErrors, Got: %v", err)
+	}
+	if len(result.Files) != 2 {
+		t.Fatalf("Expected 2 file results, Got: %d", len(result.Files))
+	}
+
+	file := result.Files[0]
+	if file.Err != nil {
+		t.Fatalf("Expected nil error. Got: %v", file.Err)
+	}
+	if expected := filepath.Join(location, "file.txt"); file.Path != expected {
+		t.Fatalf("Expected: %v, Got: %v", expected, file.Path)
+	}
+	if file.BytesWritten != 5 {
+		t.Fatalf("Expected 5 bytes written, Got: %d", file.BytesWritten)
+	}
+	data, err := os.ReadFile(file.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+
+	missing := result.Files[1]
+	if missing.URL != opts.URLs[1] || missing.Err == nil {
+		t.Fatalf("Expected %v to fail, Got: %+v", opts.URLs[1], missing)
+	}
+}
+
+func TestDownloadRequestFails(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	mux.HandleFunc("/mirror/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	mux.HandleFunc("/truncated.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		if r.Method == http.MethodHead {
+			return
+		}
+		fmt.Fprint(w, "hello")
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	closed := httptest.NewServer(mux)
+	closed.Close()
+
+	// A server that can't be reached fails only its own download, unless a mirror
+	// can be reached
+	location := t.TempDir()
+	result, err := Download(context.Background(), DownloadOptions{
+		URLs:     []string{closed.URL + "/unreachable.txt", ts.URL + "/file.txt", closed.URL + "/mirrored.txt"},
+		Mirrors:  [][]string{{closed.URL + "/mirror.txt"}, nil, {ts.URL + "/mirror/mirrored.txt"}},
+		Location: location,
+	})
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) || len(downloadErrs.Errs) != 1 || downloadErrs.Total != 3 {
+		t.Fatalf("Expected 1 of 3 DownloadErrors, Got: %v", err)
+	}
+	if failed := downloadErrs.Errs[0]; failed.URL != closed.URL+"/unreachable.txt" || !strings.Contains(failed.Err.Error(), "connection refused") {
+		t.Fatalf("Expected the connection to be refused, Got: %v", failed)
+	}
+	if len(result.Files) != 3 || result.Files[1].Err != nil || result.Files[2].Err != nil {
+		t.Fatalf("Expected the other urls to be downloaded, Got: %+v", result.Files)
+	}
+	for _, name := range []string{"file.txt", "mirrored.txt"} {
+		data, err := os.ReadFile(filepath.Join(location, name))
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("Expected %s to contain hello, Got: %q, %v", name, data, err)
+		}
+	}
+
+	// A body cut off mid-write fails only its own download
+	opts := DownloadOptions{
+		URLs:     []string{ts.URL + "/truncated.txt", ts.URL + "/file.txt"},
+		Location: location,
+		Retries:  0,
+	}
+	result, err = Download(context.Background(), opts)
+	if !errors.As(err, &downloadErrs) || len(downloadErrs.Errs) != 1 {
+		t.Fatalf("Expected 1 DownloadError, Got: %v", err)
+	}
+	if len(result.Files) != 2 {
+		t.Fatalf("Expected 2 file results, Got: %d", len(result.Files))
+	}
+	if file := result.Files[0]; file.Err == nil {
+		t.Fatalf("Expected %v to fail, Got: %+v", file.URL, file)
+	}
+	if file := result.Files[1]; file.Err != nil {
+		t.Fatalf("Expected nil error. Got: %v", file.Err)
+	}
+
+	// The data received before the body was cut off is kept to be resumed
+	data, err := os.ReadFile(filepath.Join(location, "truncated.txt.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+}
+
+func TestDownloadEmptyFile(t *testing.T) {
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "empty.txt", modTime, bytes.NewReader(nil))
+	}))
+	defer ts.Close()
+
+	for _, timeCond := range []bool{false, true} {
+		location := t.TempDir()
+		opts := DownloadOptions{URLs: []string{ts.URL + "/empty.txt"}, Location: location, TimeCond: timeCond}
+		// The second run finds the file already downloaded
+		for run := 1; run <= 2; run++ {
+			result, err := Download(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("TimeCond %v, run %d: Expected nil error. Got: %v", timeCond, run, err)
+			}
+			if file := result.Files[0]; file.Err != nil || file.Path != filepath.Join(location, "empty.txt") {
+				t.Fatalf("TimeCond %v, run %d: Expected empty.txt to be downloaded, Got: %+v", timeCond, run, file)
+			}
+			info, err := os.Stat(filepath.Join(location, "empty.txt"))
+			if err != nil {
+				t.Fatalf("TimeCond %v, run %d: %v", timeCond, run, err)
+			}
+			if info.Size() != 0 {
+				t.Fatalf("TimeCond %v, run %d: Expected an empty file, Got: %d bytes", timeCond, run, info.Size())
+			}
+		}
+	}
+}
+
+func TestDownloadProgressWriter(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	url := ts.URL + "/file.txt"
+
+	for _, jsonProgress := range []bool{false, true} {
+		output, progress := new(bytes.Buffer), new(bytes.Buffer)
+		opts := DownloadOptions{
+			URLs:         []string{url},
+			Location:     t.TempDir(),
+			Output:       output,
+			Progress:     progress,
+			JSONProgress: jsonProgress,
+		}
+		_, err := Download(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+
+		// Messages and results go to Output, and progress only to Progress
+		messages, updates := output.String(), progress.String()
+		if jsonProgress {
+			if !strings.Contains(messages, `"status":"completed"`) || strings.Contains(messages, `"status":"downloading"`) {
+				t.Fatalf("Expected only the result on Output, Got: %q", messages)
+			}
+			if !strings.Contains(updates, `"status":"downloading"`) || strings.Contains(updates, `"status":"completed"`) {
+				t.Fatalf("Expected only the progress on Progress, Got: %q", updates)
+			}
+			continue
+		}
+		if !strings.Contains(messages, "Downloading "+url) || !strings.Contains(messages, "completed "+url) || strings.Contains(messages, "transferred") {
+			t.Fatalf("Expected only messages on Output, Got: %q", messages)
+		}
+		if !strings.Contains(updates, "transferred 5 / 5 bytes") || strings.Contains(updates, url) {
+			t.Fatalf("Expected only the progress on Progress, Got: %q", updates)
+		}
+	}
+}
+
+func TestDownloadOnProgress(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	url, missing := ts.URL+"/file.txt", ts.URL+"/missing.txt"
+
+	var events []ProgressEvent
+	opts := DownloadOptions{
+		URLs:       []string{missing, url},
+		Location:   t.TempDir(),
+		OnProgress: func(event ProgressEvent) { events = append(events, event) },
+		// A single download at a time keeps the events in order
+		MaxConcurrent: 1,
+	}
+	_, err := Download(context.Background(), opts)
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected DownloadErrors, Got: %v", err)
+	}
+
+	var statuses []string
+	for _, event := range events {
+		statuses = append(statuses, event.URL+" "+event.Status)
+	}
+	// The missing url fails when it is looked up, without starting
+	expected := []string{
+		missing + " " + ProgressFailed,
+		url + " " + ProgressStarted,
+		url + " " + ProgressDownloading,
+		url + " " + ProgressCompleted,
+	}
+	if strings.Join(statuses, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected: %q, Got: %q", expected, statuses)
+	}
+	completed := events[3]
+	if completed.Bytes != 5 || completed.Total != 5 || completed.Result == nil || completed.Result.Err != nil {
+		t.Fatalf("Expected the completed file with 5 of 5 bytes, Got: %+v", completed)
+	}
+	if events[0].Result == nil || events[0].Result.Err == nil {
+		t.Fatalf("Expected the failed result, Got: %+v", events[0])
+	}
+}
+
+func TestDownloadCancel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		if r.Method == http.MethodHead {
+			return
+		}
+		// Send half of the file, then stall until the client goes away
+		fmt.Fprint(w, "hello")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	destinationPath := filepath.Join(location, "file.txt")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel once the first half of the file is on disk
+	go func() {
+		for {
+			fInfo, err := os.Stat(destinationPath + ".part")
+			if err == nil && fInfo.Size() == 5 {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	_, err := Download(ctx, DownloadOptions{URLs: []string{ts.URL + "/file.txt"}, Location: location})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected: %v, Got: %v", context.Canceled, err)
+	}
+
+	// The partial file is kept so that it can be resumed, but not under the final name
+	_, err = os.Stat(destinationPath)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected no file at %v. Got: %v", destinationPath, err)
+	}
+	data, err := os.ReadFile(destinationPath + ".part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected: hello, Got: %s", data)
+	}
+}
+
+func TestDownloadDiskSpace(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	defer func(f func(string) (uint64, error)) { availableSpace = f }(availableSpace)
+	availableSpace = func(string) (uint64, error) { return 60, nil }
+
+	location := t.TempDir()
+	opts := DownloadOptions{URLs: []string{ts.URL + "/file.txt"}, Location: location}
+	_, err := Download(context.Background(), opts)
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("Expected ErrInsufficientSpace, Got: %v", err)
+	}
+
+	// Data already downloaded by an earlier run doesn't need more space
+	err = os.WriteFile(filepath.Join(location, "file.txt.part"), []byte(body[:50]), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Download(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+
+	opts.Location = t.TempDir()
+	opts.NoSpaceCheck = true
+	_, err = Download(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Expected nil error with NoSpaceCheck. Got: %v", err)
+	}
+}
+
+func TestDownloadDecompress(t *testing.T) {
+	body := strings.Repeat("hello world\n", 1000)
+	gzipped := new(bytes.Buffer)
+	gw := gzip.NewWriter(gzipped)
+	gw.Write([]byte(body))
+	gw.Close()
+	deflated := new(bytes.Buffer)
+	zw := zlib.NewWriter(deflated)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	var rangeRequested bool
+	encoded := func(encoding string, data []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if len(r.Header.Get("Range")) != 0 {
+				rangeRequested = true
+			}
+			// Serve the compressed file whether or not the client asked for it
+			w.Header().Set("Content-Encoding", encoding)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt.gz", encoded("gzip", gzipped.Bytes()))
+	mux.HandleFunc("/file.txt.z", encoded("deflate", deflated.Bytes()))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		url          string
+		partial      string
+		noDecompress bool
+		expected     string
+	}{
+		{name: "gzip", url: ts.URL + "/file.txt.gz", expected: body},
+		{name: "deflate", url: ts.URL + "/file.txt.z", expected: body},
+		{name: "no resume", url: ts.URL + "/file.txt.gz", partial: body[:100], expected: body},
+		{name: "no decompress", url: ts.URL + "/file.txt.gz", noDecompress: true, expected: gzipped.String()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rangeRequested = false
+			location := t.TempDir()
+			opts := DownloadOptions{
+				URLs:         []string{tc.url},
+				Location:     location,
+				Filename:     "file.txt",
+				NoDecompress: tc.noDecompress,
+			}
+			destinationPath := filepath.Join(location, "file.txt")
+			if len(tc.partial) != 0 {
+				err := os.WriteFile(getPartPath(destinationPath), []byte(tc.partial), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := Download(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Expected nil error. Got: %v", err)
+			}
+			data, err := os.ReadFile(destinationPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.expected {
+				t.Fatalf("Expected %d bytes, Got: %d", len(tc.expected), len(data))
+			}
+			if rangeRequested {
+				t.Fatal("Expected the compressed file to be downloaded from scratch")
+			}
+		})
+	}
+
+	// Compressed files are decompressed when streamed too
+	buf := new(bytes.Buffer)
+	_, err := Download(context.Background(), DownloadOptions{URLs: []string{ts.URL + "/file.txt.gz"}, Destination: buf})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if buf.String() != body {
+		t.Fatalf("Expected %d bytes, Got: %d", len(body), buf.Len())
+	}
+}
+
+func TestDownloadMirrors(t *testing.T) {
+	var mirrorRange string
+	mux := http.NewServeMux()
+	// The primary sends half of the file and then drops the connection
+	mux.HandleFunc("/primary/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "10")
+		if r.Method == http.MethodHead {
+			return
+		}
+		fmt.Fprint(w, "hello")
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	mux.HandleFunc("/corrupt/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "HELLOWORLD")
+	})
+	mux.HandleFunc("/mirror/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mirrorRange = r.Header.Get("Range")
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader("helloworld"))
+	})
+	mux.HandleFunc("/broken/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		mirrors  []string
+		checksum string
+		mirror   string
+		rangeReq string
+		err      string
+	}{
+		{
+			name:     "resume from mirror",
+			url:      ts.URL + "/primary/file.txt",
+			mirrors:  []string{ts.URL + "/broken/file.txt", ts.URL + "/mirror/file.txt"},
+			mirror:   ts.URL + "/mirror/file.txt",
+			rangeReq: "bytes=5-",
+		},
+		{
+			name:     "checksum mismatch",
+			url:      ts.URL + "/corrupt/file.txt",
+			mirrors:  []string{ts.URL + "/mirror/file.txt"},
+			checksum: "md5:fc5e038d38a57032085441e7fe7010b0",
+			mirror:   ts.URL + "/mirror/file.txt",
+		},
+		{
+			name:    "unreachable url",
+			url:     unreachable.URL + "/file.txt",
+			mirrors: []string{ts.URL + "/mirror/file.txt"},
+			mirror:  ts.URL + "/mirror/file.txt",
+		},
+		{
+			name:    "every mirror fails",
+			url:     ts.URL + "/broken/file.txt",
+			mirrors: []string{ts.URL + "/broken/file.txt?mirror", ts.URL + "/missing.txt"},
+			err:     "every mirror failed, the last with: unexpected Status Code: 404",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mirrorRange = ""
+			location := t.TempDir()
+			result, err := Download(context.Background(), DownloadOptions{
+				URLs:     []string{tc.url},
+				Mirrors:  [][]string{tc.mirrors},
+				Location: location,
+				Checksum: tc.checksum,
+			})
+			if len(tc.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q, Got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected nil error. Got: %v", err)
+			}
+			if result.Files[0].Mirror != tc.mirror {
+				t.Fatalf("Expected the file to be downloaded from %v, Got: %v", tc.mirror, result.Files[0].Mirror)
+			}
+			if mirrorRange != tc.rangeReq {
+				t.Fatalf("Expected Range %q from the mirror, Got: %q", tc.rangeReq, mirrorRange)
+			}
+			data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "helloworld" {
+				t.Fatalf("Expected: helloworld, Got: %s", data)
+			}
+		})
+	}
+}
+
+func BenchmarkDownloadBufferSize(b *testing.B) {
+	body := bytes.Repeat([]byte("a"), 16<<20)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, size := range []int{4 << 10, DefaultBufferSize, 256 << 10, 1 << 20} {
+		b.Run(formatByteSize(float64(size)), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				_, err := Download(context.Background(), DownloadOptions{
+					URLs:        []string{ts.URL + "/file.bin"},
+					Destination: io.Discard,
+					BufferSize:  size,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
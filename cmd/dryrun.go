@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// dryRun looks up every url in opts with a HEAD request and prints where it would be
+// downloaded to w, without writing any files. Unreachable urls are reported in the
+// result and the returned DownloadErrors.
+func dryRun(ctx context.Context, client *http.Client, opts *DownloadOptions, w io.Writer) (*DownloadResult, error) {
+	d := &downloader{client: client, opts: opts, log: newLogger(w, opts.LogLevel)}
+	result := &DownloadResult{Files: make([]FileResult, len(opts.URLs))}
+	remotes := make([]remoteFile, len(opts.URLs))
+	for i, u := range opts.URLs {
+		result.Files[i].URL = u
+		remote, err := d.lookup(ctx, u, time.Time{})
+		if err == nil && remote.statusCode >= http.StatusBadRequest {
+			err = StatusError{StatusCode: remote.statusCode}
+		}
+		if err != nil {
+			result.Files[i].Err = err
+			continue
+		}
+		remotes[i] = opts.place(i, remote)
+	}
+	if err := resolveConflicts(opts.URLs, remotes, opts.OnConflict); err != nil {
+		return result, err
+	}
+
+	var failed []DownloadError
+	for i, remote := range remotes {
+		file := &result.Files[i]
+		if file.Err == nil && opts.Destination == nil {
+			file.Path, file.Err = d.getDestinationPath(remote)
+		}
+		if file.Err != nil {
+			fmt.Fprintf(w, "Can't download %v: %v\n", file.URL, file.Err)
+			failed = append(failed, DownloadError{URL: file.URL, Err: file.Err})
+			continue
+		}
+
+		destination := file.Path
+		if opts.Destination != nil {
+			destination = "stdout"
+		}
+		if remote.duplicate {
+			file.Skipped = true
+			fmt.Fprintf(w, "Would skip %v, which is saved to %s by an earlier url\n", file.URL, destination)
+			continue
+		}
+		size := "unknown size"
+		if remote.contentLength >= 0 {
+			size = fmt.Sprintf("%d bytes", remote.contentLength)
+		}
+		fmt.Fprintf(w, "Would download %v to %s (%s)\n", file.URL, destination, size)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if len(failed) > 0 {
+		return result, DownloadErrors{Errs: failed, Total: len(opts.URLs)}
+	}
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleDownloadDryRun(t *testing.T) {
+	var gets int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := filepath.Join(t.TempDir(), "downloads")
+	byteBuf := new(bytes.Buffer)
+	err := HandleDownload(byteBuf, []string{"-dry-run", "-x", "3", "-location", location, ts.URL + "/a/file.zip", ts.URL + "/b/file.zip", ts.URL + "/missing.zip"})
+
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected DownloadErrors, Got: %v", err)
+	}
+	if len(downloadErrs.Errs) != 1 || downloadErrs.Errs[0].URL != ts.URL+"/missing.zip" {
+		t.Fatalf("Expected only %v to fail, Got: %v", ts.URL+"/missing.zip", err)
+	}
+
+	expected := fmt.Sprintf("Would download %s/a/file.zip to %s (5 bytes)\n", ts.URL, filepath.Join(location, "file.zip")) +
+		fmt.Sprintf("Would download %s/b/file.zip to %s (5 bytes)\n", ts.URL, filepath.Join(location, "file(1).zip")) +
+		fmt.Sprintf("Can't download %s/missing.zip: unexpected Status Code: 404\n", ts.URL)
+	if got := byteBuf.String(); got != expected {
+		t.Fatalf("Expected: %s, Got: %s", expected, got)
+	}
+
+	// Nothing is downloaded or written
+	if gets != 0 {
+		t.Fatalf("Expected no GET requests, Got: %d", gets)
+	}
+	_, err = os.Stat(location)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected %s not to be created, Got: %v", location, err)
+	}
+}
@@ -1,14 +1,125 @@
 package cmd
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
 
 var (
-	ErrNoServerSpecified = errors.New("you have to specify a remote server for each file to download")
-	ErrNumDownloadFiles = errors.New("you have to specify a number greater than 0 for -x")
-	ErrInvalidCommand = errors.New("invalid download command specified")
-	ErrNumFilesMustBeZero = errors.New("you have to specify 0 for -x")
+	ErrNoServerSpecified   = errors.New("you have to specify a remote server to download from, or a -url-file")
+	ErrTooFewServers       = errors.New("you have to specify a remote server for each file given to -x")
+	ErrTooManyServers      = errors.New("you have specified more remote servers than the number of files given to -x")
+	ErrNumDownloadFiles    = errors.New("you have to specify a number greater than 0 for -x")
+	ErrInvalidCommand      = errors.New("invalid download command specified")
+	ErrNumFilesMustBeZero  = errors.New("you have to specify 0 for -x")
+	ErrMaxConcurrent       = errors.New("you have to specify a number greater than 0 for -max-concurrent")
+	ErrNumSegments         = errors.New("you have to specify a number greater than 0 for -segments")
+	ErrMergeStrategy       = errors.New("you have to specify -merge-strategy as writeat or concat")
+	ErrNumRetries          = errors.New("you have to specify 0 or a positive number for -retries")
+	ErrRetryBackoff        = errors.New("you have to specify 0 or a positive duration for -retry-backoff")
+	ErrMaxRetryAfter       = errors.New("you have to specify a positive duration for -max-retry-after")
+	ErrInvalidChecksum     = errors.New("you have to specify -checksum as algorithm:hex, where algorithm is one of md5, sha1, sha256 or sha512")
+	ErrChecksumSingleFile  = errors.New("you can only specify -checksum when downloading a single file")
+	ErrOutputSingleFile    = errors.New("you can only specify -output when downloading a single file")
+	ErrMirrorSingleFile    = errors.New("you can only specify -mirror when downloading a single file, use a -url-file to give mirrors of several")
+	ErrChecksumStdout      = errors.New("you can't specify -checksum when writing to stdout")
+	ErrInvalidHash         = errors.New("you have to specify -print-hash as md5, sha1, sha256 or sha512")
+	ErrPrintHashValue      = errors.New("you have to join the -print-hash algorithm with =")
+	ErrInvalidChecksumFile = errors.New("invalid checksum file")
+	ErrChecksumConflict    = errors.New("you can't specify both -checksum and -checksum-file")
+	ErrChecksumFileStdout  = errors.New("you can't specify -checksum-file when writing to stdout")
+	ErrMaxRedirects        = errors.New("you have to specify 0 or a positive number for -max-redirects")
+	ErrInvalidMethod       = errors.New("you have to specify -method as GET or another method whose response is the file, such as POST")
+	ErrBodyWithGet         = errors.New("you can only specify -data or -data-file with a -method other than GET")
+	ErrDataTwice           = errors.New("you can't specify both -data and -data-file")
+	ErrInvalidHeader       = errors.New("you have to specify -header as Key: Value")
+	ErrPasswordWithoutUser = errors.New("you have to specify -user with -password")
+	ErrPasswordTwice       = errors.New("you can't specify -password together with a password in -user")
+	ErrNoPassword          = errors.New("you have to specify a password for -user")
+	ErrPasswordStdin       = errors.New("you can't read both the urls and the password from stdin, set $DLMANAGER_PASSWORD")
+	ErrPasswordEcho        = errors.New("the password can't be hidden as it's typed, set $DLMANAGER_PASSWORD")
+	ErrTokenTwice          = errors.New("you can't specify both -token-file and -token-env")
+	ErrInvalidTokenFile    = errors.New("you have to specify -token-file as a readable file holding a bearer token")
+	ErrTokenEnvNotSet      = errors.New("the environment variable given to -token-env isn't set")
+	ErrAuthTwice           = errors.New("you can't specify both -user and a bearer token")
+	ErrInvalidNetrc        = errors.New("invalid netrc file")
+	ErrInvalidLimitRate    = errors.New("you have to specify -limit-rate as a positive number of bytes, optionally followed by k, m or g")
+	ErrInvalidHostRate     = errors.New("you have to specify -limit-rate-per-host as a positive number of bytes, optionally followed by k, m or g")
+	ErrInvalidMinFileSize  = errors.New("you have to specify -min-filesize as a number of bytes, optionally followed by k, m or g")
+	ErrInvalidBufferSize   = errors.New("you have to specify -buffer-size as a positive number of bytes up to 64m, optionally followed by k, m or g")
+	ErrTimeout             = errors.New("you have to specify 0 or a positive duration for -timeout")
+	ErrWait                = errors.New("you have to specify 0 or a positive duration for -wait")
+	ErrDeadline            = errors.New("you have to specify 0 or a positive duration for -deadline")
+	ErrProgressInterval    = errors.New("you have to specify a positive duration for -progress-interval")
+	ErrMaxIdleConns        = errors.New("you have to specify a number greater than 0 for -max-idle-conns")
+	ErrIdleConnTimeout     = errors.New("you have to specify a positive duration for -idle-conn-timeout")
+	ErrIdleTimeout         = errors.New("you have to specify 0 or a positive duration for -idle-timeout")
+	ErrInvalidCACert       = errors.New("you have to specify -cacert as a file of PEM encoded certificates")
+	ErrInvalidProxy        = errors.New("you have to specify -proxy as an http://, https:// or socks5:// url")
+	ErrIPVersion           = errors.New("you can't specify both -4 and -6")
+	ErrHTTPVersion         = errors.New("you have to specify -http-version as 1.1 or 2")
+	ErrHTTP2Conflict       = errors.New("you can't specify both -disable-http2 and -http-version 2")
+	ErrInvalidReferer      = errors.New("you have to specify -referer as an http:// or https:// url")
+	ErrInvalidOnConflict   = errors.New("you have to specify -on-conflict as rename, skip or error")
+	ErrInvalidLogLevel     = errors.New("you have to specify -log-level as error, info or debug")
+	ErrInvalidOnOversize   = errors.New("you have to specify -on-oversize as restart or error")
+	ErrRenameTemplate      = errors.New("invalid -rename template")
+	ErrFilenameConflict    = errors.New("urls are saved to the same file")
+	ErrInvalidConfig       = errors.New("invalid config file")
+	ErrInvalidShell        = errors.New("you have to specify the shell to complete as bash, zsh or fish")
+	ErrCleanArgs           = errors.New("clean doesn't take any arguments, use -location to choose the directory to clean")
+	ErrListArgs            = errors.New("list doesn't take any arguments, use -location to choose the directory to list")
+	ErrHeadArgs            = errors.New("you have to specify a single url for head")
+	ErrInvalidURL          = errors.New("invalid url")
+	ErrInvalidRange        = errors.New("invalid url range")
+	ErrFetchURLFile        = errors.New("couldn't fetch the url file")
+	ErrFetchIndex          = errors.New("couldn't fetch the index page")
+	ErrSyncURLFile         = errors.New("you can only specify -sync with index pages given as arguments, not a -url-file or stdin")
+	ErrSyncSingleFile      = errors.New("you can't specify -output, -checksum or -mirror with -sync")
+	ErrInvalidLevel        = errors.New("you have to specify 0 or a positive number for -level")
+	ErrLevelWithoutSync    = errors.New("you can only specify -level with -sync")
+	ErrInvalidPath         = errors.New("path must be relative and stay inside the download location")
+	ErrNoFilename          = errors.New("filename couldn't be determined")
+	ErrInsufficientSpace   = errors.New("not enough disk space")
+	ErrLocationNotExist    = errors.New("download location doesn't exist")
+	ErrLocationNotWritable = errors.New("download location isn't writable")
+	ErrStalled             = errors.New("download stalled")
+	ErrStopped             = errors.New("stopped after another download failed")
+	ErrDeadlineReached     = errors.New("abandoned at the -deadline")
+	ErrFileTooSmall        = errors.New("file is smaller than the minimum file size, and may be an error page")
+	ErrSizeMismatch        = errors.New("downloaded size doesn't match the size reported by the server")
+	ErrOversize            = errors.New("partial download is larger than the remote file")
+)
+
+// Exit codes of the dlmanager command, see ExitCode.
+const (
+	// ExitOK means every file was downloaded.
+	ExitOK = 0
+	// ExitInvalidInput means the command or its options were invalid.
+	ExitInvalidInput = 1
+	// ExitPartialFailure means some files were downloaded, but others failed.
+	ExitPartialFailure = 2
+	// ExitFailure means no file was downloaded.
+	ExitFailure = 3
 )
 
+// ExitCode returns the exit code of the dlmanager command that failed with err.
+func ExitCode(err error) int {
+	var downloadErrs DownloadErrors
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &InvalidInputError{}), errors.As(err, &FlagParsingError{}):
+		return ExitInvalidInput
+	case errors.As(err, &downloadErrs) && downloadErrs.Partial():
+		return ExitPartialFailure
+	default:
+		return ExitFailure
+	}
+}
+
 type InvalidInputError struct {
 	Err error
 }
@@ -17,10 +128,97 @@ func (e InvalidInputError) Error() string {
 	return e.Err.Error()
 }
 
+func (e InvalidInputError) Unwrap() error {
+	return e.Err
+}
+
 type FlagParsingError struct {
 	Err error
 }
 
 func (e FlagParsingError) Error() string {
 	return e.Err.Error()
-}
\ No newline at end of file
+}
+
+func (e FlagParsingError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError reports an HTTP response with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	// RetryAfter is the delay a 429 or 503 response asked for in its Retry-After
+	// header, or 0 if it didn't
+	RetryAfter time.Duration
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("unexpected Status Code: %v", e.StatusCode)
+}
+
+// ChecksumError reports a downloaded file whose hash doesn't match the expected checksum.
+type ChecksumError struct {
+	Path      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch for %s: expected %s, got %s", e.Algorithm, e.Path, e.Expected, e.Actual)
+}
+
+// DownloadError reports the failed download of a single url.
+type DownloadError struct {
+	URL string
+	Err error
+}
+
+func (e DownloadError) Error() string {
+	return e.URL + ": " + e.Err.Error()
+}
+
+func (e DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// DownloadErrors reports every failed download of a batch.
+type DownloadErrors struct {
+	Errs []DownloadError
+	// Total is the number of urls in the batch, including those that didn't fail.
+	Total int
+}
+
+// Partial reports whether some urls of the batch didn't fail.
+func (e DownloadErrors) Partial() bool {
+	return len(e.Errs) < e.Total
+}
+
+func (e DownloadErrors) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "failed to download: " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the failed downloads matches target, so errors.Is finds the
+// cause of each one without needing the multiple error unwrapping of Go 1.20.
+func (e DownloadErrors) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the failed downloads that matches target, like errors.As.
+func (e DownloadErrors) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"testing"
+)
+
+func TestErrorsUnwrap(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected error
+	}{
+		{InvalidInputError{ErrNoServerSpecified}, ErrNoServerSpecified},
+		{InvalidInputError{fmt.Errorf("%w on line 2 of urls.txt", ErrInvalidURL)}, ErrInvalidURL},
+		{FlagParsingError{flag.ErrHelp}, flag.ErrHelp},
+		{fmt.Errorf("download: %w", InvalidInputError{ErrMaxConcurrent}), ErrMaxConcurrent},
+	}
+	for _, tc := range tests {
+		if !errors.Is(tc.err, tc.expected) {
+			t.Errorf("%v: Expected errors.Is to find %v", tc.err, tc.expected)
+		}
+	}
+
+	// The sentinel errors returned by the sub-commands can be checked directly
+	err := HandleDownload(new(bytes.Buffer), []string{"-max-concurrent", "0", "http://example.com/file.txt"})
+	if !errors.Is(err, ErrMaxConcurrent) || ExitCode(err) != ExitInvalidInput {
+		t.Fatalf("Expected ErrMaxConcurrent, Got: %v", err)
+	}
+	err = HandleDownload(new(bytes.Buffer), []string{"-h"})
+	if !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("Expected flag.ErrHelp, Got: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+)
+
+// headInfo is the metadata of a url printed by the head sub-command.
+type headInfo struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+	// ContentLength is -1 if the server didn't report it
+	ContentLength int64  `json:"content_length"`
+	ContentType   string `json:"content_type,omitempty"`
+	AcceptRanges  bool   `json:"accept_ranges"`
+	ETag          string `json:"etag,omitempty"`
+	LastModified  string `json:"last_modified,omitempty"`
+	// Filename is the name the file is saved as, or empty if it can't be determined
+	Filename string `json:"filename,omitempty"`
+}
+
+// HandleHead handles the head sub-command, which sends a HEAD request for a url and
+// prints what the server reports about the file, without downloading it.
+func HandleHead(w io.Writer, args []string) error {
+	var headers stringsFlag
+	var userAgent, user, proxy string
+	var jsonOutput, guessExtension, netrc bool
+	var opts DownloadOptions
+
+	flags := flag.NewFlagSet("head", flag.ContinueOnError)
+	flags.SetOutput(w)
+	flags.Var(&headers, "header", "Extra request `header` as \"Key: Value\". May be repeated")
+	flags.StringVar(&userAgent, "user-agent", DefaultUserAgent, "User-Agent sent with the request. Empty sends none")
+	flags.StringVar(&user, "user", "", "Username for basic authentication, optionally as user:password")
+	flags.BoolVar(&netrc, "netrc", false, "Send the login and password for the host in $"+netrcEnv+" or ~/.netrc using basic authentication")
+	flags.StringVar(&proxy, "proxy", "", "Proxy `url` as http://, https:// or socks5://host:port. Defaults to $HTTP_PROXY and $HTTPS_PROXY")
+	flags.BoolVar(&opts.Insecure, "insecure", false, "Don't verify the server's TLS certificate")
+	flags.BoolVar(&opts.Insecure, "k", false, "Shorthand for -insecure")
+	flags.StringVar(&opts.CACertFile, "cacert", "", "File of PEM encoded CA certificates used to verify the server's TLS certificate")
+	flags.BoolVar(&guessExtension, "guess-extension", false, "Add an extension based on the Content-Type to a filename that has none")
+	flags.BoolVar(&jsonOutput, "json", false, "Print the metadata as a JSON object")
+	flags.Usage = func() {
+		var usageString = `
+head: A sub-command for printing the metadata of a url without downloading it
+
+head: <options> url`
+		fmt.Fprint(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "options: ")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return FlagParsingError{err}
+	}
+	if flags.NArg() != 1 {
+		return InvalidInputError{ErrHeadArgs}
+	}
+	rawURL := flags.Arg(0)
+	if !isHTTPURL(rawURL) {
+		return InvalidInputError{fmt.Errorf("%w: %q", ErrInvalidURL, rawURL)}
+	}
+	header, err := parseHeaders(headers)
+	if err != nil {
+		return InvalidInputError{err}
+	}
+	// an empty -user-agent sends no User-Agent at all
+	if _, ok := header["User-Agent"]; !ok {
+		header["User-Agent"] = []string{userAgent}
+	}
+	opts.Header = header
+
+	// The request is sent like a download's, so it reports what the download would see
+	if len(proxy) != 0 {
+		opts.Proxy, err = parseProxyURL(proxy)
+		if err != nil {
+			return InvalidInputError{err}
+		}
+	}
+	if len(user) != 0 {
+		var ok bool
+		opts.Username, opts.Password, ok = strings.Cut(user, ":")
+		if !ok {
+			opts.Password, err = readPassword(opts.Username, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if netrc {
+		opts.NetrcFile, err = getNetrcPath()
+		if err != nil {
+			return InvalidInputError{fmt.Errorf("%w: %v", ErrInvalidNetrc, err)}
+		}
+	}
+	client, err := opts.newClient(w)
+	if err != nil {
+		return err
+	}
+	if opts.Insecure {
+		fmt.Fprintln(stderr, "Warning: TLS certificate verification is disabled, connections can be intercepted")
+	}
+	resp, err := sendHTTPHeadRequest(context.Background(), rawURL, client, opts.requestHeader())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	remote := newRemoteFile(rawURL, resp, guessExtension, false)
+	info := headInfo{
+		URL:           rawURL,
+		StatusCode:    remote.statusCode,
+		ContentLength: remote.contentLength,
+		ContentType:   resp.Header.Get("Content-Type"),
+		AcceptRanges:  remote.acceptRanges,
+		ETag:          remote.etag,
+		LastModified:  remote.lastModified,
+		Filename:      remote.filename,
+	}
+	if jsonOutput {
+		err := json.NewEncoder(w).Encode(info)
+		if err != nil {
+			return err
+		}
+	} else {
+		printHeadInfo(w, info)
+	}
+	if info.StatusCode >= http.StatusBadRequest {
+		return StatusError{StatusCode: info.StatusCode}
+	}
+	return nil
+}
+
+// printHeadInfo writes info to w, one field per line.
+func printHeadInfo(w io.Writer, info headInfo) {
+	contentLength := "unknown"
+	if info.ContentLength >= 0 {
+		contentLength = fmt.Sprintf("%d (%s)", info.ContentLength, formatByteSize(float64(info.ContentLength)))
+	}
+	acceptRanges := "no"
+	if info.AcceptRanges {
+		acceptRanges = "yes"
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "URL:\t%s\n", info.URL)
+	fmt.Fprintf(tw, "Status:\t%d %s\n", info.StatusCode, http.StatusText(info.StatusCode))
+	fmt.Fprintf(tw, "Content-Length:\t%s\n", contentLength)
+	fmt.Fprintf(tw, "Content-Type:\t%s\n", info.ContentType)
+	fmt.Fprintf(tw, "Accept-Ranges:\t%s\n", acceptRanges)
+	fmt.Fprintf(tw, "ETag:\t%s\n", info.ETag)
+	fmt.Fprintf(tw, "Last-Modified:\t%s\n", info.LastModified)
+	fmt.Fprintf(tw, "Filename:\t%s\n", info.Filename)
+	tw.Flush()
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleHead(t *testing.T) {
+	var method, accept, userAgent string
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/assets/report", func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		accept = r.Header.Get("Accept")
+		userAgent = r.UserAgent()
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/pdf")
+		http.ServeContent(w, r, "", modTime, strings.NewReader("hello"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	byteBuf := new(bytes.Buffer)
+	err := HandleHead(byteBuf, []string{"-header", "Accept: application/pdf", "-guess-extension", ts.URL + "/assets/report"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if method != http.MethodHead || accept != "application/pdf" || userAgent != DefaultUserAgent {
+		t.Fatalf("Expected a HEAD request with the given header, Got: %s with Accept %q and User-Agent %q", method, accept, userAgent)
+	}
+	expected := strings.Join([]string{
+		"URL:            " + ts.URL + "/assets/report",
+		"Status:         200 OK",
+		"Content-Length: 5 (5 B)",
+		"Content-Type:   application/pdf",
+		"Accept-Ranges:  yes",
+		`ETag:           "v1"`,
+		"Last-Modified:  Mon, 02 Jan 2023 03:04:05 GMT",
+		"Filename:       report.pdf",
+		"",
+	}, "\n")
+	if byteBuf.String() != expected {
+		t.Fatalf("Expected: %q, Got: %q", expected, byteBuf.String())
+	}
+
+	byteBuf.Reset()
+	err = HandleHead(byteBuf, []string{"-json", "-user-agent", "", ts.URL + "/assets/report"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if userAgent != "" {
+		t.Fatalf("Expected no User-Agent, Got: %q", userAgent)
+	}
+	var info headInfo
+	if err := json.Unmarshal(byteBuf.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentLength != 5 || !info.AcceptRanges || info.ETag != `"v1"` || info.Filename != "report" {
+		t.Fatalf("Expected the metadata of the file, Got: %s", byteBuf.String())
+	}
+
+	// The metadata is printed for error responses too
+	byteBuf.Reset()
+	err = HandleHead(byteBuf, []string{ts.URL + "/missing.txt"})
+	var statusErr StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a 404 status error, Got: %v", err)
+	}
+	if !strings.Contains(byteBuf.String(), "Status:         404 Not Found") {
+		t.Fatalf("Expected the status to be printed, Got: %q", byteBuf.String())
+	}
+}
+
+func TestHandleHeadClient(t *testing.T) {
+	var username, password string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+		w.Header().Set("Content-Length", "5")
+	}))
+	defer ts.Close()
+	stderr = new(bytes.Buffer)
+	defer func() { stderr = os.Stderr }()
+
+	// The server's certificate isn't trusted by default
+	err := HandleHead(new(bytes.Buffer), []string{ts.URL + "/a.txt"})
+	if err == nil {
+		t.Fatal("Expected a TLS error. Got nil")
+	}
+
+	// The request is sent with the TLS settings and credentials of a download
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	err = os.WriteFile(caCert, certPEM, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = HandleHead(new(bytes.Buffer), []string{"-cacert", caCert, "-user", "alice:secret", ts.URL + "/a.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if username != "alice" || password != "secret" {
+		t.Fatalf("Expected the credentials alice:secret, Got: %s:%s", username, password)
+	}
+	err = HandleHead(new(bytes.Buffer), []string{"-k", ts.URL + "/a.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+}
+
+func TestHandleHeadErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{[]string{}, ErrHeadArgs},
+		{[]string{"http://localhost/a.txt", "http://localhost/b.txt"}, ErrHeadArgs},
+		{[]string{"localhost/a.txt"}, ErrInvalidURL},
+		{[]string{"-header", "Accept", "http://localhost/a.txt"}, ErrInvalidHeader},
+		{[]string{"-proxy", "ftp://localhost", "http://localhost/a.txt"}, ErrInvalidProxy},
+	}
+	for _, tc := range tests {
+		err := HandleHead(new(bytes.Buffer), tc.args)
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, tc.err) {
+			t.Fatalf("%v: Expected %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
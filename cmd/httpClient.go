@@ -1,50 +1,216 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
 	"time"
 )
 
-// httpClient creates an HTTP client.
-func httpClient() *http.Client {
-	// redirectPolicyFunc does not follow redirection request
+// clientConfig configures the HTTP client created by httpClient.
+type clientConfig struct {
+	// maxRedirects is the number of redirects followed before a request fails
+	maxRedirects int
+	// proxy is the proxy requests go through, or nil to use the proxy set in the environment
+	proxy *url.URL
+	// tlsConfig is used for HTTPS connections, or nil to use the system defaults
+	tlsConfig *tls.Config
+	// verbose, if not nil, receives the details of every request and its response
+	verbose io.Writer
+	// disableCompression stops the client from asking for gzip compressed responses,
+	// so it doesn't decompress them either
+	disableCompression bool
+	// network is tcp4 or tcp6 to only connect over IPv4 or IPv6. Empty uses either
+	network string
+	// maxIdleConns idle connections are kept open for idleConnTimeout to be reused
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+	// disableHTTP2 makes connections only use HTTP/1.1
+	disableHTTP2 bool
+	// netrc, if not nil, holds the basic authentication credentials sent to each host
+	netrc netrcCredentials
+}
+
+// httpClient creates an HTTP client configured by config. Cookies set by responses are
+// stored and sent with later requests, so a cookie set before a redirect is sent to the
+// redirect target.
+func httpClient(config clientConfig) *http.Client {
+	// redirectPolicyFunc stops following redirects once maxRedirects is exceeded
 	redirectPolicyFunc := func(r *http.Request, via []*http.Request) error {
-		if len(via) >= 1 {
-			return errors.New("stopped after 1 redirect")
+		if len(via) > config.maxRedirects {
+			return fmt.Errorf("too many redirects, the limit is %d", config.maxRedirects)
 		}
 		return nil
 	}
 
+	proxy := http.ProxyFromEnvironment
+	if config.proxy != nil {
+		proxy = http.ProxyURL(config.proxy)
+	}
+
+	// Dial every connection over network, whatever the transport asks for
+	network := config.network
+	if len(network) == 0 {
+		network = "tcp"
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dialContext := func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
 	// Configure the connection pool
 	t := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          25,
-		IdleConnTimeout:       90 * time.Second,
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		ForceAttemptHTTP2:     !config.disableHTTP2,
+		MaxIdleConns:          config.maxIdleConns,
+		IdleConnTimeout:       config.idleConnTimeout,
 		TLSHandshakeTimeout:   10 * time.Second,
+		TLSClientConfig:       config.tlsConfig,
 		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    config.disableCompression,
 	}
 
+	if config.disableHTTP2 {
+		// A non-nil empty map stops the transport from negotiating HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	var transport http.RoundTripper = t
+	if config.netrc != nil {
+		transport = &netrcTransport{next: transport, credentials: config.netrc}
+	}
+	if config.verbose != nil {
+		transport = &loggingTransport{next: transport, w: config.verbose}
+	}
+
+	// cookiejar.New never returns an error
+	jar, _ := cookiejar.New(nil)
+
 	return &http.Client{
 		CheckRedirect: redirectPolicyFunc,
-		Transport:     t,
+		Transport:     transport,
+		Jar:           jar,
+	}
+}
+
+// loggingTransport is an http.RoundTripper that logs the details of every request,
+// including each redirect, and its response to w.
+type loggingTransport struct {
+	next http.RoundTripper
+	w    io.Writer
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(t.w, "%s %s: %v\n", req.Method, req.URL, err)
+		return nil, err
+	}
+
+	contentLength := "unknown"
+	if resp.ContentLength >= 0 {
+		contentLength = fmt.Sprint(resp.ContentLength)
+	}
+	acceptRanges := "no"
+	if resp.Header.Get("Accept-Ranges") == "bytes" {
+		acceptRanges = "yes"
+	}
+	fmt.Fprintf(t.w, "%s %s: %s (Content-Type: %s, Content-Length: %s, accepts ranges: %s)\n",
+		req.Method, req.URL, resp.Status, resp.Header.Get("Content-Type"), contentLength, acceptRanges)
+	return resp, nil
+}
+
+// isHTTPURL reports whether rawURL is an absolute http or https url.
+func isHTTPURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) != 0
+}
+
+// parseProxyURL parses a proxy url, which must use the http, https or socks5 scheme.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || len(proxyURL.Host) == 0 {
+		return nil, ErrInvalidProxy
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+		return proxyURL, nil
+	}
+	return nil, ErrInvalidProxy
+}
+
+// newTLSConfig returns the TLS configuration for HTTPS connections. Server certificates
+// are verified against caCertFile, a PEM bundle, if it is set, and aren't verified at
+// all if insecure is true. It returns nil to use the system defaults.
+func newTLSConfig(insecure bool, caCertFile string) (*tls.Config, error) {
+	if !insecure && len(caCertFile) == 0 {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if len(caCertFile) != 0 {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, InvalidInputError{fmt.Errorf("%w: %s", ErrInvalidCACert, caCertFile)}
+		}
+	}
+	return config, nil
+}
+
+// basicAuth returns the Authorization header value for HTTP basic authentication.
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// bearerAuth returns the Authorization header value for a bearer token.
+func bearerAuth(token string) string {
+	return "Bearer " + token
+}
+
+// setRequestHeader adds the given header fields to the request.
+func setRequestHeader(req *http.Request, header http.Header) {
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
 	}
 }
 
-// sendHTTPRequest sends an HTTP request and returns a response.
-func sendHTTPRequest(url string, client *http.Client) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+// sendHTTPRequestWithHeader sends an HTTP GET request for a file and returns a response.
+// fileSize is the number of bytes of the file already downloaded. If it is positive, the
+// rest of the file is requested with a Range header to resume the download, otherwise the
+// whole file is requested. If ifRange is set, it is sent as the If-Range header of the range
+// request, so the server sends the whole file instead if it no longer matches.
+func sendHTTPRequestWithHeader(ctx context.Context, url string, client *http.Client, header http.Header, fileSize int64, ifRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	setRequestHeader(req, header)
+
+	// Resume from the bytes already downloaded, unless the user has explicitly set their own Range
+	if fileSize > 0 && len(header.Values("Range")) == 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", fileSize))
+		if len(ifRange) != 0 {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -53,17 +219,30 @@ func sendHTTPRequest(url string, client *http.Client) (*http.Response, error) {
 	return resp, nil
 }
 
-// sendHTTPRequestWithHeader sends an HTTP request with range header and returns a response.
-func sendHTTPRequestWithHeader(url string, client *http.Client, fileSize int64) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+// sendHTTPRequestWithBody sends an HTTP request with the given method and body, which may
+// be nil, and returns a response.
+func sendHTTPRequestWithBody(ctx context.Context, method, url string, client *http.Client, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
+	setRequestHeader(req, header)
 
-	// Set range header to the request if file already exists at destination path
-	if fileSize > 0 {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", fileSize))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	return resp, nil
+}
+
+// sendHTTPRangeRequest sends an HTTP request for the bytes from start to end inclusive and returns a response.
+func sendHTTPRangeRequest(ctx context.Context, url string, client *http.Client, header http.Header, start, end int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestHeader(req, header)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -73,15 +252,16 @@ func sendHTTPRequestWithHeader(url string, client *http.Client, fileSize int64)
 }
 
 // sendHTTPHeadRequest sends an HTTP HEAD request and returns a response.
-func sendHTTPHeadRequest(url string, client *http.Client) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodHead, url, nil)
+func sendHTTPHeadRequest(ctx context.Context, url string, client *http.Client, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	setRequestHeader(req, header)
 
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
-}
\ No newline at end of file
+}
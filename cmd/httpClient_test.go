@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHTTPClient(t *testing.T) {
+	proxyURL, _ := url.Parse("http://proxy.example.com:3128")
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	verbose := new(bytes.Buffer)
+	client := httpClient(clientConfig{
+		maxRedirects:       2,
+		proxy:              proxyURL,
+		tlsConfig:          tlsConfig,
+		verbose:            verbose,
+		disableCompression: true,
+		network:            "tcp4",
+		maxIdleConns:       7,
+		idleConnTimeout:    5 * time.Second,
+		disableHTTP2:       true,
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://files.example.com/file.txt", nil)
+	if err := client.CheckRedirect(req, make([]*http.Request, 2)); err != nil {
+		t.Fatalf("Expected 2 redirects to be followed, Got: %v", err)
+	}
+	if err := client.CheckRedirect(req, make([]*http.Request, 3)); err == nil {
+		t.Fatal("Expected a third redirect to fail, Got: nil")
+	}
+	if client.Jar == nil {
+		t.Fatal("Expected a cookie jar")
+	}
+
+	logging, ok := client.Transport.(*loggingTransport)
+	if !ok || logging.w != verbose {
+		t.Fatalf("Expected requests to be logged to verbose, Got: %T", client.Transport)
+	}
+	transport := logging.next.(*http.Transport)
+	if proxy, err := transport.Proxy(req); err != nil || proxy.String() != proxyURL.String() {
+		t.Fatalf("Expected proxy %v, Got: %v, %v", proxyURL, proxy, err)
+	}
+	if transport.TLSClientConfig != tlsConfig {
+		t.Fatal("Expected the given TLS config")
+	}
+	if !transport.DisableCompression {
+		t.Fatal("Expected compression to be disabled")
+	}
+	if transport.MaxIdleConns != 7 || transport.IdleConnTimeout != 5*time.Second {
+		t.Fatalf("Expected 7 idle connections kept for 5s, Got: %d for %v", transport.MaxIdleConns, transport.IdleConnTimeout)
+	}
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil || len(transport.TLSNextProto) != 0 {
+		t.Fatal("Expected HTTP/2 to be disabled")
+	}
+
+	// The listener only accepts IPv4 connections
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := transport.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected an IPv4 connection, Got: %v", err)
+	}
+	conn.Close()
+
+	client = httpClient(clientConfig{network: "tcp6"})
+	transport = client.Transport.(*http.Transport)
+	_, err = transport.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err == nil {
+		t.Fatal("Expected an IPv6 connection to an IPv4 address to fail, Got: nil")
+	}
+}
+
+func TestHTTPClientDefaults(t *testing.T) {
+	client := httpClient(clientConfig{maxIdleConns: DefaultMaxIdleConns, idleConnTimeout: DefaultIdleConnTimeout})
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected requests not to be logged, Got: %T", client.Transport)
+	}
+	if transport.TLSClientConfig != nil || transport.DisableCompression {
+		t.Fatal("Expected the default TLS config and compression")
+	}
+	if !transport.ForceAttemptHTTP2 || transport.TLSNextProto != nil {
+		t.Fatal("Expected HTTP/2 to be enabled")
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://files.example.com/file.txt", nil)
+	if err := client.CheckRedirect(req, make([]*http.Request, 1)); err == nil {
+		t.Fatal("Expected no redirects to be followed, Got: nil")
+	}
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := transport.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected a connection over either IP version, Got: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSendHTTPRequestWithHeader(t *testing.T) {
+	var rangeHeader, ifRange string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader = r.Header.Get("Range")
+		ifRange = r.Header.Get("If-Range")
+	}))
+	defer ts.Close()
+
+	testCases := []struct {
+		fileSize      int64
+		ifRange       string
+		header        http.Header
+		expectedRange string
+		expectedIf    string
+	}{
+		{fileSize: 0, ifRange: `"v1"`},
+		{fileSize: 1, expectedRange: "bytes=1-"},
+		{fileSize: 1000, ifRange: `"v1"`, expectedRange: "bytes=1000-", expectedIf: `"v1"`},
+		{fileSize: 1000, header: http.Header{"Range": {"bytes=0-99"}}, expectedRange: "bytes=0-99"},
+	}
+	for _, tc := range testCases {
+		resp, err := sendHTTPRequestWithHeader(context.Background(), ts.URL, ts.Client(), tc.header, tc.fileSize, tc.ifRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if rangeHeader != tc.expectedRange || ifRange != tc.expectedIf {
+			t.Fatalf("%d bytes downloaded: Expected Range %q and If-Range %q, Got: %q and %q", tc.fileSize, tc.expectedRange, tc.expectedIf, rangeHeader, ifRange)
+		}
+	}
+}
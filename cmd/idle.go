@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// idleReader wraps a response body and closes it if a single Read blocks for longer than
+// timeout, so a server that stops sending data without closing the connection can't stall
+// a download forever. Only time spent waiting for data counts, not time spent between reads.
+type idleReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	// stalled is set to 1 once the timer has closed body
+	stalled int32
+}
+
+// newIdleReader returns body wrapped in an idleReader, or body itself if timeout is 0.
+func newIdleReader(body io.ReadCloser, timeout time.Duration) io.ReadCloser {
+	if timeout <= 0 {
+		return body
+	}
+	r := &idleReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.stalled, 1)
+		body.Close()
+	})
+	r.timer.Stop()
+	return r
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	if atomic.LoadInt32(&r.stalled) == 1 {
+		return n, fmt.Errorf("%w: no data received for %v", ErrStalled, r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
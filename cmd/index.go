@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// hrefPattern matches the href attribute of an <a> tag, quoted with either quote or not at all.
+// Directory listings are simple enough that this finds every link without parsing the HTML.
+var hrefPattern = regexp.MustCompile(`(?is)<a\s[^>]*?\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// maxIndexSize caps how much of an index page is read.
+const maxIndexSize = 16 << 20
+
+// extractLinks returns the links of the <a> tags in the HTML page r, resolved against base.
+// Links that can't be parsed are skipped, and the fragment of each link is dropped.
+func extractLinks(r io.Reader, base *url.URL) ([]*url.URL, error) {
+	page, err := io.ReadAll(io.LimitReader(r, maxIndexSize))
+	if err != nil {
+		return nil, err
+	}
+	var links []*url.URL
+	for _, match := range hrefPattern.FindAllSubmatch(page, -1) {
+		href := string(match[1]) + string(match[2]) + string(match[3])
+		link, err := base.Parse(html.UnescapeString(strings.TrimSpace(href)))
+		if err != nil {
+			continue
+		}
+		link.Fragment = ""
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// maxSyncPages caps the number of pages fetched from each index page, which stops a
+// deep -level from crawling a large site.
+var maxSyncPages = 1000
+
+// isPageLink reports whether link is followed as a page listing further links, either a
+// directory such as docs/ or an HTML page.
+func isPageLink(link *url.URL) bool {
+	ext := strings.ToLower(path.Ext(link.Path))
+	return strings.HasSuffix(link.Path, "/") || ext == ".html" || ext == ".htm"
+}
+
+// indexCrawler follows the links of index pages to the files they list.
+type indexCrawler struct {
+	client *http.Client
+	header http.Header
+	config *downloadConfig
+	// files holds the url of every file found, so each is only downloaded once
+	files map[string]bool
+	urls  []string
+	// paths holds the directory of each of urls relative to the index page it was found
+	// under, such as docs/
+	paths []string
+}
+
+// syncIndexes replaces the urls of config, which are index pages such as the listing of a
+// directory, with the urls of the files they list. Subdirectories and HTML pages linked
+// from the index are followed up to config.level links deep, and the files found are saved
+// in the same directories relative to the download location. Each page is requested with
+// the same client, headers and credentials as the downloads, within the Timeout of config.
+func syncIndexes(ctx context.Context, config *downloadConfig) error {
+	client, err := config.newClient(config.Output)
+	if err != nil {
+		return err
+	}
+	c := &indexCrawler{
+		client: client,
+		header: config.requestHeader(),
+		config: config,
+		files:  make(map[string]bool),
+	}
+	for _, rawURL := range config.URLs {
+		err := c.crawl(ctx, rawURL, config.level)
+		if err != nil {
+			return err
+		}
+	}
+	config.URLs = c.urls
+	config.Paths = c.paths
+	return nil
+}
+
+// crawl adds the files linked from the index page at rawURL, following the pages it links
+// to up to level links deep. Only links on the same host and inside the directory of the
+// index are kept, which skips the parent directory and the links back to a page itself,
+// such as ?C=N;O=D to sort the listing.
+func (c *indexCrawler) crawl(ctx context.Context, rawURL string, level int) error {
+	type page struct {
+		url   string
+		depth int
+	}
+	queue := []page{{rawURL, 0}}
+	visited := make(map[string]bool)
+	var root *url.URL
+	var dir string
+	found := len(c.urls)
+	var fetched int
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if fetched >= maxSyncPages {
+			return InvalidInputError{fmt.Errorf("%w %s: more than %d pages found, specify a lower -level", ErrFetchIndex, rawURL, maxSyncPages)}
+		}
+		base, links, err := c.fetch(ctx, p.url)
+		if err != nil {
+			return err
+		}
+		fetched++
+		// A page that redirects outside the directory isn't followed
+		if root != nil && (base.Host != root.Host || !strings.HasPrefix(base.Path, dir)) {
+			continue
+		}
+
+		// Everything is kept inside the directory of the page the crawl started from
+		if root == nil {
+			root = base
+			dir = base.Path[:strings.LastIndex(base.Path, "/")+1]
+		}
+		visited[pageKey(base)] = true
+
+		for _, link := range links {
+			if link.Scheme != root.Scheme || link.Host != root.Host || link.Path == base.Path {
+				continue
+			}
+			if !strings.HasPrefix(link.Path, dir) || len(link.Path) == len(dir) {
+				continue
+			}
+			if isPageLink(link) && p.depth < level && !visited[pageKey(link)] {
+				visited[pageKey(link)] = true
+				queue = append(queue, page{link.String(), p.depth + 1})
+			}
+			if strings.HasSuffix(link.Path, "/") || c.files[link.String()] {
+				continue
+			}
+			c.files[link.String()] = true
+			c.urls = append(c.urls, link.String())
+			c.paths = append(c.paths, strings.TrimPrefix(link.Path[:strings.LastIndex(link.Path, "/")+1], dir))
+		}
+	}
+	if len(c.urls) == found {
+		return InvalidInputError{fmt.Errorf("%w %s: no files listed", ErrFetchIndex, rawURL)}
+	}
+	return nil
+}
+
+// pageKey identifies a page by its url without the query, so the links that sort a
+// listing don't make it visited again.
+func pageKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// fetch requests the page at rawURL and returns its url after any redirect, such as from
+// /dir to /dir/, and the links it holds, which are resolved against that url.
+func (c *indexCrawler) fetch(ctx context.Context, rawURL string) (*url.URL, []*url.URL, error) {
+	pageCtx := ctx
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		pageCtx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(pageCtx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, InvalidInputError{fmt.Errorf("%w %s: %v", ErrFetchIndex, rawURL, err)}
+	}
+	req.Header = c.header.Clone()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		// Report Ctrl-C or the deadline as such, rather than as a page that can't be fetched
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, InvalidInputError{fmt.Errorf("%w %s: %v", ErrFetchIndex, rawURL, err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, InvalidInputError{fmt.Errorf("%w %s: %d %s", ErrFetchIndex, rawURL, resp.StatusCode, http.StatusText(resp.StatusCode))}
+	}
+	links, err := extractLinks(resp.Body, resp.Request.URL)
+	if err != nil {
+		return nil, nil, InvalidInputError{fmt.Errorf("%w %s: %v", ErrFetchIndex, rawURL, err)}
+	}
+	return resp.Request.URL, links, nil
+}
@@ -0,0 +1,309 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const indexPage = `<html><body>
+<h1>Index of /files</h1>
+<a href="?C=N;O=D">Name</a> <a href='?C=M;O=A'>Last modified</a>
+<a href="/">Parent Directory</a>
+<a href="../">Parent Directory</a>
+<a href="a.txt">a.txt</a>
+<A HREF=b.txt>b.txt</A>
+<a class="file" href="c%20d.txt#top">c d.txt</a>
+<a href="/files/e.txt?v=1&amp;dl=1">e.txt</a>
+<a href="a.txt">a.txt again</a>
+<a href="docs/">docs/</a>
+<a href="http://other.example.com/files/f.txt">elsewhere</a>
+<a href="mailto:admin@example.com">admin</a>
+</body></html>`
+
+func TestExtractLinks(t *testing.T) {
+	base, err := url.Parse("http://example.com/files/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := extractLinks(strings.NewReader(indexPage), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"http://example.com/files/?C=N;O=D",
+		"http://example.com/files/?C=M;O=A",
+		"http://example.com/",
+		"http://example.com/",
+		"http://example.com/files/a.txt",
+		"http://example.com/files/b.txt",
+		"http://example.com/files/c%20d.txt",
+		"http://example.com/files/e.txt?v=1&dl=1",
+		"http://example.com/files/a.txt",
+		"http://example.com/files/docs/",
+		"http://other.example.com/files/f.txt",
+		"mailto:admin@example.com",
+	}
+	var got []string
+	for _, link := range links {
+		got = append(got, link.String())
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected: %v, Got: %v", expected, got)
+	}
+}
+
+func TestHandleDownloadSync(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files/" {
+			fmt.Fprint(w, indexPage)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	})
+	mux.HandleFunc("/empty/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><a href="../">Parent Directory</a></html>`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// The index is requested without its trailing slash, and links are resolved
+	// against the page it redirects to
+	location := t.TempDir()
+	err := HandleDownload(new(bytes.Buffer), []string{"-sync", "-location", location, ts.URL + "/files"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	entries, err := os.ReadDir(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if expected := []string{"a.txt", "b.txt", "c d.txt", "e.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected: %v, Got: %v", expected, names)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "b.txt"))
+	if err != nil || string(data) != "/files/b.txt" {
+		t.Fatalf("Expected b.txt to contain /files/b.txt, Got: %q, %v", data, err)
+	}
+
+	urlFile := filepath.Join(t.TempDir(), "urls.txt")
+	err = os.WriteFile(urlFile, []byte(ts.URL+"/files/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"-sync", ts.URL + "/empty/"}, ErrFetchIndex},
+		{[]string{"-sync", ts.URL + "/missing/"}, ErrFetchIndex},
+		{[]string{"-sync", "-url-file", urlFile}, ErrSyncURLFile},
+		{[]string{"-sync", "-o", "file.txt", ts.URL + "/files/"}, ErrSyncSingleFile},
+	}
+	for _, tc := range tests {
+		err := HandleDownload(new(bytes.Buffer), append([]string{"-location", t.TempDir()}, tc.args...))
+		var inputErr InvalidInputError
+		if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, tc.err) {
+			t.Fatalf("%v: Expected %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHandleDownloadSyncLevel(t *testing.T) {
+	pages := map[string]string{
+		"/site/":                  `<a href="a.txt">a</a> <a href="docs/">docs</a> <a href="about.html">about</a> <a href="/">home</a>`,
+		"/site/docs/":             `<a href="../">up</a> <a href="b.txt">b</a> <a href="more/">more</a> <a href="/site/">site</a>`,
+		"/site/docs/more/":        `<a href="c.txt">c</a> <a href="deeper/">deeper</a>`,
+		"/site/docs/more/deeper/": `<a href="d.txt">d</a>`,
+		"/site/about.html":        `<a href="a.txt">a</a> <a href="/site/">site</a> <a href="/other/e.txt">e</a>`,
+		"/":                       `<a href="site/">site</a> <a href="other/e.txt">e</a>`,
+	}
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			requests[r.URL.Path]++
+			mu.Unlock()
+		}
+		if page, ok := pages[r.URL.Path]; ok {
+			fmt.Fprint(w, page)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		level    int
+		expected []string
+	}{
+		{0, []string{"a.txt", "about.html"}},
+		{1, []string{"a.txt", "about.html", "docs/b.txt"}},
+		{2, []string{"a.txt", "about.html", "docs/b.txt", "docs/more/c.txt"}},
+		{5, []string{"a.txt", "about.html", "docs/b.txt", "docs/more/c.txt", "docs/more/deeper/d.txt"}},
+	}
+	for _, tc := range tests {
+		mu.Lock()
+		requests = make(map[string]int)
+		mu.Unlock()
+		location := t.TempDir()
+		err := HandleDownload(new(bytes.Buffer), []string{"-sync", "-level", strconv.Itoa(tc.level), "-location", location, ts.URL + "/site/"})
+		if err != nil {
+			t.Fatalf("%d: Expected nil error. Got: %v", tc.level, err)
+		}
+		var got []string
+		err = filepath.WalkDir(location, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				rel, _ := filepath.Rel(location, path)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("%d: Expected: %v, Got: %v", tc.level, tc.expected, got)
+		}
+
+		// Pages linking back to each other are only requested once, and nothing
+		// outside the directory of the index is requested
+		mu.Lock()
+		for path, n := range requests {
+			if !strings.HasPrefix(path, "/site/") {
+				t.Errorf("%d: Expected no request outside /site/, Got: %s", tc.level, path)
+			}
+			if pages[path] != "" && n > 2 {
+				t.Errorf("%d: Expected %s to be fetched at most twice, as a page and a file, Got: %d", tc.level, path, n)
+			}
+		}
+		mu.Unlock()
+	}
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-level", "1", ts.URL + "/site/"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrLevelWithoutSync) {
+		t.Fatalf("Expected ErrLevelWithoutSync, Got: %v", err)
+	}
+	err = HandleDownload(new(bytes.Buffer), []string{"-sync", "-level", "-1", ts.URL + "/site/"})
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidLevel) {
+		t.Fatalf("Expected ErrInvalidLevel, Got: %v", err)
+	}
+}
+
+func TestHandleDownloadSyncClient(t *testing.T) {
+	var mu sync.Mutex
+	var userAgent, cookie string
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files/" {
+			mu.Lock()
+			userAgent, cookie = r.UserAgent(), r.Header.Get("Cookie")
+			mu.Unlock()
+			fmt.Fprint(w, `<a href="a.txt">a.txt</a>`)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	})
+	mux.HandleFunc("/slow/", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+	defer close(release)
+
+	// Index pages are requested with the TLS settings, User-Agent and cookies of the downloads
+	err := HandleDownload(new(bytes.Buffer), []string{"-sync", "-location", t.TempDir(), ts.URL + "/files/"})
+	if err == nil {
+		t.Fatal("Expected the self-signed certificate to be rejected, Got: nil")
+	}
+	location := t.TempDir()
+	err = HandleDownload(new(bytes.Buffer), []string{"-sync", "-k", "-user-agent", "tester/1.0", "-cookie", "session=42", "-location", location, ts.URL + "/files/"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	mu.Lock()
+	gotUserAgent, gotCookie := userAgent, cookie
+	mu.Unlock()
+	if gotUserAgent != "tester/1.0" || gotCookie != "session=42" {
+		t.Fatalf("Expected the User-Agent and cookie to be sent, Got: %q, %q", gotUserAgent, gotCookie)
+	}
+	if _, err := os.Stat(filepath.Join(location, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A page that doesn't respond fails within -timeout
+	start := time.Now()
+	err = HandleDownload(new(bytes.Buffer), []string{"-sync", "-k", "-timeout", "100ms", "-location", t.TempDir(), ts.URL + "/slow/"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrFetchIndex) {
+		t.Fatalf("Expected ErrFetchIndex, Got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the page to time out, Got: %v", elapsed)
+	}
+}
+
+func TestHandleDownloadSyncMaxPages(t *testing.T) {
+	defer func(max int) { maxSyncPages = max }(maxSyncPages)
+	maxSyncPages = 5
+
+	// Every page links to three more, so the pages found grow much faster than
+	// the pages fetched
+	var mu sync.Mutex
+	var pages int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			fmt.Fprint(w, r.URL.Path)
+			return
+		}
+		mu.Lock()
+		pages++
+		mu.Unlock()
+		fmt.Fprint(w, `<a href="file.txt">file</a> <a href="a/">a</a> <a href="b/">b</a> <a href="c/">c</a>`)
+	}))
+	defer ts.Close()
+
+	err := HandleDownload(new(bytes.Buffer), []string{"-sync", "-level", "10", "-location", t.TempDir(), ts.URL + "/site/"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrFetchIndex) || !strings.Contains(err.Error(), "more than 5 pages") {
+		t.Fatalf("Expected ErrFetchIndex for more than 5 pages, Got: %v", err)
+	}
+	mu.Lock()
+	fetched := pages
+	mu.Unlock()
+	if fetched != 5 {
+		t.Fatalf("Expected 5 pages to be fetched, Got: %d", fetched)
+	}
+
+	// A crawl within the cap isn't affected
+	err = HandleDownload(new(bytes.Buffer), []string{"-sync", "-level", "1", "-location", t.TempDir(), ts.URL + "/site/"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// partialDownload is a download whose .part file is waiting to be resumed.
+type partialDownload struct {
+	// Path is where the file is saved once complete
+	Path string `json:"path"`
+	// URL is empty if the sidecar file is missing or can't be parsed
+	URL   string `json:"url,omitempty"`
+	Bytes int64  `json:"bytes"`
+	// Size is -1 if it is unknown
+	Size int64 `json:"size"`
+	// Percent is omitted if the size is unknown
+	Percent *float64 `json:"percent,omitempty"`
+}
+
+// findPartialDownloads returns the downloads with a .part file or segment files in
+// location and its sub-directories, sorted by path. The bytes of a segmented download
+// are those of all its segment files. Their url and size are read from their sidecar
+// files, and are unknown if the sidecar file is missing or can't be parsed.
+func findPartialDownloads(location string) ([]partialDownload, error) {
+	var downloads []partialDownload
+	// found holds the index in downloads of each download, as the files of a segmented
+	// download are listed one after another
+	found := make(map[string]int)
+	err := filepath.WalkDir(location, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		downloadPath, ok := trimPartPath(path)
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if i, ok := found[downloadPath]; ok {
+			downloads[i].Bytes += info.Size()
+			return nil
+		}
+		download := partialDownload{Path: downloadPath, Bytes: info.Size(), Size: -1}
+		meta, err := readResumeMeta(download.Path)
+		if err == nil && meta != nil {
+			download.URL = meta.URL
+			download.Size = meta.Size
+		}
+		found[downloadPath] = len(downloads)
+		downloads = append(downloads, download)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, InvalidInputError{fmt.Errorf("%w: %s", ErrLocationNotExist, location)}
+	}
+	for i := range downloads {
+		if downloads[i].Size > 0 {
+			percent := float64(downloads[i].Bytes) / float64(downloads[i].Size) * 100
+			downloads[i].Percent = &percent
+		}
+	}
+	return downloads, err
+}
+
+// HandleList handles the list sub-command, which prints the url, bytes downloaded, size
+// and percent complete of every partial download in the download location.
+func HandleList(w io.Writer, args []string) error {
+	var location string
+	var jsonOutput bool
+
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	flags.SetOutput(w)
+	flags.StringVar(&location, "location", DefaultLocation, "Download location to list")
+	flags.BoolVar(&jsonOutput, "json", false, "Print each partial download as a JSON object on its own line")
+	flags.Usage = func() {
+		var usageString = `
+list: A sub-command for listing partial downloads that can be resumed
+
+list: <options>`
+		fmt.Fprint(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "options: ")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return FlagParsingError{err}
+	}
+	if flags.NArg() != 0 {
+		return InvalidInputError{ErrListArgs}
+	}
+
+	downloads, err := findPartialDownloads(location)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(w)
+		for _, download := range downloads {
+			if err := enc.Encode(download); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(downloads) == 0 {
+		fmt.Fprintf(w, "No partial downloads found in %s\n", location)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tURL\tDOWNLOADED\tSIZE\tPERCENT")
+	for _, download := range downloads {
+		url, size, percent := "unknown", "unknown", "-"
+		if len(download.URL) != 0 {
+			url = download.URL
+		}
+		if download.Size >= 0 {
+			size = formatByteSize(float64(download.Size))
+		}
+		if download.Percent != nil {
+			percent = fmt.Sprintf("%.1f%%", *download.Percent)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", download.Path, url, formatByteSize(float64(download.Bytes)), size, percent)
+	}
+	tw.Flush()
+	return nil
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandleList(t *testing.T) {
+	location := t.TempDir()
+	files := map[string]string{
+		"go.pdf.part":        "hello",
+		"go.pdf.dlmeta":      `{"url":"http://localhost/go.pdf","size":20,"bytes_written":5}`,
+		"stream.bin.part":    "hello",
+		"stream.bin.dlmeta":  `{"url":"http://localhost/stream.bin","size":-1,"bytes_written":5}`,
+		"corrupt.txt.part":   "hello",
+		"corrupt.txt.dlmeta": "{",
+		"orphan.txt.part":    "hello",
+		"video.mp4.part":     "",
+		"video.mp4.part0":    "hello",
+		"video.mp4.part1":    "hello",
+		"video.mp4.dlmeta":   `{"url":"http://localhost/video.mp4","size":40,"bytes_written":0}`,
+		"notes.party":        "hello",
+		"done.txt":           "hello",
+	}
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(location, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byteBuf := new(bytes.Buffer)
+	err := HandleList(byteBuf, []string{"-location", location})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(byteBuf.String()), "\n")
+	expected := [][]string{
+		{"FILE", "URL", "DOWNLOADED", "SIZE", "PERCENT"},
+		{filepath.Join(location, "corrupt.txt"), "unknown", "5", "B", "unknown", "-"},
+		{filepath.Join(location, "go.pdf"), "http://localhost/go.pdf", "5", "B", "20", "B", "25.0%"},
+		{filepath.Join(location, "orphan.txt"), "unknown", "5", "B", "unknown", "-"},
+		{filepath.Join(location, "stream.bin"), "http://localhost/stream.bin", "5", "B", "unknown", "-"},
+		{filepath.Join(location, "video.mp4"), "http://localhost/video.mp4", "10", "B", "40", "B", "25.0%"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, Got: %q", len(expected), lines)
+	}
+	for i, fields := range expected {
+		if got := strings.Fields(lines[i]); strings.Join(got, " ") != strings.Join(fields, " ") {
+			t.Fatalf("Expected: %q, Got: %q", fields, got)
+		}
+	}
+
+	byteBuf.Reset()
+	err = HandleList(byteBuf, []string{"-location", location, "-json"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	lines = strings.Split(strings.TrimSpace(byteBuf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 JSON lines, Got: %q", lines)
+	}
+	var download partialDownload
+	if err := json.Unmarshal([]byte(lines[1]), &download); err != nil {
+		t.Fatal(err)
+	}
+	if download.URL != "http://localhost/go.pdf" || download.Bytes != 5 || download.Size != 20 || download.Percent == nil || *download.Percent != 25 {
+		t.Fatalf("Expected go.pdf 25%% complete, Got: %s", lines[1])
+	}
+	if strings.Contains(lines[0], "percent") || strings.Contains(lines[0], "url") {
+		t.Fatalf("Expected no url or percent for a corrupt sidecar file, Got: %s", lines[0])
+	}
+}
+
+func TestHandleListErrors(t *testing.T) {
+	byteBuf := new(bytes.Buffer)
+	location := t.TempDir()
+	err := HandleList(byteBuf, []string{"-location", location})
+	if err != nil || byteBuf.String() != "No partial downloads found in "+location+"\n" {
+		t.Fatalf("Expected nothing to list, Got: %v, %q", err, byteBuf.String())
+	}
+
+	byteBuf.Reset()
+	err = HandleList(byteBuf, []string{"-location", location, "-json"})
+	if err != nil || byteBuf.Len() != 0 {
+		t.Fatalf("Expected no JSON output, Got: %v, %q", err, byteBuf.String())
+	}
+
+	err = HandleList(byteBuf, []string{"-location", filepath.Join(t.TempDir(), "missing")})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrLocationNotExist) {
+		t.Fatalf("Expected ErrLocationNotExist, Got: %v", err)
+	}
+
+	err = HandleList(byteBuf, []string{"downloads"})
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrListArgs) {
+		t.Fatalf("Expected ErrListArgs, Got: %v", err)
+	}
+}
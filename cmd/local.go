@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// isFileURL reports whether rawURL is a file:// url naming a local file.
+func isFileURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "file" && len(u.Path) != 0
+}
+
+// localPath returns the path of the local file named by the file:// url rawURL.
+func localPath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// lookupLocalFile is lookup for a file:// url. The file is reported as not found,
+// like a 404 response, if it doesn't exist or is a directory.
+func lookupLocalFile(rawURL string) (remoteFile, error) {
+	remote := remoteFile{source: rawURL, contentLength: -1, filename: getURLFileName(rawURL, false), statusCode: http.StatusOK}
+	path, err := localPath(rawURL)
+	if err != nil {
+		return remote, err
+	}
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		remote.statusCode = http.StatusNotFound
+		return remote, nil
+	case err != nil:
+		return remote, err
+	case info.IsDir():
+		remote.statusCode = http.StatusNotFound
+		return remote, nil
+	}
+	remote.contentLength = info.Size()
+	remote.lastModified = info.ModTime().UTC().Format(http.TimeFormat)
+	return remote, nil
+}
+
+// openLocalFile opens the local file named by the file:// url rawURL from offset onwards.
+// It is returned as the response to a request for the file, so that it is written and
+// resumed like a downloaded file: a 206 response with a Content-Range if offset is past
+// the start of the file, and a 200 response otherwise.
+func openLocalFile(rawURL string, offset int64) (*http.Response, error) {
+	path, err := localPath(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	size := info.Size()
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          file,
+		ContentLength: size,
+	}
+	if offset > 0 && offset < size {
+		_, err := file.Seek(offset, io.SeekStart)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		resp.StatusCode = http.StatusPartialContent
+		resp.ContentLength = size - offset
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	}
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	return resp, nil
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+)
+
+// Log levels, see DownloadOptions.LogLevel.
+const (
+	// LogError only writes the outcome of each download and warnings that can't be ignored.
+	LogError = "error"
+	// LogInfo also writes when each download starts or is skipped, and other warnings.
+	LogInfo = "info"
+	// LogDebug also writes every request, its response, where each download resumes
+	// and each retry.
+	LogDebug = "debug"
+)
+
+// logLevels orders the log levels, from the fewest messages to the most.
+var logLevels = map[string]int{LogError: 0, LogInfo: 1, LogDebug: 2}
+
+// logger writes the messages of the enabled log levels to w. A nil logger writes nothing.
+type logger struct {
+	w     io.Writer
+	level int
+}
+
+// newLogger returns a logger writing the messages of level, one of the log levels, and
+// the levels below it to w.
+func newLogger(w io.Writer, level string) *logger {
+	return &logger{w: w, level: logLevels[level]}
+}
+
+// infof writes a message at LogInfo level, followed by a newline.
+func (l *logger) infof(format string, args ...interface{}) {
+	l.logf(logLevels[LogInfo], "", format, args...)
+}
+
+// debugf writes a message at LogDebug level, followed by a newline.
+func (l *logger) debugf(format string, args ...interface{}) {
+	l.logf(logLevels[LogDebug], "debug: ", format, args...)
+}
+
+func (l *logger) logf(level int, prefix, format string, args ...interface{}) {
+	if l == nil || level > l.level {
+		return
+	}
+	fmt.Fprintf(l.w, prefix+format+"\n", args...)
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcEnv is the environment variable naming the netrc file used instead of ~/.netrc.
+const netrcEnv = "NETRC"
+
+// netrcEntry holds the credentials of a machine in a netrc file.
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// netrcCredentials maps the host of each machine in a netrc file to its credentials.
+// The entry of the default machine, if any, is stored under the empty host.
+type netrcCredentials map[string]netrcEntry
+
+// lookup returns the credentials for host, or those of the default machine if host has none.
+func (c netrcCredentials) lookup(host string) (netrcEntry, bool) {
+	if entry, ok := c[host]; ok {
+		return entry, true
+	}
+	entry, ok := c[""]
+	return entry, ok
+}
+
+// getNetrcPath returns the path of the netrc file: $NETRC if it is set, otherwise ~/.netrc.
+func getNetrcPath() (string, error) {
+	if path := os.Getenv(netrcEnv); len(path) != 0 {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".netrc"), nil
+}
+
+// readNetrc reads the netrc file at path.
+func readNetrc(path string) (netrcCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, InvalidInputError{fmt.Errorf("%w: %v", ErrInvalidNetrc, err)}
+	}
+	defer f.Close()
+	credentials, err := parseNetrc(f)
+	if err != nil {
+		return nil, InvalidInputError{fmt.Errorf("%w: %v in %s", ErrInvalidNetrc, err, path)}
+	}
+	return credentials, nil
+}
+
+// parseNetrc parses the machine, default, login and password tokens of a netrc file. Other
+// tokens, such as account, are skipped along with their value, and macro definitions are
+// skipped up to the blank line that ends them.
+func parseNetrc(r io.Reader) (netrcCredentials, error) {
+	credentials := make(netrcCredentials)
+	var host string
+	var entry *netrcEntry
+	inMacro := false
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if inMacro {
+			inMacro = len(fields) != 0
+			continue
+		}
+		for i := 0; i < len(fields); i++ {
+			token := fields[i]
+			if token == "default" {
+				host = ""
+				entry = &netrcEntry{}
+				credentials[host] = *entry
+				continue
+			}
+			if strings.HasPrefix(token, "#") && i == 0 {
+				break
+			}
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("missing value for %s on line %d", token, lineNum)
+			}
+			i++
+			value := fields[i]
+			switch token {
+			case "machine":
+				host = value
+				entry = &netrcEntry{}
+			case "login":
+				if entry == nil {
+					return nil, fmt.Errorf("login outside of a machine on line %d", lineNum)
+				}
+				entry.login = value
+			case "password":
+				if entry == nil {
+					return nil, fmt.Errorf("password outside of a machine on line %d", lineNum)
+				}
+				entry.password = value
+			case "macdef":
+				// The macro runs to the next blank line
+				inMacro = true
+				i = len(fields)
+				continue
+			}
+			if entry != nil {
+				credentials[host] = *entry
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// netrcTransport is an http.RoundTripper that sends the credentials of the host of every
+// request, including each redirect, using basic authentication. Requests that already have
+// an Authorization header are sent as they are.
+type netrcTransport struct {
+	next        http.RoundTripper
+	credentials netrcCredentials
+}
+
+func (t *netrcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Values("Authorization")) == 0 {
+		if entry, ok := t.credentials.lookup(req.URL.Hostname()); ok {
+			// A RoundTripper must not modify the request it is given
+			req = req.Clone(req.Context())
+			req.SetBasicAuth(entry.login, entry.password)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	netrc := `# credentials
+machine example.com login alice password secret
+machine files.example.com
+	login bob
+	account ignored
+	password hunter2
+
+macdef init
+machine macro.example.com login eve password macro
+
+default login anonymous password guest
+`
+	credentials, err := parseNetrc(strings.NewReader(netrc))
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	tests := []struct {
+		host     string
+		expected netrcEntry
+	}{
+		{"example.com", netrcEntry{"alice", "secret"}},
+		{"files.example.com", netrcEntry{"bob", "hunter2"}},
+		{"macro.example.com", netrcEntry{"anonymous", "guest"}},
+		{"other.example.com", netrcEntry{"anonymous", "guest"}},
+	}
+	for _, tc := range tests {
+		entry, ok := credentials.lookup(tc.host)
+		if !ok || entry != tc.expected {
+			t.Errorf("%s: Expected: %v, Got: %v", tc.host, tc.expected, entry)
+		}
+	}
+
+	for _, netrc := range []string{"machine", "login alice", "machine example.com login"} {
+		if _, err := parseNetrc(strings.NewReader(netrc)); err == nil {
+			t.Errorf("%q: Expected an error", netrc)
+		}
+	}
+}
+
+func TestHandleDownloadNetrc(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "alice" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	err := os.WriteFile(netrc, []byte("machine 127.0.0.1 login alice password secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(netrcEnv, netrc)
+
+	location := t.TempDir()
+	err = HandleDownload(new(bytes.Buffer), []string{"-netrc", "-location", location, ts.URL + "/hello.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(location, "hello.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Expected the file to be downloaded, Got: %q, %v", data, err)
+	}
+
+	// -user takes precedence over the netrc file
+	t.Setenv(passwordEnv, "wrong")
+	err = HandleDownload(new(bytes.Buffer), []string{"-netrc", "-user", "alice", "-location", t.TempDir(), ts.URL + "/hello.txt"})
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected the download to fail, Got: %v", err)
+	}
+
+	t.Setenv(netrcEnv, filepath.Join(t.TempDir(), "missing"))
+	err = HandleDownload(new(bytes.Buffer), []string{"-netrc", ts.URL + "/hello.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidNetrc) {
+		t.Fatalf("Expected ErrInvalidNetrc, Got: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// progressEvent reports the progress of a single download to the display.
+type progressEvent struct {
+	url string
+	// bytes is the number of bytes written by a single chunk
+	bytes int64
+	// started is set when the download starts, before any bytes are written
+	started bool
+	// result is set once the download has finished, instead of bytes
+	result *FileResult
+}
+
+// notifyProgress calls onProgress with every event received on events, then passes it on to
+// the returned channel, which is closed once events is. remotes holds the file looked up for
+// each url.
+func notifyProgress(events chan progressEvent, urls []string, remotes []remoteFile, onProgress func(ProgressEvent)) chan progressEvent {
+	totals := make(map[string]int64, len(urls))
+	for i, url := range urls {
+		totals[url] = remotes[i].contentLength
+	}
+	transferred := make(map[string]int64, len(urls))
+
+	out := make(chan progressEvent)
+	go func() {
+		defer close(out)
+		for event := range events {
+			transferred[event.url] += event.bytes
+			progress := ProgressEvent{URL: event.url, Bytes: transferred[event.url], Total: totals[event.url], Result: event.result}
+			switch {
+			case event.started:
+				progress.Status = ProgressStarted
+			case event.result == nil:
+				progress.Status = ProgressDownloading
+			case event.result.Err != nil:
+				progress.Status = ProgressFailed
+			case event.result.Skipped:
+				progress.Status = ProgressSkipped
+			default:
+				progress.Status = ProgressCompleted
+			}
+			onProgress(progress)
+			out <- event
+		}
+	}()
+	return out
+}
+
+// jsonProgress is a line of the JSON progress output.
+type jsonProgress struct {
+	// Status is downloading, completed, skipped or failed
+	Status  string  `json:"status"`
+	URL     string  `json:"url"`
+	Bytes   int64   `json:"bytes"`
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent,omitempty"`
+	// Speed is in bytes per second
+	Speed float64 `json:"speed"`
+	Path  string  `json:"path,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// fileProgress tracks the progress of a single download.
+type fileProgress struct {
+	started         time.Time
+	transferred     int64
+	lastTransferred int64
+	rate            float64
+}
+
+// progressThrottle collects the urls whose progress hasn't been shown yet, so that progress
+// is shown at most once per interval instead of for every chunk.
+type progressThrottle struct {
+	// c receives a value every interval. It is nil if every chunk is shown
+	c       <-chan time.Time
+	ticker  *time.Ticker
+	pending []string
+}
+
+// newProgressThrottle returns a progressThrottle that shows progress every interval, or for
+// every chunk if interval is 0.
+func newProgressThrottle(interval time.Duration) *progressThrottle {
+	if interval <= 0 {
+		return &progressThrottle{}
+	}
+	ticker := time.NewTicker(interval)
+	return &progressThrottle{c: ticker.C, ticker: ticker}
+}
+
+// add records that url made progress, and reports whether it should be shown right away.
+func (p *progressThrottle) add(url string) bool {
+	if p.ticker == nil {
+		return true
+	}
+	for _, pending := range p.pending {
+		if pending == url {
+			return false
+		}
+	}
+	p.pending = append(p.pending, url)
+	return false
+}
+
+// take removes url from the pending urls, and reports whether it was pending.
+func (p *progressThrottle) take(url string) bool {
+	for i, pending := range p.pending {
+		if pending == url {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// flush returns the pending urls, in the order they first made progress, and clears them.
+func (p *progressThrottle) flush() []string {
+	pending := p.pending
+	p.pending = nil
+	return pending
+}
+
+// stop releases the ticker of p.
+func (p *progressThrottle) stop() {
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+}
+
+// displayJSONProgress writes download progress as newline-delimited JSON objects, with a line on
+// w for every download that finishes, and a line on progress for the progress of each file every
+// interval, or for every chunk written if interval is 0. remotes holds the file looked up for each
+// url. It returns once the bytes channel is closed.
+func displayJSONProgress(w, progress io.Writer, urls []string, remotes []remoteFile, bytes chan progressEvent, interval time.Duration) {
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+	throttle := newProgressThrottle(interval)
+	defer throttle.stop()
+
+	totals := make(map[string]int64, len(urls))
+	files := make(map[string]*fileProgress, len(urls))
+	for i, url := range urls {
+		totals[url] = remotes[i].contentLength
+		files[url] = &fileProgress{}
+	}
+
+	enc := json.NewEncoder(progress)
+	results := json.NewEncoder(w)
+	show := func(url string) {
+		file := files[url]
+		enc.Encode(jsonProgress{
+			Status:  "downloading",
+			URL:     url,
+			Bytes:   file.transferred,
+			Total:   totals[url],
+			Percent: calculateDownloadPercentage(file.transferred, totals[url]),
+			Speed:   file.rate,
+		})
+	}
+
+	lastTick := time.Now()
+	for {
+		select {
+		case event, ok := <-bytes:
+			if !ok {
+				for _, url := range throttle.flush() {
+					show(url)
+				}
+				return
+			}
+			if event.started {
+				continue
+			}
+			file := files[event.url]
+			if event.result == nil {
+				file.transferred += event.bytes
+				if throttle.add(event.url) {
+					show(event.url)
+				}
+				continue
+			}
+
+			// Bring the progress of the file up to date before its result
+			if throttle.take(event.url) {
+				show(event.url)
+			}
+			line := jsonProgress{URL: event.url, Bytes: file.transferred, Total: totals[event.url], Speed: file.rate}
+			switch {
+			case event.result.Err != nil:
+				line.Status = "failed"
+				line.Error = event.result.Err.Error()
+			case event.result.Skipped:
+				// skipped or up-to-date
+				line.Status = event.result.Status()
+				line.Path = event.result.Path
+			default:
+				line.Status = "completed"
+				line.Path = event.result.Path
+				line.Percent = 100
+			}
+			results.Encode(line)
+		case <-throttle.c:
+			for _, url := range throttle.flush() {
+				show(url)
+			}
+		case now := <-ticker.C:
+			elapsed := now.Sub(lastTick).Seconds()
+			for _, file := range files {
+				file.rate = float64(file.transferred-file.lastTransferred) / elapsed
+				file.lastTransferred = file.transferred
+			}
+			lastTick = now
+		}
+	}
+}
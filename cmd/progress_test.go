@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleDownloadJSONProgress(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	fileURL := ts.URL + "/file.txt"
+	missingURL := ts.URL + "/missing.txt"
+	byteBuf := new(bytes.Buffer)
+	err := HandleDownload(byteBuf, []string{"-json", "-x", "2", "-retries", "0", "-location", t.TempDir(), fileURL, missingURL})
+	if err == nil {
+		t.Fatal("Expected non-nil error, Got: nil")
+	}
+
+	// Every line of output is a JSON object
+	var lines []jsonProgress
+	var last []byte
+	scanner := bufio.NewScanner(byteBuf)
+	for scanner.Scan() {
+		var line jsonProgress
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Expected a JSON object, Got: %s", scanner.Text())
+		}
+		lines = append(lines, line)
+		last = append(last[:0], scanner.Bytes()...)
+	}
+
+	var progress, completed, failed, summaries int
+	for _, line := range lines {
+		switch line.Status {
+		case "downloading":
+			progress++
+			if line.URL != fileURL || line.Total != 5 {
+				t.Fatalf("Expected progress of %s out of 5 bytes, Got: %+v", fileURL, line)
+			}
+		case "completed":
+			completed++
+			if line.URL != fileURL || line.Bytes != 5 || line.Percent != 100 {
+				t.Fatalf("Expected %s to complete with 5 bytes, Got: %+v", fileURL, line)
+			}
+		case "failed":
+			failed++
+			if line.URL != missingURL || len(line.Error) == 0 {
+				t.Fatalf("Expected %s to fail with an error, Got: %+v", missingURL, line)
+			}
+		case "summary":
+			summaries++
+		default:
+			t.Fatalf("Unexpected status: %+v", line)
+		}
+	}
+	if progress == 0 || completed != 1 || failed != 1 {
+		t.Fatalf("Expected progress, 1 completed and 1 failed event, Got: %+v", lines)
+	}
+
+	// The summary is the last line
+	var summary jsonSummary
+	if err := json.Unmarshal(last, &summary); err != nil || summaries != 1 || summary.Status != "summary" {
+		t.Fatalf("Expected a single summary line last, Got: %s", last)
+	}
+	expected := []jsonFileSummary{
+		{URL: fileURL, Status: "completed", Bytes: 5},
+		{URL: missingURL, Status: "failed"},
+	}
+	if len(summary.Files) != len(expected) {
+		t.Fatalf("Expected %d files in the summary, Got: %+v", len(expected), summary.Files)
+	}
+	for i, file := range summary.Files {
+		if file.URL != expected[i].URL || file.Status != expected[i].Status || file.Bytes != expected[i].Bytes {
+			t.Fatalf("Expected %+v, Got: %+v", expected[i], file)
+		}
+	}
+	if len(summary.Files[0].Path) == 0 || len(summary.Files[1].Error) == 0 {
+		t.Fatalf("Expected the path of the completed file and the error of the failed one, Got: %+v", summary.Files)
+	}
+}
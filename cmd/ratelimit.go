@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseByteSize parses a human-readable size such as 500k or 2m into bytes.
+// The suffixes k, m and g are powers of 1024. A value without a suffix is in bytes.
+func parseByteSize(size string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToLower(strings.TrimSpace(size))
+	switch {
+	case strings.HasSuffix(number, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		number = number[:len(number)-1]
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("size must be a positive number")
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// rateLimiter is a token bucket that limits the number of bytes transferred per second.
+// It is safe for concurrent use, so one limiter can throttle several downloads at once.
+type rateLimiter struct {
+	mu sync.Mutex
+	// rate is the number of bytes allowed per second, which is also the bucket size
+	rate   float64
+	tokens float64
+	last   time.Time
+	// parent, if not nil, also limits every transfer, e.g. the limiter of all
+	// downloads for the limiter of a single host
+	parent *rateLimiter
+}
+
+// newRateLimiter returns a rateLimiter allowing rate bytes per second,
+// or nil if rate is not positive.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n bytes may be transferred by l and its parent, or ctx is cancelled.
+// A nil rateLimiter never blocks.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes n tokens from l and its parents, and returns how long to wait until every
+// one of them allows the transfer.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	var delay time.Duration
+	for limiter := l; limiter != nil; limiter = limiter.parent {
+		if d := limiter.take(n); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// take refills the bucket for the time elapsed and takes n tokens from it. If the bucket
+// goes negative, it returns how long to wait until it would have refilled.
+func (l *rateLimiter) take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// hostLimiters holds a rateLimiter for each host, created the first time a host is
+// transferred from. It is safe for concurrent use.
+type hostLimiters struct {
+	mu     sync.Mutex
+	rate   int64
+	parent *rateLimiter
+	hosts  map[string]*rateLimiter
+}
+
+// newHostLimiters returns hostLimiters allowing rate bytes per second from each host, and
+// no more than parent allows from all hosts combined, or nil if rate is not positive.
+func newHostLimiters(rate int64, parent *rateLimiter) *hostLimiters {
+	if rate <= 0 {
+		return nil
+	}
+	return &hostLimiters{rate: rate, parent: parent, hosts: make(map[string]*rateLimiter)}
+}
+
+// get returns the rateLimiter of host. A nil hostLimiters returns nil.
+func (h *hostLimiters) get(host string) *rateLimiter {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l, ok := h.hosts[host]
+	if !ok {
+		l = newRateLimiter(h.rate)
+		l.parent = h.parent
+		h.hosts[host] = l
+	}
+	return l
+}
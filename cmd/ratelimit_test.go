@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		expected int64
+		err      bool
+	}{
+		{size: "100", expected: 100},
+		{size: "500k", expected: 500 * 1024},
+		{size: "2M", expected: 2 * 1024 * 1024},
+		{size: "1.5g", expected: 3 * 512 * 1024 * 1024},
+		{size: "", err: true},
+		{size: "k", err: true},
+		{size: "-1k", err: true},
+		{size: "10kb", err: true},
+		{size: "nan", err: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseByteSize(tc.size)
+		if tc.err && err == nil {
+			t.Fatalf("Expected non-nil error for %q, Got: %v", tc.size, got)
+		}
+		if !tc.err && err != nil {
+			t.Fatalf("Expected nil error for %q. Got: %v", tc.size, err)
+		}
+		if got != tc.expected {
+			t.Fatalf("Expected: %v, Got: %v", tc.expected, got)
+		}
+	}
+}
+
+func TestHostLimiters(t *testing.T) {
+	limiters := newHostLimiters(1000, nil)
+	a, b := limiters.get("a.example.com"), limiters.get("b.example.com")
+	if a == b || limiters.get("a.example.com") != a {
+		t.Fatal("Expected a limiter per host")
+	}
+
+	// Each host has its own bucket, so taking from one doesn't delay the other
+	approx := func(got, expected time.Duration) bool {
+		return got > expected-50*time.Millisecond && got < expected+50*time.Millisecond
+	}
+	if delay := a.take(1000); !approx(delay, time.Second) {
+		t.Fatalf("Expected a delay of 1s, Got: %v", delay)
+	}
+	if delay := b.take(1000); !approx(delay, time.Second) {
+		t.Fatalf("Expected a delay of 1s for the other host, Got: %v", delay)
+	}
+
+	// The limiter of all hosts still applies to each of them
+	parent := newRateLimiter(1000)
+	limiters = newHostLimiters(1000, parent)
+	limiters.get("a.example.com").reserve(1000)
+	if delay := limiters.get("b.example.com").reserve(1000); !approx(delay, 2*time.Second) {
+		t.Fatalf("Expected a delay of 2s from the limiter of all hosts, Got: %v", delay)
+	}
+
+	if newHostLimiters(0, parent).get("a.example.com") != nil {
+		t.Fatal("Expected no limiter without a rate")
+	}
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// renameValues returns the value of every placeholder of a RenameTemplate for the file
+// named filename, downloaded from the index-th url rawURL, counting from 1, on date.
+func renameValues(filename, rawURL string, index int, date time.Time) map[string]string {
+	var host string
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Hostname()
+	}
+	return map[string]string{
+		"basename": filename,
+		"host":     host,
+		"date":     date.Format("2006-01-02"),
+		"index":    strconv.Itoa(index),
+	}
+}
+
+// expandTemplate replaces every {placeholder} in template with its entry in values.
+// It returns ErrRenameTemplate if a brace is unbalanced or a placeholder is unknown.
+func expandTemplate(template string, values map[string]string) (string, error) {
+	var b strings.Builder
+	rest := template
+	for len(rest) != 0 {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			b.WriteString(rest)
+			break
+		}
+		if rest[open] == '}' {
+			return "", fmt.Errorf("%w: unexpected } in %q", ErrRenameTemplate, template)
+		}
+		b.WriteString(rest[:open])
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] == '{' {
+			return "", fmt.Errorf("%w: unclosed { in %q", ErrRenameTemplate, template)
+		}
+		name := rest[open+1 : open+1+end]
+		value, ok := values[name]
+		if !ok {
+			return "", fmt.Errorf("%w: unknown placeholder {%s} in %q", ErrRenameTemplate, name, template)
+		}
+		b.WriteString(value)
+		rest = rest[open+1+end+1:]
+	}
+	return b.String(), nil
+}
+
+// validateRenameTemplate returns ErrRenameTemplate if template isn't a valid
+// RenameTemplate. Files are only renamed, so it can't contain a path separator.
+func validateRenameTemplate(template string) error {
+	if strings.ContainsAny(template, `/\`) {
+		return fmt.Errorf("%w: %q contains a path separator", ErrRenameTemplate, template)
+	}
+	_, err := expandTemplate(template, renameValues("file", "http://localhost/file", 1, time.Time{}))
+	return err
+}
+
+// rename returns the filename of the file named filename, downloaded from the index-th url
+// rawURL, counting from 1, once RenameTemplate is applied. A file without a name keeps none.
+func (opts *DownloadOptions) rename(filename, rawURL string, index int) string {
+	if len(opts.RenameTemplate) == 0 || len(filename) == 0 {
+		return filename
+	}
+	name, err := expandTemplate(opts.RenameTemplate, renameValues(filename, rawURL, index, opts.startTime))
+	if err != nil {
+		return filename
+	}
+	return sanitizeFileName(name)
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	values := renameValues("go.pdf", "https://www.openmymind.net:8443/assets/go/go.pdf", 3, time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC))
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{basename}", "go.pdf"},
+		{"{date}-{basename}", "2023-01-02-go.pdf"},
+		{"{host}_{index}_{basename}", "www.openmymind.net_3_go.pdf"},
+		{"book.pdf", "book.pdf"},
+	}
+	for _, tc := range tests {
+		got, err := expandTemplate(tc.template, values)
+		if err != nil || got != tc.expected {
+			t.Errorf("%q: Expected: %q, Got: %q, %v", tc.template, tc.expected, got, err)
+		}
+	}
+
+	for _, template := range []string{"{name}", "{basename", "basename}", "{{basename}}", "{}", "{host}/{basename}", `{host}\{basename}`} {
+		err := validateRenameTemplate(template)
+		if !errors.Is(err, ErrRenameTemplate) {
+			t.Errorf("%q: Expected ErrRenameTemplate, Got: %v", template, err)
+		}
+	}
+}
+
+func TestHandleDownloadRename(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+
+	location := t.TempDir()
+	args := []string{"-x", "2", "-rename", "{host}-{index}-{date}-{basename}", "-location", location, ts.URL + "/a.txt", ts.URL + "/b.txt"}
+	err := HandleDownload(new(bytes.Buffer), args)
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	date := time.Now().Format("2006-01-02")
+	for _, name := range []string{"127.0.0.1-1-" + date + "-a.txt", "127.0.0.1-2-" + date + "-b.txt"} {
+		if _, err := os.Stat(filepath.Join(location, name)); err != nil {
+			t.Fatalf("Expected the file renamed to %s. Got: %v", name, err)
+		}
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-rename", "{size}-{basename}", ts.URL + "/a.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrRenameTemplate) {
+		t.Fatalf("Expected ErrRenameTemplate, Got: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// metaSuffix is appended to the path of a download to name the sidecar file
+// describing its .part file.
+const metaSuffix = ".dlmeta"
+
+// resumeMeta is saved next to a partial download, so a later run can tell whether
+// the .part file still belongs to the remote file before appending to it.
+type resumeMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Size is -1 if the server didn't report the Content-Length
+	Size         int64 `json:"size"`
+	BytesWritten int64 `json:"bytes_written"`
+	// Segmented is set while the .part file is downloaded in segments, which leaves
+	// holes in it until every segment is complete, even once it has the full size
+	Segmented bool `json:"segmented,omitempty"`
+}
+
+// getMetaPath returns the path of the sidecar file of the download saved to path.
+func getMetaPath(path string) string {
+	return path + metaSuffix
+}
+
+// newResumeMeta returns the metadata of a download of url described by remote.
+func newResumeMeta(url string, remote remoteFile) resumeMeta {
+	return resumeMeta{
+		URL:          url,
+		ETag:         remote.etag,
+		LastModified: remote.lastModified,
+		Size:         remote.contentLength,
+	}
+}
+
+// matches reports whether a partial download described by m can be resumed from other.
+// ETag is compared if both have one, otherwise Last-Modified is compared if both have one.
+func (m resumeMeta) matches(other resumeMeta) bool {
+	if m.URL != other.URL || m.Size != other.Size {
+		return false
+	}
+	if len(m.ETag) != 0 && len(other.ETag) != 0 {
+		return m.ETag == other.ETag
+	}
+	if len(m.LastModified) != 0 && len(other.LastModified) != 0 {
+		return m.LastModified == other.LastModified
+	}
+	return true
+}
+
+// readResumeMeta reads the sidecar file of the download saved to path.
+// It returns nil if there is none or it can't be parsed.
+func readResumeMeta(path string) (*resumeMeta, error) {
+	data, err := os.ReadFile(getMetaPath(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var meta resumeMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, nil
+	}
+	return &meta, nil
+}
+
+// writeResumeMeta saves meta as the sidecar file of the download saved to path,
+// recording the size of its .part file as the bytes written.
+func writeResumeMeta(path string, meta resumeMeta) error {
+	var err error
+	meta.BytesWritten, err = getExistingFileSize(getPartPath(path))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getMetaPath(path), data, 0644)
+}
+
+// removeResumeMeta deletes the sidecar file of the download saved to path, if any.
+func removeResumeMeta(path string) error {
+	err := os.Remove(getMetaPath(path))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// prepareResume checks that the .part file of the download of url saved to path was
+// downloaded from the same remote file, and deletes it if the remote file has changed
+// since or it was being downloaded in segments, so the download restarts from scratch.
+// It then records the remote file in the sidecar file.
+func prepareResume(url, path string, remote remoteFile) (resumeMeta, error) {
+	meta := newResumeMeta(url, remote)
+	saved, err := readResumeMeta(path)
+	if err != nil {
+		return meta, err
+	}
+	if saved != nil && (saved.Segmented || !saved.matches(meta)) {
+		err := os.Remove(getPartPath(path))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return meta, err
+		}
+	}
+	return meta, writeResumeMeta(path, meta)
+}
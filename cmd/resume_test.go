@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandleDownloadResumeMeta(t *testing.T) {
+	body := "hello world"
+	var mu sync.Mutex
+	var ranges []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	url := ts.URL + "/file.txt"
+
+	tests := []struct {
+		etag        string
+		part        string
+		rangeHeader string
+	}{
+		// The remote file is unchanged, so the download resumes
+		{etag: `"v2"`, part: "hello", rangeHeader: "bytes=5-"},
+		// The remote file changed, so the download restarts
+		{etag: `"v1"`, part: "HELLO", rangeHeader: ""},
+	}
+
+	for _, tc := range tests {
+		ranges = nil
+		location := t.TempDir()
+		path := filepath.Join(location, "file.txt")
+		err := os.WriteFile(getPartPath(path), []byte(tc.part), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := json.Marshal(resumeMeta{URL: url, ETag: tc.etag, Size: int64(len(body)), BytesWritten: int64(len(tc.part))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(getMetaPath(path), meta, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = HandleDownload(new(bytes.Buffer), []string{"-location", location, url})
+		if err != nil {
+			t.Fatalf("Expected nil error. Got: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatalf("Expected: %s, Got: %s", body, data)
+		}
+		if len(ranges) != 1 || ranges[0] != tc.rangeHeader {
+			t.Fatalf("Expected a single request with Range %q, Got: %q", tc.rangeHeader, ranges)
+		}
+
+		// The sidecar file is deleted once the download completes
+		_, err = os.Stat(getMetaPath(path))
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Expected %s to be deleted, Got: %v", getMetaPath(path), err)
+		}
+	}
+}
+
+func TestResumeMetaMatches(t *testing.T) {
+	meta := resumeMeta{URL: "http://example.com/file.txt", ETag: `"v1"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT", Size: 10}
+
+	tests := []struct {
+		other    resumeMeta
+		expected bool
+	}{
+		{meta, true},
+		{resumeMeta{URL: meta.URL, ETag: `"v2"`, LastModified: meta.LastModified, Size: 10}, false},
+		{resumeMeta{URL: meta.URL, LastModified: meta.LastModified, Size: 10}, true},
+		{resumeMeta{URL: meta.URL, LastModified: "Tue, 03 Jan 2006 15:04:05 GMT", Size: 10}, false},
+		{resumeMeta{URL: meta.URL, Size: 10}, true},
+		{resumeMeta{URL: meta.URL, ETag: `"v1"`, Size: 20}, false},
+		{resumeMeta{URL: "http://example.com/other.txt", ETag: `"v1"`, Size: 10}, false},
+	}
+	for _, tc := range tests {
+		if got := meta.matches(tc.other); got != tc.expected {
+			t.Errorf("%+v: Expected: %v, Got: %v", tc.other, tc.expected, got)
+		}
+	}
+}
+
+func TestHandleDownloadIfRange(t *testing.T) {
+	body := "hello world"
+	var ifRange string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		// The file is replaced between the HEAD and GET requests
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == http.MethodGet {
+			ifRange = r.Header.Get("If-Range")
+			w.Header().Set("ETag", `"v2"`)
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := os.WriteFile(filepath.Join(location, "file.txt.part"), []byte("HELLO"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = HandleDownload(new(bytes.Buffer), []string{"-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if ifRange != `"v1"` {
+		t.Fatalf(`Expected If-Range: "v1", Got: %q`, ifRange)
+	}
+
+	// The server sent the whole new file instead of appending to the old one
+	data, err := os.ReadFile(filepath.Join(location, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Fatalf("Expected: %s, Got: %s", body, data)
+	}
+}
+
+func TestHandleDownloadRangeNotSatisfiable(t *testing.T) {
+	body := "hello"
+	var mu sync.Mutex
+	var ranges []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	// The size of the file is only reported in the Content-Range of the 416 response
+	mux.HandleFunc("/unknown/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if r.Method == http.MethodHead {
+			w.Header().Set("Transfer-Encoding", "chunked")
+			return
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		url    string
+		part   string
+		ranges []string
+	}{
+		// The remote file shrank below the .part file, so the download restarts without
+		// asking for a range past its end
+		{url: ts.URL + "/file.txt", part: "hello world", ranges: []string{"", ""}},
+		// The size of the remote file is only known once the range is rejected
+		{url: ts.URL + "/unknown/file.txt", part: "hello world", ranges: []string{"", "bytes=11-", ""}},
+		// The .part file is already complete
+		{url: ts.URL + "/unknown/file.txt", part: "hello", ranges: []string{"", "bytes=5-"}},
+	}
+	for _, tc := range tests {
+		ranges = nil
+		location := t.TempDir()
+		path := filepath.Join(location, "file.txt")
+		err := os.WriteFile(getPartPath(path), []byte(tc.part), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = HandleDownload(new(bytes.Buffer), []string{"-location", location, "-retries", "0", tc.url})
+		if err != nil {
+			t.Fatalf("%s: Expected nil error. Got: %v", tc.url, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatalf("%s: Expected: %s, Got: %s", tc.url, body, data)
+		}
+		mu.Lock()
+		if strings.Join(ranges, ",") != strings.Join(tc.ranges, ",") {
+			t.Fatalf("%s: Expected requests with Range %q, Got: %q", tc.url, tc.ranges, ranges)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestHandleDownloadOversize(t *testing.T) {
+	body := "hello"
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(body))
+	}))
+	defer ts.Close()
+
+	location := t.TempDir()
+	path := filepath.Join(location, "file.txt")
+	err := os.WriteFile(getPartPath(path), []byte("hello world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The .part file is left alone, and the download isn't retried
+	byteBuf := new(bytes.Buffer)
+	err = HandleDownload(byteBuf, []string{"-location", location, "-on-oversize", "error", ts.URL + "/file.txt"})
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) || !errors.Is(downloadErrs.Errs[0].Err, ErrOversize) {
+		t.Fatalf("Expected ErrOversize, Got: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected only the HEAD request, Got: %d requests", requests)
+	}
+	data, err := os.ReadFile(getPartPath(path))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected the .part file to be kept, Got: %q, %v", data, err)
+	}
+	warning := fmt.Sprintf("Warning: %s is 11 bytes, larger than the 5 bytes of %s/file.txt\n", getPartPath(path), ts.URL)
+	if !strings.Contains(byteBuf.String(), warning) {
+		t.Fatalf("Expected a warning, Got: %q", byteBuf.String())
+	}
+
+	byteBuf.Reset()
+	err = HandleDownload(byteBuf, []string{"-location", location, ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil || string(data) != body {
+		t.Fatalf("Expected: %s, Got: %q, %v", body, data, err)
+	}
+	if !strings.Contains(byteBuf.String(), warning) {
+		t.Fatalf("Expected a warning, Got: %q", byteBuf.String())
+	}
+
+	err = HandleDownload(new(bytes.Buffer), []string{"-on-oversize", "append", ts.URL + "/file.txt"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrInvalidOnOversize) {
+		t.Fatalf("Expected ErrInvalidOnOversize, Got: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isRetryable reports whether a failed download attempt is worth retrying.
+// Network errors, 5xx and 429 responses are considered transient; other
+// HTTP errors and local file errors are not.
+func isRetryable(err error) bool {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrOversize) {
+		return false
+	}
+	var pathErr *fs.PathError
+	return !errors.As(err, &pathErr)
+}
+
+// retryDelay returns how long to wait before the given retry attempt.
+// The delay starts at backoff and doubles with every attempt, up to max.
+func retryDelay(backoff, max time.Duration, attempt int) time.Duration {
+	delay := backoff
+	for i := 0; i < attempt && delay < max; i++ {
+		// Doubling past max could overflow
+		if delay > max/2 {
+			return max
+		}
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// retryDelay returns how long to wait before retrying the given attempt, which failed
+// with err. It is the delay asked for by a Retry-After header, and the exponential
+// backoff otherwise, both up to MaxRetryAfter.
+func (d *downloader) retryDelay(err error, attempt int) time.Duration {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		if statusErr.RetryAfter > d.opts.MaxRetryAfter {
+			return d.opts.MaxRetryAfter
+		}
+		return statusErr.RetryAfter
+	}
+	return retryDelay(d.opts.RetryBackoff, d.opts.MaxRetryAfter, attempt)
+}
+
+// newStatusError returns the StatusError of resp, with the delay asked for by its
+// Retry-After header if it is a 429 or 503 response.
+func newStatusError(resp *http.Response) StatusError {
+	err := StatusError{StatusCode: resp.StatusCode}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return err
+}
+
+// parseRetryAfter returns the delay asked for by a Retry-After header, given either as
+// a number of seconds or as an HTTP date, relative to now. It is 0 if value is empty,
+// invalid or in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		switch {
+		case seconds <= 0:
+			return 0
+		case seconds > int64(math.MaxInt64/time.Second):
+			return math.MaxInt64
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"1", time.Second},
+		{" 120 ", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-30 * time.Second).Format(http.TimeFormat), 0},
+		{"99999999999999999", time.Duration(1<<63 - 1)},
+	}
+	for _, tc := range tests {
+		if got := parseRetryAfter(tc.value, now); got != tc.expected {
+			t.Errorf("%q: Expected: %v, Got: %v", tc.value, tc.expected, got)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff  time.Duration
+		attempt  int
+		expected time.Duration
+	}{
+		{time.Second, 0, time.Second},
+		{time.Second, 3, 8 * time.Second},
+		{time.Second, 10, time.Minute},
+		// A shift this large would overflow to 0 or a negative delay
+		{time.Second, 63, time.Minute},
+		{time.Second, 1000, time.Minute},
+		{2 * time.Minute, 0, time.Minute},
+		{0, 1000, 0},
+	}
+	for _, tc := range tests {
+		if got := retryDelay(tc.backoff, time.Minute, tc.attempt); got != tc.expected {
+			t.Errorf("%v, attempt %d: Expected: %v, Got: %v", tc.backoff, tc.attempt, tc.expected, got)
+		}
+	}
+}
+
+func TestNewStatusError(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		expected   time.Duration
+	}{
+		{http.StatusTooManyRequests, 3 * time.Second},
+		{http.StatusServiceUnavailable, 3 * time.Second},
+		// Retry-After is only honoured on 429 and 503 responses
+		{http.StatusInternalServerError, 0},
+	}
+	for _, tc := range tests {
+		resp := &http.Response{StatusCode: tc.statusCode, Header: http.Header{"Retry-After": {"3"}}}
+		err := newStatusError(resp)
+		if err.StatusCode != tc.statusCode || err.RetryAfter != tc.expected {
+			t.Errorf("%d: Expected a retry after %v, Got: %+v", tc.statusCode, tc.expected, err)
+		}
+	}
+}
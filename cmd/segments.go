@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// segment is an inclusive byte range of a file.
+type segment struct {
+	start, end int64
+}
+
+// splitSegments divides a file of contentLength bytes into at most n segments of near-equal size.
+func splitSegments(contentLength int64, n int) []segment {
+	if int64(n) > contentLength {
+		n = int(contentLength)
+	}
+	size := contentLength / int64(n)
+	segments := make([]segment, n)
+	for i := range segments {
+		segments[i].start = int64(i) * size
+		segments[i].end = segments[i].start + size - 1
+	}
+	// The last segment takes the remainder of the division
+	segments[n-1].end = contentLength - 1
+	return segments
+}
+
+// segmentFile is a file holding a single segment, which is written at the offsets
+// of the segment in the whole file.
+type segmentFile struct {
+	*os.File
+	start int64
+}
+
+func (f segmentFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.File.WriteAt(p, off-f.start)
+}
+
+// segmentPath returns the path of the file holding the index-th segment of the
+// download at destinationPath, e.g. file.zip.part0.
+func segmentPath(destinationPath string, index int) string {
+	return destinationPath + strconv.Itoa(index)
+}
+
+// segmented reports whether remote is downloaded in segments.
+func (d *downloader) segmented(remote remoteFile) bool {
+	return d.opts.Segments > 1 && remote.acceptRanges && remote.contentLength > 0
+}
+
+// trimPartPath returns the path of the download that the file at path belongs to, and
+// whether it is a .part file or one of its segment files, such as file.zip.part0.
+func trimPartPath(path string) (string, bool) {
+	i := strings.LastIndex(path, partSuffix)
+	if i < 0 {
+		return "", false
+	}
+	for _, r := range path[i+len(partSuffix):] {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+	return path[:i], true
+}
+
+// fetchSegments downloads remote to destinationPath using one range request per segment,
+// and reports its progress under url. It returns the number of bytes written.
+// With MergeWriteAt, each segment is written at its offset in the file. With MergeConcat,
+// each segment is written to a file of its own, and the files are joined in order once
+// every segment is complete.
+// The file is always downloaded from the start, since it isn't known which segments of an
+// existing partial file are complete.
+func (d *downloader) fetchSegments(ctx context.Context, url, destinationPath string, remote remoteFile) (int64, error) {
+	contentLength := remote.contentLength
+	file, err := os.OpenFile(destinationPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	segments := splitSegments(contentLength, d.opts.Segments)
+	writers := make([]io.WriterAt, len(segments))
+	var parts []*os.File
+	// The segment files are only needed until they are joined
+	defer func() {
+		for i, part := range parts {
+			part.Close()
+			os.Remove(segmentPath(destinationPath, i))
+		}
+	}()
+	if d.opts.MergeStrategy == MergeConcat {
+		for i, s := range segments {
+			part, err := os.OpenFile(segmentPath(destinationPath, i), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+			if err != nil {
+				return 0, err
+			}
+			parts = append(parts, part)
+			writers[i] = segmentFile{part, s.start}
+		}
+	} else {
+		err = file.Truncate(contentLength)
+		if err != nil {
+			return 0, err
+		}
+		for i := range segments {
+			writers[i] = file
+		}
+	}
+
+	// Stop the remaining segments as soon as one fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var written int64
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for i, s := range segments {
+		wg.Add(1)
+		go func(s segment, w io.WriterAt) {
+			defer wg.Done()
+			err := d.fetchSegment(ctx, url, remote.source, w, s, &written)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(s, writers[i])
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		// The file has gaps where segments are missing, so it can't be resumed
+		file.Truncate(0)
+		return written, firstErr
+	}
+
+	for i, part := range parts {
+		s := segments[i]
+		_, err := io.Copy(file, io.NewSectionReader(part, 0, s.end-s.start+1))
+		if err != nil {
+			file.Truncate(0)
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// fetchSegment downloads a single segment of source into w, at the offsets of the segment
+// in the file, adding the bytes written to written, and reports its progress under url.
+func (d *downloader) fetchSegment(ctx context.Context, url, source string, w io.WriterAt, s segment, written *int64) error {
+	d.log.debugf("Requesting bytes %d-%d of %v", s.start, s.end, source)
+	resp, err := sendHTTPRangeRequest(ctx, source, d.client, d.opts.Header, s.start, s.end)
+	if err != nil {
+		return err
+	}
+	d.log.debugf("%v responded with %d %s", source, resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Body = newIdleReader(resp.Body, d.opts.IdleTimeout)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return newStatusError(resp)
+	}
+	start, err := getContentRangeStart(resp)
+	if err != nil {
+		return err
+	}
+	if start != s.start {
+		return fmt.Errorf("server sent segment at byte %d instead of byte %d", start, s.start)
+	}
+
+	limiter := d.limiterFor(source)
+	bytes := make([]byte, d.opts.BufferSize)
+	offset := s.start
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		bytesRead, readErr := resp.Body.Read(bytes)
+		if offset+int64(bytesRead) > s.end+1 {
+			return fmt.Errorf("server sent more than the requested segment %d-%d", s.start, s.end)
+		}
+		if bytesRead > 0 {
+			err := limiter.wait(ctx, bytesRead)
+			if err != nil {
+				return err
+			}
+
+			// Write the chunk at its position in the file
+			fw, err := w.WriteAt(bytes[0:bytesRead], offset)
+			if err != nil {
+				return err
+			}
+			offset += int64(fw)
+			atomic.AddInt64(written, int64(fw))
+			d.bytesChan <- progressEvent{url: url, bytes: int64(fw)}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				break
+			}
+			return readErr
+		}
+	}
+
+	if offset != s.end+1 {
+		return fmt.Errorf("server sent %d bytes of segment %d-%d", offset-s.start, s.start, s.end)
+	}
+	return nil
+}
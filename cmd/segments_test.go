@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitSegments(t *testing.T) {
+	tests := []struct {
+		contentLength int64
+		n             int
+		expected      []segment
+	}{
+		{contentLength: 10, n: 1, expected: []segment{{0, 9}}},
+		{contentLength: 10, n: 3, expected: []segment{{0, 2}, {3, 5}, {6, 9}}},
+		{contentLength: 2, n: 4, expected: []segment{{0, 0}, {1, 1}}},
+	}
+
+	for _, tc := range tests {
+		got := splitSegments(tc.contentLength, tc.n)
+		if len(got) != len(tc.expected) {
+			t.Fatalf("Expected: %v, Got: %v", tc.expected, got)
+		}
+		for i := range got {
+			if got[i] != tc.expected[i] {
+				t.Fatalf("Expected: %v, Got: %v", tc.expected, got)
+			}
+		}
+	}
+}
+
+func TestDownloadSegments(t *testing.T) {
+	body := make([]byte, 100*1024+3)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	var ranges []string
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranges/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(body))
+	})
+	mux.HandleFunc("/no-ranges/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{
+			url:      ts.URL + "/ranges/file.bin",
+			expected: []string{"bytes=0-25599", "bytes=25600-51199", "bytes=51200-76799", "bytes=76800-102402"},
+		},
+		{
+			url: ts.URL + "/no-ranges/file.bin",
+		},
+	}
+
+	for _, strategy := range []string{MergeWriteAt, MergeConcat} {
+		for _, tc := range tests {
+			ranges = nil
+			location := t.TempDir()
+			_, err := Download(context.Background(), DownloadOptions{URLs: []string{tc.url}, Location: location, Segments: 4, MergeStrategy: strategy})
+			if err != nil {
+				t.Fatalf("%s: Expected nil error. Got: %v", strategy, err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(location, "file.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, body) {
+				t.Fatalf("%s: Expected downloaded file to match the source", strategy)
+			}
+
+			// The segment files are removed once they are joined
+			entries, err := os.ReadDir(location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("%s: Expected only file.bin in the location, Got: %d files", strategy, len(entries))
+			}
+
+			sort.Strings(ranges)
+			if len(ranges) != len(tc.expected) {
+				t.Fatalf("Expected: %v, Got: %v", tc.expected, ranges)
+			}
+			for i := range ranges {
+				if ranges[i] != tc.expected[i] {
+					t.Fatalf("Expected: %v, Got: %v", tc.expected, ranges)
+				}
+			}
+		}
+	}
+
+	_, err := Download(context.Background(), DownloadOptions{URLs: []string{ts.URL + "/ranges/file.bin"}, Location: t.TempDir(), Segments: 4, MergeStrategy: "mmap"})
+	var inputErr InvalidInputError
+	if !errors.As(err, &inputErr) || !errors.Is(inputErr.Err, ErrMergeStrategy) {
+		t.Fatalf("Expected ErrMergeStrategy, Got: %v", err)
+	}
+}
+
+func TestDownloadSegmentsInterrupted(t *testing.T) {
+	body := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	var fail bool
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		failing := fail
+		mu.Unlock()
+		if failing && r.Header.Get("Range") == "bytes=0-25599" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	url := ts.URL + "/file.bin"
+
+	for _, strategy := range []string{MergeWriteAt, MergeConcat} {
+		location := t.TempDir()
+		path := filepath.Join(location, "file.bin")
+
+		// A failed segment leaves the sidecar file marking the download as segmented
+		mu.Lock()
+		fail = true
+		mu.Unlock()
+		_, err := Download(context.Background(), DownloadOptions{URLs: []string{url}, Location: location, Segments: 4, MergeStrategy: strategy, Output: io.Discard})
+		if err == nil {
+			t.Fatalf("%s: Expected an error. Got nil", strategy)
+		}
+		meta, err := readResumeMeta(path)
+		if err != nil || meta == nil || !meta.Segmented {
+			t.Fatalf("%s: Expected the sidecar file to mark the download as segmented, Got: %+v, %v", strategy, meta, err)
+		}
+
+		// A run killed mid-download can leave a .part file of the full size with holes,
+		// which is downloaded again rather than taken as complete
+		mu.Lock()
+		fail = false
+		mu.Unlock()
+		for _, segments := range []int{4, 1} {
+			os.Remove(path)
+			err = os.WriteFile(getMetaPath(path), []byte(`{"url":"`+url+`","size":102400,"segmented":true}`), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(getPartPath(path), make([]byte, len(body)), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Download(context.Background(), DownloadOptions{URLs: []string{url}, Location: location, Segments: segments, MergeStrategy: strategy, Output: io.Discard})
+			if err != nil {
+				t.Fatalf("%s: Expected nil error. Got: %v", strategy, err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, body) {
+				t.Fatalf("%s, %d segments: Expected downloaded file to match the source", strategy, segments)
+			}
+		}
+	}
+}
+
+func BenchmarkMergeStrategy(b *testing.B) {
+	body := bytes.Repeat([]byte("a"), 64<<20)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(body))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, strategy := range []string{MergeWriteAt, MergeConcat} {
+		b.Run(strategy, func(b *testing.B) {
+			location := b.TempDir()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				_, err := Download(context.Background(), DownloadOptions{
+					URLs:          []string{ts.URL + "/file.bin"},
+					Location:      location,
+					Segments:      8,
+					MergeStrategy: strategy,
+					Force:         true,
+					Output:        io.Discard,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// spiderLine is a line of the JSON output of Spider.
+type spiderLine struct {
+	URL string `json:"url"`
+	OK  bool   `json:"ok"`
+	// StatusCode is 0 if no response was received
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// spider checks that every url in opts responds with a success status, without
+// downloading or writing anything, and prints whether each link is OK or broken to w.
+// Broken links are reported in the result and the returned DownloadErrors.
+func spider(ctx context.Context, client *http.Client, opts *DownloadOptions, w io.Writer) (*DownloadResult, error) {
+	d := &downloader{client: client, opts: opts, log: newLogger(w, opts.LogLevel)}
+	result := &DownloadResult{Files: make([]FileResult, len(opts.URLs))}
+	var failed []DownloadError
+	for i, u := range opts.URLs {
+		file := &result.Files[i]
+		file.URL = u
+		remote, err := d.check(ctx, u)
+		if err == nil && remote.statusCode >= http.StatusBadRequest {
+			err = StatusError{StatusCode: remote.statusCode}
+		}
+		file.Err = err
+		if err != nil {
+			failed = append(failed, DownloadError{URL: u, Err: err})
+		}
+
+		if opts.JSONProgress {
+			line := spiderLine{URL: u, OK: err == nil, StatusCode: remote.statusCode}
+			if err != nil {
+				line.Error = err.Error()
+			}
+			json.NewEncoder(w).Encode(line)
+			continue
+		}
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "OK %v (%d %s)\n", u, remote.statusCode, http.StatusText(remote.statusCode))
+		case remote.statusCode != 0:
+			fmt.Fprintf(w, "Broken %v (%d %s)\n", u, remote.statusCode, http.StatusText(remote.statusCode))
+		default:
+			fmt.Fprintf(w, "Broken %v: %v\n", u, err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if len(failed) > 0 {
+		return result, DownloadErrors{Errs: failed, Total: len(opts.URLs)}
+	}
+	return result, nil
+}
+
+// check requests url with a HEAD request, or a GET request for its first byte if NoHead
+// is set. A HEAD request that fails with an error status is sent again as a GET request,
+// since some servers only reject HEAD requests.
+func (d *downloader) check(ctx context.Context, url string) (remoteFile, error) {
+	if isFileURL(url) {
+		return lookupLocalFile(url)
+	}
+	if !d.opts.NoHead {
+		remote, err := getRemoteFile(ctx, d.client, url, d.opts.Header, false, false)
+		if err != nil || remote.statusCode < http.StatusBadRequest {
+			return remote, err
+		}
+	}
+	return probeRemoteFile(ctx, d.client, url, d.opts.Header, false, false)
+}
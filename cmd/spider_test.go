@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleDownloadSpider(t *testing.T) {
+	var fullGets int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.zip":
+			http.NotFound(w, r)
+			return
+		case "/nohead.zip":
+			// Only GET requests are allowed
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		if r.Method == http.MethodGet && len(r.Header.Get("Range")) == 0 {
+			fullGets++
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("hello"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	urls := []string{ts.URL + "/file.zip", ts.URL + "/nohead.zip", ts.URL + "/missing.zip"}
+	byteBuf := new(bytes.Buffer)
+	err := HandleDownload(byteBuf, append([]string{"-spider", "-x", "3", "-location", location}, urls...))
+
+	var downloadErrs DownloadErrors
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected DownloadErrors, Got: %v", err)
+	}
+	if len(downloadErrs.Errs) != 1 || downloadErrs.Errs[0].URL != urls[2] {
+		t.Fatalf("Expected only %v to be broken, Got: %v", urls[2], err)
+	}
+	expected := fmt.Sprintf("OK %s (200 OK)\nOK %s (206 Partial Content)\nBroken %s (404 Not Found)\n", urls[0], urls[1], urls[2])
+	if got := byteBuf.String(); got != expected {
+		t.Fatalf("Expected: %q, Got: %q", expected, got)
+	}
+
+	// Nothing is downloaded or written
+	if fullGets != 0 {
+		t.Fatalf("Expected no full GET requests, Got: %d", fullGets)
+	}
+	entries, err := os.ReadDir(location)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Expected %s to be empty, Got: %v, %v", location, entries, err)
+	}
+
+	byteBuf.Reset()
+	err = HandleDownload(byteBuf, append([]string{"-spider", "-json", "-x", "3", "-location", filepath.Join(location, "sub")}, urls...))
+	if !errors.As(err, &downloadErrs) {
+		t.Fatalf("Expected DownloadErrors, Got: %v", err)
+	}
+	var lines []spiderLine
+	dec := json.NewDecoder(byteBuf)
+	for dec.More() {
+		var line spiderLine
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 || !lines[0].OK || !lines[1].OK || lines[2].OK || lines[2].StatusCode != http.StatusNotFound || len(lines[2].Error) == 0 {
+		t.Fatalf("Expected a JSON line per url, Got: %+v", lines)
+	}
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// jsonSummary is the line of JSON output that reports the outcome of every download
+// once the batch has finished.
+type jsonSummary struct {
+	// Status is always summary, to tell the line apart from progress lines
+	Status string            `json:"status"`
+	Files  []jsonFileSummary `json:"files"`
+}
+
+// jsonFileSummary reports the outcome of a single download in a jsonSummary.
+type jsonFileSummary struct {
+	URL  string `json:"url"`
+	Path string `json:"path,omitempty"`
+	// Status is completed, resumed, skipped or failed
+	Status string `json:"status"`
+	Bytes  int64  `json:"bytes"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+	// Hash is set if -print-hash is given
+	Hash string `json:"hash,omitempty"`
+	// Timings is set if -trace is given and a request was made
+	Timings *jsonTimings `json:"timings,omitempty"`
+}
+
+// jsonTimings is the Timings of a download in a jsonFileSummary, in seconds.
+type jsonTimings struct {
+	Reused    bool    `json:"reused"`
+	DNS       float64 `json:"dns"`
+	Connect   float64 `json:"connect"`
+	TLS       float64 `json:"tls"`
+	FirstByte float64 `json:"first_byte"`
+	Total     float64 `json:"total"`
+}
+
+// printSummary writes a table to w showing the file, bytes downloaded, status and
+// duration of every download in result.
+func printSummary(w io.Writer, result *DownloadResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSIZE\tSTATUS\tTIME")
+	for _, file := range result.Files {
+		name := file.Path
+		if len(name) == 0 {
+			name = file.URL
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\n", name, formatByteSize(float64(file.BytesWritten)), file.Status(), file.Duration.Round(time.Millisecond))
+	}
+	tw.Flush()
+}
+
+// printOutcome writes to w how many of the files in result were downloaded to location.
+// Files that were skipped or failed don't count.
+func printOutcome(w io.Writer, result *DownloadResult, location string) {
+	var downloaded int
+	for _, file := range result.Files {
+		if file.Err == nil && !file.Skipped {
+			downloaded++
+		}
+	}
+	switch downloaded {
+	case 0:
+		fmt.Fprintln(w, "No files were downloaded")
+	case len(result.Files):
+		fmt.Fprintf(w, "File(s) downloaded to %s\n", location)
+	default:
+		fmt.Fprintf(w, "%d of %d files downloaded to %s\n", downloaded, len(result.Files), location)
+	}
+}
+
+// printJSONSummary writes the outcome of every download in result to w as a single
+// JSON object.
+func printJSONSummary(w io.Writer, result *DownloadResult) {
+	summary := jsonSummary{Status: "summary", Files: make([]jsonFileSummary, len(result.Files))}
+	for i, file := range result.Files {
+		summary.Files[i] = jsonFileSummary{
+			URL:      file.URL,
+			Path:     file.Path,
+			Status:   file.Status(),
+			Bytes:    file.BytesWritten,
+			Duration: file.Duration.Seconds(),
+			Hash:     file.Hash,
+		}
+		if file.Err != nil {
+			summary.Files[i].Error = file.Err.Error()
+		}
+		if t := file.Timings; t != nil {
+			summary.Files[i].Timings = &jsonTimings{
+				Reused:    t.Reused,
+				DNS:       t.DNS.Seconds(),
+				Connect:   t.Connect.Seconds(),
+				TLS:       t.TLS.Seconds(),
+				FirstByte: t.FirstByte.Seconds(),
+				Total:     t.Total.Seconds(),
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(summary)
+}
+
+// printHashes writes the hash of every file in result that has one to w, in the
+// "<hash>  <file>" format of sha256sum. A file written to stdout is named -.
+func printHashes(w io.Writer, result *DownloadResult) {
+	for _, file := range result.Files {
+		if len(file.Hash) == 0 {
+			continue
+		}
+		name := file.Path
+		if len(name) == 0 {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%s  %s\n", file.Hash, name)
+	}
+}
+
+// printTimings writes a table to w showing the timings of the request that downloaded
+// each file in result, for the files that were requested.
+func printTimings(w io.Writer, result *DownloadResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tDNS\tCONNECT\tTLS\tFIRST BYTE\tTOTAL\tREUSED")
+	for _, file := range result.Files {
+		t := file.Timings
+		if t == nil {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%v\t%v\t%v\t%v\n", file.URL, t.DNS.Round(time.Microsecond), t.Connect.Round(time.Microsecond), t.TLS.Round(time.Microsecond), t.FirstByte.Round(time.Microsecond), t.Total.Round(time.Microsecond), t.Reused)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleDownloadSummary(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader("hello world"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	location := t.TempDir()
+	err := os.WriteFile(filepath.Join(location, "resumed.txt.part"), []byte("hello"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-x", "3", "-retries", "0", "-location", location, ts.URL + "/completed.txt", ts.URL + "/resumed.txt", ts.URL + "/missing.txt"}
+	byteBuf := new(bytes.Buffer)
+	err = HandleDownload(byteBuf, args)
+	if err == nil {
+		t.Fatal("Expected non-nil error, Got: nil")
+	}
+
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^FILE +SIZE +STATUS +TIME$`),
+		regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(filepath.Join(location, "completed.txt")) + ` +11 B +completed +\S+$`),
+		regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(filepath.Join(location, "resumed.txt")) + ` +6 B +resumed +\S+$`),
+		regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(filepath.Join(location, "missing.txt")) + ` +0 B +failed +\S+$`),
+	}
+	for _, re := range expected {
+		if !re.Match(byteBuf.Bytes()) {
+			t.Fatalf("Expected output to match %s, Got: %s", re, byteBuf)
+		}
+	}
+
+	if !strings.Contains(byteBuf.String(), "2 of 3 files downloaded to "+location+"\n") {
+		t.Fatalf("Expected 2 of 3 files to be reported as downloaded, Got: %s", byteBuf)
+	}
+
+	// A run where every download fails doesn't look successful
+	byteBuf.Reset()
+	err = HandleDownload(byteBuf, []string{"-retries", "0", "-location", location, ts.URL + "/missing.txt"})
+	if err == nil {
+		t.Fatal("Expected non-nil error, Got: nil")
+	}
+	if !strings.HasSuffix(byteBuf.String(), "No files were downloaded\n") || strings.Contains(byteBuf.String(), "downloaded to") {
+		t.Fatalf("Expected no files to be reported as downloaded, Got: %s", byteBuf)
+	}
+
+	// -quiet hides the progress and the summary
+	byteBuf.Reset()
+	err = HandleDownload(byteBuf, []string{"-quiet", "-force", "-location", location, ts.URL + "/completed.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	if byteBuf.Len() != 0 {
+		t.Fatalf("Expected no output, Got: %s", byteBuf)
+	}
+}
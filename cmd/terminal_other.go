@@ -0,0 +1,13 @@
+//go:build !darwin && !freebsd && !linux
+
+package cmd
+
+import (
+	"errors"
+	"os"
+)
+
+// disableEcho isn't supported on this platform.
+func disableEcho(f *os.File) (func(), error) {
+	return nil, errors.New("echoing can't be turned off on this platform")
+}
@@ -0,0 +1,34 @@
+//go:build darwin || freebsd || linux
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// disableEcho stops the terminal f from echoing what is typed, so a password isn't shown
+// as it is entered, and returns a function that turns echoing back on.
+func disableEcho(f *os.File) (func(), error) {
+	var termios syscall.Termios
+	if err := ioctlTermios(f, ioctlGetTermios, &termios); err != nil {
+		return nil, err
+	}
+	saved := termios
+	termios.Lflag &^= syscall.ECHO
+	if err := ioctlTermios(f, ioctlSetTermios, &termios); err != nil {
+		return nil, err
+	}
+	return func() {
+		ioctlTermios(f, ioctlSetTermios, &saved)
+	}, nil
+}
+
+func ioctlTermios(f *os.File, request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
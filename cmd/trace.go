@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings breaks down the request that downloaded a file, like the timing variables of
+// curl's -w option. Each is the time from the start of the request until the end of a
+// phase. The phases of a connection are zero if an open connection was reused.
+type Timings struct {
+	// Reused reports that the request was sent on an open connection, such as the one
+	// the file was looked up on, so there was no DNS lookup, connection or handshake
+	Reused bool
+	// DNS is until the host name was resolved
+	DNS time.Duration
+	// Connect is until the TCP connection was established
+	Connect time.Duration
+	// TLS is until the TLS handshake was done, or zero for plain HTTP
+	TLS time.Duration
+	// FirstByte is until the first byte of the response arrived
+	FirstByte time.Duration
+	// Total is until the whole file was transferred
+	Total time.Duration
+}
+
+// traceKey is the context key of the requestTrace of a download.
+type traceKey struct{}
+
+// requestTrace records when each phase of the latest request of a download ended. It is
+// shared by the concurrent requests of a download in segments.
+type requestTrace struct {
+	mu                                  sync.Mutex
+	start, dns, connect, tls, firstByte time.Time
+	reused                              bool
+}
+
+// withRequestTrace returns a copy of ctx whose download requests are traced by tr.
+func withRequestTrace(ctx context.Context, tr *requestTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, tr)
+}
+
+// traceRequest returns a copy of ctx tracing a request with the requestTrace of ctx, or ctx
+// itself if it has none. The request replaces any earlier one in the trace.
+func traceRequest(ctx context.Context) context.Context {
+	tr, ok := ctx.Value(traceKey{}).(*requestTrace)
+	if !ok {
+		return ctx
+	}
+	tr.mu.Lock()
+	tr.start = time.Now()
+	tr.dns, tr.connect, tr.tls, tr.firstByte = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	tr.reused = false
+	tr.mu.Unlock()
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			tr.mu.Lock()
+			tr.reused = info.Reused
+			tr.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			tr.record(&tr.dns)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			tr.record(&tr.connect)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			tr.record(&tr.tls)
+		},
+		GotFirstResponseByte: func() {
+			tr.record(&tr.firstByte)
+		},
+	})
+}
+
+// record sets t to the current time.
+func (tr *requestTrace) record(t *time.Time) {
+	tr.mu.Lock()
+	*t = time.Now()
+	tr.mu.Unlock()
+}
+
+// timings returns the timings of the latest request, or nil if no request was traced.
+// The transfer is taken to have finished when timings is called.
+func (tr *requestTrace) timings() *Timings {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.start.IsZero() {
+		return nil
+	}
+	since := func(t time.Time) time.Duration {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Sub(tr.start)
+	}
+	return &Timings{
+		Reused:    tr.reused,
+		DNS:       since(tr.dns),
+		Connect:   since(tr.connect),
+		TLS:       since(tr.tls),
+		FirstByte: since(tr.firstByte),
+		Total:     time.Since(tr.start),
+	}
+}
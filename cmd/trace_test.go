@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestHandleDownloadTrace(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	byteBuf := new(bytes.Buffer)
+	err := HandleDownload(byteBuf, []string{"-trace", "-insecure", "-location", t.TempDir(), ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^URL +DNS +CONNECT +TLS +FIRST BYTE +TOTAL +REUSED$`),
+		regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(ts.URL+"/file.txt") + `( +\S+){5} +(true|false)$`),
+	}
+	for _, re := range expected {
+		if !re.Match(byteBuf.Bytes()) {
+			t.Fatalf("Expected output to match %s, Got: %s", re, byteBuf)
+		}
+	}
+
+	// The connection isn't reused when the file isn't looked up first
+	byteBuf.Reset()
+	err = HandleDownload(byteBuf, []string{"-trace", "-json", "-insecure", "-method", http.MethodPost, "-location", t.TempDir(), ts.URL + "/file.txt"})
+	if err != nil {
+		t.Fatalf("Expected nil error. Got: %v", err)
+	}
+	// The summary is the last line, after the warning about -insecure and the progress
+	lines := bytes.Split(bytes.TrimSpace(byteBuf.Bytes()), []byte("\n"))
+	var summary jsonSummary
+	if err := json.Unmarshal(lines[len(lines)-1], &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Files) != 1 || summary.Files[0].Timings == nil {
+		t.Fatalf("Expected the summary to have timings, Got: %+v", summary)
+	}
+	timings := summary.Files[0].Timings
+	if timings.Reused || timings.Connect <= 0 || timings.TLS < timings.Connect || timings.FirstByte < timings.TLS || timings.Total < timings.FirstByte {
+		t.Fatalf("Expected the timings of a new connection, Got: %+v", timings)
+	}
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxRangeURLs is the most urls a single url may expand into, which catches a
+// mistyped range before it floods the download queue.
+const maxRangeURLs = 10000
+
+// urlRangePattern matches a numeric range such as [1-10] or [001-100]. An IPv6
+// host such as [::1] has no dash between digits, so it is left alone.
+var urlRangePattern = regexp.MustCompile(`\[([0-9]*)-([0-9]*)\]`)
+
+// expandURLRange expands every numeric range in rawURL, so http://host/file[1-3].zip
+// becomes file1.zip, file2.zip and file3.zip. A range whose start has a leading zero
+// pads every number to the width of the start, as [01-10] gives 01, 02, ..., 10.
+// Several ranges expand into every combination, the last one varying fastest.
+// A url without a range is returned unchanged.
+func expandURLRange(rawURL string) ([]string, error) {
+	loc := urlRangePattern.FindStringSubmatchIndex(rawURL)
+	if loc == nil {
+		return []string{rawURL}, nil
+	}
+	prefix, suffix := rawURL[:loc[0]], rawURL[loc[1]:]
+	spec, from, to := rawURL[loc[0]:loc[1]], rawURL[loc[2]:loc[3]], rawURL[loc[4]:loc[5]]
+	if len(from) == 0 || len(to) == 0 {
+		return nil, fmt.Errorf("%w %s in %s: the start and end have to be numbers", ErrInvalidRange, spec, rawURL)
+	}
+	start, err := strconv.Atoi(from)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s in %s: %v", ErrInvalidRange, spec, rawURL, err)
+	}
+	end, err := strconv.Atoi(to)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s in %s: %v", ErrInvalidRange, spec, rawURL, err)
+	}
+	if start > end {
+		return nil, fmt.Errorf("%w %s in %s: the start is greater than the end", ErrInvalidRange, spec, rawURL)
+	}
+	if end-start >= maxRangeURLs {
+		return nil, fmt.Errorf("%w %s in %s: it expands into more than %d urls", ErrInvalidRange, spec, rawURL, maxRangeURLs)
+	}
+
+	// The rest of the url may hold further ranges
+	rest, err := expandURLRange(suffix)
+	if err != nil {
+		return nil, err
+	}
+	if (end-start+1)*len(rest) > maxRangeURLs {
+		return nil, fmt.Errorf("%w in %s: it expands into more than %d urls", ErrInvalidRange, rawURL, maxRangeURLs)
+	}
+
+	var width int
+	if len(from) > 1 && strings.HasPrefix(from, "0") {
+		width = len(from)
+	}
+	urls := make([]string, 0, (end-start+1)*len(rest))
+	for i := start; i <= end; i++ {
+		n := fmt.Sprintf("%0*d", width, i)
+		for _, r := range rest {
+			urls = append(urls, prefix+n+r)
+		}
+	}
+	return urls, nil
+}
+
+// expandURLRanges expands the ranges of a url and its mirrors together, returning
+// one list of the url followed by its mirrors for every url the ranges give. A
+// mirror without a range is kept for every url, while a mirror with one has to
+// expand into as many urls as the url itself.
+func expandURLRanges(urls []string) ([][]string, error) {
+	primary, err := expandURLRange(urls[0])
+	if err != nil {
+		return nil, err
+	}
+	expanded := make([][]string, len(primary))
+	for i, u := range primary {
+		expanded[i] = []string{u}
+	}
+	for _, mirror := range urls[1:] {
+		mirrors, err := expandURLRange(mirror)
+		if err != nil {
+			return nil, err
+		}
+		if len(mirrors) != 1 && len(mirrors) != len(primary) {
+			return nil, fmt.Errorf("%w in %s: the mirror expands into %d urls, but the url into %d", ErrInvalidRange, mirror, len(mirrors), len(primary))
+		}
+		for i := range expanded {
+			if len(mirrors) == 1 {
+				expanded[i] = append(expanded[i], mirrors[0])
+			} else {
+				expanded[i] = append(expanded[i], mirrors[i])
+			}
+		}
+	}
+	return expanded, nil
+}
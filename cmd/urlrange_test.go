@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExpandURLRange(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{"http://example.com/file.zip", []string{"http://example.com/file.zip"}},
+		{"http://example.com/file[1-3].zip", []string{"http://example.com/file1.zip", "http://example.com/file2.zip", "http://example.com/file3.zip"}},
+		{"http://example.com/file[08-10].zip", []string{"http://example.com/file08.zip", "http://example.com/file09.zip", "http://example.com/file10.zip"}},
+		{"http://example.com/[1-2]/file[0-1].zip", []string{"http://example.com/1/file0.zip", "http://example.com/1/file1.zip", "http://example.com/2/file0.zip", "http://example.com/2/file1.zip"}},
+		{"http://example.com/file[5-5].zip", []string{"http://example.com/file5.zip"}},
+		{"http://[::1]:8080/file.zip", []string{"http://[::1]:8080/file.zip"}},
+	}
+	for _, tc := range tests {
+		got, err := expandURLRange(tc.url)
+		if err != nil || !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: Expected: %v, Got: %v, %v", tc.url, tc.expected, got, err)
+		}
+	}
+
+	for _, rawURL := range []string{
+		"http://example.com/file[3-1].zip",
+		"http://example.com/file[-3].zip",
+		"http://example.com/file[1-].zip",
+		"http://example.com/file[1-99999999999999999999].zip",
+		"http://example.com/file[1-20000].zip",
+		"http://example.com/[1-200]/file[1-200].zip",
+	} {
+		_, err := expandURLRange(rawURL)
+		if !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("%s: Expected ErrInvalidRange, Got: %v", rawURL, err)
+		}
+	}
+}
+
+func TestExpandURLRanges(t *testing.T) {
+	got, err := expandURLRanges([]string{"http://example.com/file[1-2].zip", "http://mirror.example.com/file[1-2].zip", "http://backup.example.com/all.zip"})
+	expected := [][]string{
+		{"http://example.com/file1.zip", "http://mirror.example.com/file1.zip", "http://backup.example.com/all.zip"},
+		{"http://example.com/file2.zip", "http://mirror.example.com/file2.zip", "http://backup.example.com/all.zip"},
+	}
+	if err != nil || !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected: %v, Got: %v, %v", expected, got, err)
+	}
+
+	_, err = expandURLRanges([]string{"http://example.com/file[1-2].zip", "http://mirror.example.com/file[1-3].zip"})
+	if !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("Expected ErrInvalidRange, Got: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+)
+
+// Build information, set when building a release with
+//
+//	go build -ldflags "-X github.com/emzola/dlmanager/cmd.Version=1.2.0 -X github.com/emzola/dlmanager/cmd.Commit=$(git rev-parse --short HEAD) -X github.com/emzola/dlmanager/cmd.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	// Version is the version of dlmanager.
+	Version = "0.1.0"
+	// Commit is the git commit dlmanager was built from.
+	Commit = "unknown"
+	// BuildDate is the time dlmanager was built.
+	BuildDate = "unknown"
+)
+
+// HandleVersion prints the version, git commit and build date of dlmanager.
+func HandleVersion(w io.Writer) error {
+	fmt.Fprintf(w, "dlmanager %s (commit %s, built %s)\n", Version, Commit, BuildDate)
+	return nil
+}
@@ -13,7 +13,7 @@ var ErrInvalidSubCommand = errors.New("invalid sub-command specified")
 
 // printUsage displays help information.
 func printUsage(w io.Writer) error {
-	fmt.Fprintln(w, "Usage: Download Manager [download] -h")
+	fmt.Fprintln(w, "Usage: Download Manager [download|version|completion|clean|list|head] -h")
 	cmd.HandleDownload(w, []string{"-h"})
 	return nil
 }
@@ -30,6 +30,16 @@ func handleCommand(w io.Writer, args []string) error {
 			err = printUsage(w)
 		case "-help":
 			err = printUsage(w)
+		case "version", "-version":
+			err = cmd.HandleVersion(w)
+		case "completion":
+			err = cmd.HandleCompletion(w, args[1:])
+		case "clean":
+			err = cmd.HandleClean(w, args[1:])
+		case "list":
+			err = cmd.HandleList(w, args[1:])
+		case "head":
+			err = cmd.HandleHead(w, args[1:])
 		case "download":
 			err = cmd.HandleDownload(w, args[1:])
 		default:
@@ -49,7 +59,5 @@ func handleCommand(w io.Writer, args []string) error {
 
 func main() {
 	err := handleCommand(os.Stdout, os.Args[1:])
-	if err != nil {
-		os.Exit(1)
-	}
+	os.Exit(cmd.ExitCode(err))
 }
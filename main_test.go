@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
@@ -11,6 +14,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/emzola/dlmanager/cmd"
 )
 
 var binaryName string
@@ -26,6 +31,7 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		os.Exit(1)
 	}
+
 	defer func() {
 		err := os.Remove(binaryName)
 		if err != nil {
@@ -45,57 +51,76 @@ func TestSubCommandInvoke(t *testing.T) {
 	binaryPath := path.Join(curDir, binaryName)
 	t.Log(binaryPath)
 
-	tests := []struct{
-		args []string
-		input string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+	server := ts.URL + "/file.txt"
+	missing := ts.URL + "/missing.txt"
+
+	tests := []struct {
+		args                []string
+		input               string
 		expectedOutputLines []string
-		expectedExitCode int
+		expectedExitCode    int
 	}{
 		{
-			args: []string{},
+			args:                []string{},
 			expectedOutputLines: []string{},
-			expectedExitCode: 1,
+			expectedExitCode:    1,
 		},
 		{
-			args: []string{"download"},
-			expectedOutputLines: []string{"you have to specify the remote server"},
-			expectedExitCode: 1,
+			args:                []string{"download"},
+			expectedOutputLines: []string{"you have to specify a remote server to download from, or a -url-file"},
+			expectedExitCode:    1,
 		},
 		{
-			args: []string{"download", "127.0.0.1"},
+			args:             []string{"download", server},
 			expectedExitCode: 0,
 		},
 		{
-			args: []string{"download", "-location", "./downloads", "127.0.0.1"},
+			args:             []string{"download", "-location", "./downloads", server},
 			expectedExitCode: 0,
 		},
 		{
-			args: []string{"download", "-where", "./downloads", "127.0.0.1"},
+			args:                []string{"download", "-where", "./downloads", server},
 			expectedOutputLines: []string{"flag provided but not defined: -where"},
-			expectedExitCode: 1,
+			expectedExitCode:    1,
 		},
 		{
-			args: []string{"download", "-x", "2", "-location", "./downloads", "127.0.0.1", "127.0.0.1"},
+			args:             []string{"download", "-x", "2", "-location", "./downloads", server, server},
 			expectedExitCode: 0,
 		},
 		{
-			args: []string{"download", "-x", "2", "127.0.0.1", "127.0.0.1"},
+			args:             []string{"download", "-x", "2", server, server},
 			expectedExitCode: 0,
 		},
 		{
-			args: []string{"download", "-p", "2", "-location", "./downloads", "127.0.0.1", "127.0.0.1"},
+			args:                []string{"download", "-p", "2", "-location", "./downloads", server, server},
 			expectedOutputLines: []string{"flag provided but not defined: -p"},
-			expectedExitCode: 1,
+			expectedExitCode:    1,
+		},
+		{
+			args:                []string{"download", "-x", "2", "-location", "./downloads", server},
+			expectedOutputLines: []string{"you have to specify a remote server for each file given to -x: -x is 2, but 1 given"},
+			expectedExitCode:    1,
+		},
+		{
+			args:                []string{"download", "-x", "", "-location", "./downloads", server},
+			expectedOutputLines: []string{`invalid value "" for flag -x: parse error`},
+			expectedExitCode:    1,
 		},
 		{
-			args: []string{"download", "-x", "2", "-location", "./downloads", "127.0.0.1"},
-			expectedOutputLines: []string{"you have to specify a remote server for each file to download"},
-			expectedExitCode: 1,
+			args:             []string{"download", "-x", "2", server, missing},
+			expectedExitCode: 2,
 		},
 		{
-			args: []string{"download", "-x", "", "-location", "./downloads", "127.0.0.1"},
-			expectedOutputLines: []string{"you have to specify the number of files to download"},
-			expectedExitCode: 1,
+			args:             []string{"download", missing},
+			expectedExitCode: 3,
 		},
 	}
 
@@ -103,10 +128,13 @@ func TestSubCommandInvoke(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Logf("Executing %v %v\n", binaryPath, tc.args)
-		
+
 		cmd := exec.CommandContext(ctx, binaryPath, tc.args...)
+		cmd.Dir = t.TempDir()
+		// An empty home directory keeps a config file of the user running the tests out
+		cmd.Env = append(os.Environ(), "HOME="+t.TempDir())
 		cmd.Stdout = byteBuf
-	
+
 		if len(tc.input) != 0 {
 			cmd.Stdin = strings.NewReader(tc.input)
 		}
@@ -131,43 +159,223 @@ func TestSubCommandInvoke(t *testing.T) {
 	}
 }
 
+func TestVersionLdflags(t *testing.T) {
+	binaryPath := path.Join(t.TempDir(), binaryName)
+	ldflags := "-X github.com/emzola/dlmanager/cmd.Version=1.2.3 " +
+		"-X github.com/emzola/dlmanager/cmd.Commit=abc1234 " +
+		"-X github.com/emzola/dlmanager/cmd.BuildDate=2023-01-02T03:04:05Z"
+	err := exec.Command("go", "build", "-ldflags", ldflags, "-o", binaryPath).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command(binaryPath, "-version").Output()
+	if err != nil {
+		t.Fatalf("Expected application to exit without an error. Got: %v", err)
+	}
+	expected := "dlmanager 1.2.3 (commit abc1234, built 2023-01-02T03:04:05Z)\n"
+	if string(output) != expected {
+		t.Errorf("Expected: %q, Got: %q", expected, output)
+	}
+}
+
 func TestHandleCommand(t *testing.T) {
-	usageMessage := `Usage: Download Manager [download] -h
+	usageMessage := `Usage: Download Manager [download|version|completion|clean|list|head] -h
 
 download: An HTTP sub-command for downloading files
 
 download: <options> server
 
 options: 
+  -4	Only connect to IPv4 addresses
+  -6	Only connect to IPv6 addresses
+  -buffer-size string
+    	Size of the chunks files are read and written in, e.g. 64k or 1m (default "32k")
+  -cacert string
+    	File of PEM encoded CA certificates used to verify the server's TLS certificate
+  -checksum string
+    	Expected checksum of the downloaded file, as algorithm:hex (md5, sha1, sha256 or sha512)
+  -checksum-delete
+    	Delete the downloaded file if its checksum doesn't match
+  -checksum-file string
+    	Checksums file, such as SHA256SUMS, to verify each downloaded file listed in it against
+  -config file
+    	Config file of default option values, one name: value per line without the -, such as limit-rate: 500k. Lines starting with # are skipped and a value may be quoted. Defaults to ~/.dlmanagerrc if it exists
+  -continue-on-error
+    	Keep downloading the other files when one fails. If false, the first failure cancels the rest (default true)
+  -cookie string
+    	Cookie sent with every request, as name=value. Separate multiple cookies with ;
+  -data string
+    	Request body sent with -method
+  -data-file string
+    	File holding the request body sent with -method
+  -deadline duration
+    	Maximum total time to spend downloading all files. Unfinished downloads are abandoned and can be resumed later. 0 means no limit
+  -disable-http2
+    	Only use HTTP/1.1, even if the server supports HTTP/2
+  -dry-run
+    	Print what would be downloaded without downloading anything
+  -force
+    	Download files again from scratch, even if they are already complete
+  -guess-extension
+    	Add an extension based on the Content-Type to filenames that have none
+  -header header
+    	Extra request header as "Key: Value". May be repeated
+  -http-version version
+    	HTTP version to use: 2 negotiates HTTP/2 and falls back to HTTP/1.1, 1.1 only uses HTTP/1.1 (default "2")
+  -idle-conn-timeout duration
+    	How long an idle connection is kept open for reuse (default 1m30s)
+  -idle-timeout duration
+    	Abort and retry a download if no data arrives for this long. 0 means no limit
+  -insecure
+    	Don't verify the server's TLS certificate
+  -json
+    	Print progress and the summary as newline-delimited JSON objects
+  -k	Shorthand for -insecure
+  -level int
+    	Number of links deep -sync follows subdirectories and HTML pages inside the directory of the index
+  -limit-rate string
+    	Limit the combined download rate in bytes per second, e.g. 500k or 2m
+  -limit-rate-per-host string
+    	Limit the combined download rate from each host in bytes per second, e.g. 500k or 2m
   -location string
     	Download location (default "./downloads")
+  -location-must-exist
+    	Fail if the download location doesn't exist instead of creating it
+  -log-level string
+    	Messages to print: error for the outcome of each download, info to also print when it starts, debug to also print each request, resume and retry (default "info")
+  -max-concurrent int
+    	Maximum number of concurrent downloads (default 4)
+  -max-idle-conns int
+    	Maximum number of idle connections kept open for reuse (default 25)
+  -max-redirects int
+    	Maximum number of redirects to follow (default 10)
+  -max-retry-after duration
+    	Longest delay waited for before a retry, including when a 429 or 503 response asks to retry later in its Retry-After header (default 5m0s)
+  -merge-strategy string
+    	How the segments of a file are written: writeat, at their offset in the file, or concat, to files joined at the end (default "writeat")
+  -method string
+    	HTTP method files are requested with, e.g. POST. Files requested with another method than GET aren't resumed (default "GET")
+  -min-filesize string
+    	Fail files smaller than this many bytes, e.g. 1k, as likely error pages. Smaller files that were downloaded are deleted
+  -mirror url
+    	Mirror url tried if the url fails. May be repeated, in order of preference
+  -netrc
+    	Send the login and password for each host in $NETRC or ~/.netrc using basic authentication
+  -no-clobber
+    	Skip urls whose file already exists, without checking its size. -force takes precedence
+  -no-decompress
+    	Save gzip and deflate encoded files as sent instead of decompressing them
+  -no-head
+    	Look up files with a GET of their first byte instead of a HEAD request
+  -no-space-check
+    	Skip checking for enough free disk space before downloading
+  -o string
+    	Shorthand for -output
+  -on-conflict string
+    	What to do when urls are saved to the same file: rename, skip or error (default "rename")
+  -on-oversize string
+    	What to do when a partial download is larger than the remote file: restart or error (default "restart")
+  -output string
+    	Name of the downloaded file inside the download location, or - to write it to stdout
+  -password string
+    	Password for basic authentication. If omitted, it is read from $DLMANAGER_PASSWORD or stdin
+  -per-host
+    	Save files in a directory named after the host of their url inside the download location
+  -preserve-path
+    	Save files under the directories of their url path inside the download location
+  -print-hash
+    	Print the hash of each downloaded file, computed as it is written. It is sha256 unless md5, sha1 or sha512 is picked with -print-hash=algorithm, which needs the =
+  -progress-interval duration
+    	How often the progress of each file is shown (default 200ms)
+  -proxy url
+    	Proxy url as http://, https:// or socks5://host:port. Defaults to $HTTP_PROXY and $HTTPS_PROXY
+  -quiet
+    	Don't print progress or the summary
+  -referer url
+    	Referer url sent with every request
+  -rename string
+    	Template files are renamed by, with the placeholders {basename}, {host}, {date} and {index}, e.g. {date}-{basename}
+  -retries int
+    	Number of times to retry a failed download (default 3)
+  -retry-backoff duration
+    	Delay before the first retry, doubled on each retry up to -max-retry-after (default 1s)
+  -segments int
+    	Number of parallel range requests used to download each file (default 1)
+  -spider
+    	Check that every url responds with a success status and report broken links, without downloading anything
+  -strip-query
+    	Strip the query and fragment of urls from filenames. If false, the query is kept in the name (default true)
+  -sync
+    	Download the files listed in the index pages given as urls, such as the listing of a directory
+  -time-cond
+    	Only download urls whose file changed since the existing file was downloaded, using If-Modified-Since. -force takes precedence
+  -timeout duration
+    	Maximum total time to spend downloading each file, including retries. 0 means no limit
+  -token-env variable
+    	Environment variable holding a bearer token sent with every request as Authorization: Bearer
+  -token-file string
+    	File holding a bearer token sent with every request as Authorization: Bearer
+  -trace
+    	Print the DNS, connect, TLS, first byte and total time of the request downloading each file
+  -url-file string
+    	File, or http(s) url, containing list of url, each optionally followed by the path it is saved to
+  -user string
+    	Username for basic authentication, optionally as user:password
+  -user-agent string
+    	User-Agent sent with every request. Empty sends none (default "dlmanager/0.1.0")
+  -verbose
+    	Log the details of every request and response
+  -wait duration
+    	Pause before starting each download after the first, e.g. 1s. Use with -max-concurrent 1 to pause between downloads
   -x int
     	Number of files to download
+
+exit codes: 
+  0	All files were downloaded
+  1	Invalid command or options
+  2	Some files were downloaded, but others failed
+  3	No file was downloaded
 `
-	tests := []struct{
-		args []string
+	tests := []struct {
+		args   []string
 		output string
-		err error
+		err    error
 	}{
 		{
-			args: []string{},
+			args:   []string{},
 			output: "invalid sub-command specified\n" + usageMessage,
-			err: ErrInvalidSubCommand,
+			err:    ErrInvalidSubCommand,
 		},
 		{
-			args: []string{"foo"},
+			args:   []string{"foo"},
 			output: "invalid sub-command specified\n" + usageMessage,
-			err: ErrInvalidSubCommand,
+			err:    ErrInvalidSubCommand,
 		},
 		{
-			args: []string{"-h"},
+			args:   []string{"-h"},
 			output: usageMessage,
-			err: nil,
+			err:    nil,
 		},
 		{
-			args: []string{"-help"},
+			args:   []string{"-help"},
 			output: usageMessage,
-			err: nil,
+			err:    nil,
+		},
+		{
+			args:   []string{"completion", "powershell"},
+			output: cmd.ErrInvalidShell.Error() + "\n" + usageMessage,
+			err:    cmd.ErrInvalidShell,
+		},
+		{
+			args:   []string{"version"},
+			output: "dlmanager 0.1.0 (commit unknown, built unknown)\n",
+			err:    nil,
+		},
+		{
+			args:   []string{"-version"},
+			output: "dlmanager 0.1.0 (commit unknown, built unknown)\n",
+			err:    nil,
 		},
 	}
 
@@ -188,4 +396,4 @@ options:
 		}
 		byteBuf.Reset()
 	}
-}
\ No newline at end of file
+}